@@ -0,0 +1,356 @@
+package i2pbridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// decisionLog is how many of its latest decisions an Adaptive keeps
+const decisionLog = 32
+
+// AdaptiveOptions tune an Adaptive controller. Fields left zero get the
+// value from DefaultAdaptiveOptions.
+type AdaptiveOptions struct {
+	// MinQuantity and MaxQuantity bound the tunnels kept each way, 1 to 16
+	MinQuantity int
+	MaxQuantity int
+	// Interval is how often the load is measured
+	Interval time.Duration
+	// HighBytes and LowBytes are bytes per second per tunnel, and
+	// HighStreams and LowStreams open streams per tunnel. Past either high
+	// mark a tunnel is added, under both low marks one is dropped.
+	HighBytes   int
+	LowBytes    int
+	HighStreams int
+	LowStreams  int
+	// Sustain is how many intervals in a row the load has to stay past a
+	// mark before anything changes, and Cooldown how long after a change
+	// before the next one.
+	Sustain  int
+	Cooldown time.Duration
+}
+
+// DefaultAdaptiveOptions are 2 to 6 tunnels, measured every 30 seconds, with a
+// change at most every 10 minutes.
+func DefaultAdaptiveOptions() AdaptiveOptions {
+	return AdaptiveOptions{
+		MinQuantity: 2,
+		MaxQuantity: 6,
+		Interval:    30 * time.Second,
+		HighBytes:   32 << 10,
+		LowBytes:    4 << 10,
+		HighStreams: 8,
+		LowStreams:  2,
+		Sustain:     3,
+		Cooldown:    10 * time.Minute,
+	}
+}
+
+func (o AdaptiveOptions) withDefaults() AdaptiveOptions {
+	d := DefaultAdaptiveOptions()
+	ints := []struct{ v, def *int }{
+		{&o.MinQuantity, &d.MinQuantity},
+		{&o.MaxQuantity, &d.MaxQuantity},
+		{&o.HighBytes, &d.HighBytes},
+		{&o.LowBytes, &d.LowBytes},
+		{&o.HighStreams, &d.HighStreams},
+		{&o.LowStreams, &d.LowStreams},
+		{&o.Sustain, &d.Sustain},
+	}
+	for _, f := range ints {
+		if *f.v == 0 {
+			*f.v = *f.def
+		}
+	}
+	if o.Interval == 0 {
+		o.Interval = d.Interval
+	}
+	if o.Cooldown == 0 {
+		o.Cooldown = d.Cooldown
+	}
+	return o
+}
+
+// Validate checks the options make sense, once the defaults are filled in
+func (o AdaptiveOptions) Validate() error {
+	o = o.withDefaults()
+	var problems []string
+	if o.MinQuantity < 1 || o.MaxQuantity > 16 || o.MinQuantity > o.MaxQuantity {
+		problems = append(problems, fmt.Sprintf("quantity has to stay within 1 to 16, not %d to %d", o.MinQuantity, o.MaxQuantity))
+	}
+	if o.LowBytes < 0 || o.LowBytes >= o.HighBytes {
+		problems = append(problems, fmt.Sprintf("LowBytes (%d) has to be below HighBytes (%d)", o.LowBytes, o.HighBytes))
+	}
+	if o.LowStreams < 0 || o.LowStreams >= o.HighStreams {
+		problems = append(problems, fmt.Sprintf("LowStreams (%d) has to be below HighStreams (%d)", o.LowStreams, o.HighStreams))
+	}
+	if o.Interval < 0 || o.Cooldown < 0 || o.Sustain < 0 {
+		problems = append(problems, "Interval, Cooldown and Sustain can't be negative")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid adaptive tunnel options: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Decision is a change of tunnel quantity an Adaptive made
+type Decision struct {
+	Time     time.Time
+	From, To int
+	// Throughput, in bytes per second, and Streams are the load it went by
+	Throughput float64
+	Streams    int
+	Reason     string
+	// Err is why the session couldn't be moved to the new quantity
+	Err error
+}
+
+// AdaptiveStats is what an Adaptive has measured and done
+type AdaptiveStats struct {
+	// Quantity is the tunnels each way right now
+	Quantity int
+	// Throughput and Streams are the last measurements
+	Throughput float64
+	Streams    int
+	// Ups, Downs and Failures count changes made and ones that didn't work
+	Ups      uint64
+	Downs    uint64
+	Failures uint64
+	// Decisions are the latest, oldest first
+	Decisions []Decision
+}
+
+// Adaptive adds tunnels to a Supervisor's session when it's busy and drops
+// them when it's idle, within bounds. It measures throughput and open streams
+// per tunnel every Interval, and only acts once the load has stayed past a
+// mark for Sustain intervals, and not again for Cooldown, so that it doesn't
+// flap. Changes go through Supervisor.TryReconfigure, so on bridges that
+// won't have a destination in two sessions at once they're skipped rather
+// than draining the session.
+type Adaptive struct {
+	// Sessions are what's measured, the supervisor's session unless set.
+	// Apply moves everything to quantity tunnels each way, with the
+	// supervisor's TryReconfigure unless set. Set them before Start.
+	Sessions func() []*StreamSession
+	Apply    func(ctx context.Context, quantity int) error
+
+	s    *Supervisor
+	opts AdaptiveOptions
+
+	mu         sync.Mutex
+	quantity   int
+	throughput float64
+	streams    int
+	upRun      int
+	downRun    int
+	changed    time.Time
+	stats      AdaptiveStats
+
+	// lastBytes is where the previous measurement left off, by session
+	lastBytes map[*StreamSession]uint64
+
+	once sync.Once
+	stop chan struct{}
+}
+
+// NewAdaptive sets up a controller for s, it does nothing until Start
+func NewAdaptive(s *Supervisor, o AdaptiveOptions) (*Adaptive, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	o = o.withDefaults()
+	q := quantityOf(s.Options(), o.MinQuantity)
+	if q < o.MinQuantity {
+		q = o.MinQuantity
+	} else if q > o.MaxQuantity {
+		q = o.MaxQuantity
+	}
+	a := &Adaptive{s: s, opts: o, quantity: q, stop: make(chan struct{})}
+	a.Sessions = func() []*StreamSession {
+		if ss := s.Current(); ss != nil {
+			return []*StreamSession{ss}
+		}
+		return nil
+	}
+	a.Apply = func(ctx context.Context, quantity int) error {
+		return s.TryReconfigure(ctx, withQuantity(s.Options(), quantity))
+	}
+	return a, nil
+}
+
+// Start starts measuring, more than once is fine
+func (a *Adaptive) Start() {
+	a.once.Do(func() {
+		go a.run()
+	})
+}
+
+// Close stops the controller, the session keeps whatever quantity it has
+func (a *Adaptive) Close() error {
+	a.once.Do(func() {})
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	select {
+	case <-a.stop:
+	default:
+		close(a.stop)
+	}
+	return nil
+}
+
+// Stats reports the last measurements and the decisions made
+func (a *Adaptive) Stats() AdaptiveStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st := a.stats
+	st.Quantity = a.quantity
+	st.Throughput = a.throughput
+	st.Streams = a.streams
+	st.Decisions = append([]Decision{}, a.stats.Decisions...)
+	return st
+}
+
+func (a *Adaptive) run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-a.stop:
+		case <-a.s.done:
+		}
+		cancel()
+	}()
+	ticker := time.NewTicker(a.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		throughput, streams, ok := a.measure()
+		if !ok {
+			continue
+		}
+		// someone else may have reconfigured the session
+		a.mu.Lock()
+		a.quantity = quantityOf(a.s.Options(), a.quantity)
+		a.mu.Unlock()
+		d, ok := a.observe(throughput, streams, time.Now())
+		if !ok {
+			continue
+		}
+		if d.Err = a.Apply(ctx, d.To); errors.Is(d.Err, ErrDuplicatedDest) {
+			d.Reason += ", skipped since the bridge won't make a second session for the destination"
+		}
+		a.record(d)
+	}
+}
+
+// measure is the throughput since the last time, and the open streams, over
+// every session. Sessions seen for the first time only count their streams,
+// and it's false if none had been seen before, since there's nothing to
+// compare with yet.
+func (a *Adaptive) measure() (float64, int, bool) {
+	seen := map[*StreamSession]uint64{}
+	var bytes uint64
+	var streams int
+	ok := false
+	for _, ss := range a.Sessions() {
+		read, written := ss.Traffic()
+		total := read + written
+		if last, known := a.lastBytes[ss]; known {
+			bytes += total - last
+			ok = true
+		}
+		seen[ss] = total
+		streams += ss.Streams()
+	}
+	a.lastBytes = seen
+	return float64(bytes) / a.opts.Interval.Seconds(), streams, ok
+}
+
+// observe takes a measurement in, and says if the quantity should change
+func (a *Adaptive) observe(throughput float64, streams int, now time.Time) (Decision, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.throughput, a.streams = throughput, streams
+	q := float64(a.quantity)
+	bytes, perStream := throughput/q, float64(streams)/q
+	switch {
+	case bytes > float64(a.opts.HighBytes) || perStream > float64(a.opts.HighStreams):
+		a.upRun++
+		a.downRun = 0
+	case bytes < float64(a.opts.LowBytes) && perStream < float64(a.opts.LowStreams):
+		a.downRun++
+		a.upRun = 0
+	default:
+		a.upRun, a.downRun = 0, 0
+	}
+	if !a.changed.IsZero() && now.Sub(a.changed) < a.opts.Cooldown {
+		return Decision{}, false
+	}
+	d := Decision{Time: now, From: a.quantity, Throughput: throughput, Streams: streams}
+	switch {
+	case a.upRun >= a.opts.Sustain && a.quantity < a.opts.MaxQuantity:
+		d.To = a.quantity + 1
+		d.Reason = fmt.Sprintf("%.0f B/s and %d streams over %d tunnels for %d intervals", throughput, streams, a.quantity, a.upRun)
+	case a.downRun >= a.opts.Sustain && a.quantity > a.opts.MinQuantity:
+		d.To = a.quantity - 1
+		d.Reason = fmt.Sprintf("only %.0f B/s and %d streams over %d tunnels for %d intervals", throughput, streams, a.quantity, a.downRun)
+	default:
+		return Decision{}, false
+	}
+	a.upRun, a.downRun = 0, 0
+	a.changed = now
+	return d, true
+}
+
+// record keeps d, and takes its quantity on if it worked
+func (a *Adaptive) record(d Decision) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case d.Err != nil:
+		a.stats.Failures++
+	case d.To > d.From:
+		a.stats.Ups++
+		a.quantity = d.To
+	default:
+		a.stats.Downs++
+		a.quantity = d.To
+	}
+	a.stats.Decisions = append(a.stats.Decisions, d)
+	if len(a.stats.Decisions) > decisionLog {
+		a.stats.Decisions = a.stats.Decisions[len(a.stats.Decisions)-decisionLog:]
+	}
+}
+
+// quantityOf is the inbound tunnel quantity in options, or def
+func quantityOf(options []string, def int) int {
+	for _, o := range options {
+		if v := strings.TrimPrefix(o, "inbound.quantity="); v != o {
+			if n, err := strconv.Atoi(v); err == nil {
+				return n
+			}
+		}
+	}
+	return def
+}
+
+// withQuantity is options with q tunnels each way
+func withQuantity(options []string, q int) []string {
+	var out []string
+	for _, o := range options {
+		if !strings.HasPrefix(o, "inbound.quantity=") && !strings.HasPrefix(o, "outbound.quantity=") {
+			out = append(out, o)
+		}
+	}
+	n := strconv.Itoa(q)
+	return append(out, "inbound.quantity="+n, "outbound.quantity="+n)
+}
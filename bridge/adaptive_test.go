@@ -0,0 +1,172 @@
+package i2pbridge
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveObserve(t *testing.T) {
+	s := NewSupervisor(nil, testKeySource, []string{"inbound.quantity=3"})
+	a, err := NewAdaptive(s, AdaptiveOptions{MinQuantity: 2, MaxQuantity: 4, Sustain: 2, Cooldown: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Stats().Quantity != 3 {
+		t.Fatalf("started at %d tunnels, want 3 from the options", a.Stats().Quantity)
+	}
+	now := time.Now()
+	busy := float64(3 * (64 << 10))
+	if _, ok := a.observe(busy, 0, now); ok {
+		t.Fatal("changed after one busy interval, Sustain is 2")
+	}
+	d, ok := a.observe(busy, 0, now.Add(time.Second))
+	if !ok || d.From != 3 || d.To != 4 {
+		t.Fatalf("got %+v, want 3 to 4", d)
+	}
+	a.record(d)
+
+	// cooldown, then the upper bound
+	a.observe(busy, 0, now.Add(2*time.Second))
+	if _, ok := a.observe(busy, 0, now.Add(3*time.Second)); ok {
+		t.Error("changed again within the cooldown")
+	}
+	if _, ok := a.observe(busy, 0, now.Add(2*time.Minute)); ok {
+		t.Error("went past MaxQuantity")
+	}
+
+	// in between the marks, nothing happens
+	middle := float64(4 * (16 << 10))
+	for i := 0; i < 5; i++ {
+		if _, ok := a.observe(middle, 0, now.Add(time.Hour+time.Duration(i)*time.Second)); ok {
+			t.Fatal("changed with the load between the marks")
+		}
+	}
+	a.observe(0, 0, now.Add(2*time.Hour))
+	d, ok = a.observe(0, 0, now.Add(2*time.Hour+time.Second))
+	if !ok || d.To != 3 {
+		t.Fatalf("got %+v, want 4 to 3", d)
+	}
+	a.record(d)
+	st := a.Stats()
+	if st.Quantity != 3 || st.Ups != 1 || st.Downs != 1 || len(st.Decisions) != 2 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestAdaptiveOptionsValidate(t *testing.T) {
+	if err := (AdaptiveOptions{}).Validate(); err != nil {
+		t.Errorf("defaults: %v", err)
+	}
+	if err := (AdaptiveOptions{MinQuantity: 5, MaxQuantity: 3}).Validate(); err == nil {
+		t.Error("min above max accepted")
+	}
+	if err := (AdaptiveOptions{LowBytes: 100, HighBytes: 10}).Validate(); err == nil {
+		t.Error("low mark above high mark accepted")
+	}
+}
+
+func TestAdaptiveReconfigures(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	s := fastSupervisor(r.bridge())
+	defer s.Close()
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAdaptive(s, AdaptiveOptions{
+		MinQuantity: 2,
+		MaxQuantity: 3,
+		Interval:    20 * time.Millisecond,
+		HighStreams: 3,
+		LowStreams:  1,
+		Sustain:     1,
+		Cooldown:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	// 7 streams over 2 tunnels is past the high mark
+	for i := 0; i < 7; i++ {
+		c, err := s.DialContextI2P(ctx, "", testPeer(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	a.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Stats().Ups == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("didn't scale up, stats %+v", a.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	create := r.lastCreate()
+	if create["inbound.quantity"] != "3" || create["outbound.quantity"] != "3" {
+		t.Errorf("new session made with %v", create)
+	}
+	if q := a.Stats().Quantity; q != 3 {
+		t.Errorf("quantity %d", q)
+	}
+}
+
+func TestAdaptiveDuplicatedDest(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	r.uniqueDests = true
+	s := fastSupervisor(r.bridge())
+	defer s.Close()
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	old := s.Current()
+	a, err := NewAdaptive(s, AdaptiveOptions{
+		MinQuantity: 2,
+		MaxQuantity: 3,
+		Interval:    20 * time.Millisecond,
+		HighStreams: 3,
+		LowStreams:  1,
+		Sustain:     1,
+		Cooldown:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for i := 0; i < 7; i++ {
+		c, err := s.DialContextI2P(ctx, "", testPeer(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	a.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Stats().Failures == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("didn't try to scale up, stats %+v", a.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	st := a.Stats()
+	if d := st.Decisions[len(st.Decisions)-1]; !errors.Is(d.Err, ErrDuplicatedDest) {
+		t.Errorf("decision failed with %v, want ErrDuplicatedDest", d.Err)
+	}
+	if st.Quantity != 2 || st.Ups != 0 {
+		t.Errorf("stats %+v, the quantity shouldn't have changed", st)
+	}
+	// the session was left alone rather than drained
+	if st := s.Status(); s.Current() != old || (st != StatusReady && st != StatusPublished) {
+		t.Errorf("status %s, the session should have been kept", st)
+	}
+	short, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	c, err := s.DialContextI2P(short, "", testPeer(t))
+	if err != nil {
+		t.Fatalf("dial after a skipped change: %v", err)
+	}
+	c.Close()
+}
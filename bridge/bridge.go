@@ -0,0 +1,292 @@
+package i2pbridge
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAddress is where the SAM bridge listens out of the box
+	DefaultAddress = "127.0.0.1:7656"
+
+	// helloTimeout bounds connecting to the bridge and the HELLO handshake
+	helloTimeout = 30 * time.Second
+)
+
+// ErrAuthFailed is returned when the bridge rejects our USER and PASSWORD, or
+// wants credentials and we didn't have any.
+var ErrAuthFailed = errors.New("SAM bridge authentication failed")
+
+// Bridge is everything needed to open a connection to a SAM bridge. Every
+// control and data connection opened for a session goes through the same
+// Bridge, so they all authenticate and encrypt the same way.
+type Bridge struct {
+	Address  string
+	User     string
+	Password string
+	// TLS, if set, wraps every connection to the bridge in TLS, see TLSConfig
+	TLS *tls.Config
+}
+
+// Default returns a Bridge for the usual unauthenticated local SAM bridge
+func Default() *Bridge {
+	return &Bridge{Address: DefaultAddress}
+}
+
+func (b *Bridge) address() string {
+	if b == nil || b.Address == "" {
+		return DefaultAddress
+	}
+	return b.Address
+}
+
+// String describes the bridge, without the password
+func (b *Bridge) String() string {
+	s := b.address()
+	if b.User != "" {
+		s = b.User + "@" + s
+	}
+	if b.TLS != nil {
+		s = "tls://" + s
+	}
+	return s
+}
+
+// Conn is a connection to the SAM bridge which has already said HELLO
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	wmu     sync.Mutex
+	Version Version
+}
+
+// Dial connects to the bridge and negotiates a SAM version, authenticating
+// if the Bridge has credentials.
+func (b *Bridge) Dial() (*Conn, error) {
+	return b.DialContext(context.Background())
+}
+
+// DialContext is like Dial, but gives up when ctx is done
+func (b *Bridge) DialContext(ctx context.Context) (*Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, helloTimeout)
+	defer cancel()
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", b.address())
+	if err != nil {
+		return nil, err
+	}
+	if b.TLS != nil {
+		tc := tls.Client(nc, b.clientTLS())
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("TLS handshake with SAM bridge at %s: %w", b.address(), err)
+		}
+		nc = tc
+	}
+	c := &Conn{Conn: nc, r: bufio.NewReader(nc)}
+	deadline, _ := ctx.Deadline()
+	stop := closeOnDone(ctx, nc)
+	err = c.hello(b, deadline)
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conn) hello(b *Bridge, deadline time.Time) error {
+	c.SetDeadline(deadline)
+	defer c.SetDeadline(time.Time{})
+	min := MinVersion
+	auth := ""
+	if b.User != "" || b.Password != "" {
+		// authentication arrived in 3.2, there's no point asking for less
+		min = authVersion
+		auth = " USER=" + quote(b.User) + " PASSWORD=" + quote(b.Password)
+	}
+	r, err := c.Command("HELLO VERSION MIN=" + min.String() + " MAX=" + MaxVersion.String() + auth)
+	if err != nil {
+		return err
+	}
+	switch r.Result() {
+	case "OK":
+		// bridges that only speak 3.0 may not say which version they picked
+		c.Version = MinVersion
+		if v, ok := r.Pairs["VERSION"]; ok {
+			if c.Version, err = ParseVersion(v); err != nil {
+				return err
+			}
+		}
+		if !c.Version.AtLeast(min) || !MaxVersion.AtLeast(c.Version) {
+			return fmt.Errorf("SAM bridge at %s picked version %s, we asked for %s to %s", b.address(), c.Version, min, MaxVersion)
+		}
+		return nil
+	case "NOVERSION":
+		return fmt.Errorf("%w: SAM bridge at %s doesn't speak SAM %s to %s", ErrVersionUnsupported, b.address(), min, MaxVersion)
+	}
+	msg := strings.ToLower(r.Pairs["MESSAGE"])
+	if b.User != "" || b.Password != "" || strings.Contains(msg, "auth") || strings.Contains(msg, "password") {
+		return fmt.Errorf("%w: %s: %s", ErrAuthFailed, b, r.Message())
+	}
+	return r.Err()
+}
+
+// Capabilities says what the bridge can do on this connection
+func (c *Conn) Capabilities() Capabilities {
+	return CapabilitiesOf(c.Version)
+}
+
+// Capabilities connects to the bridge just to find out what it supports
+func (b *Bridge) Capabilities() (Capabilities, error) {
+	c, err := b.Dial()
+	if err != nil {
+		return Capabilities{}, err
+	}
+	defer c.Close()
+	return c.Capabilities(), nil
+}
+
+// Command sends one command line and reads one reply line
+func (c *Conn) Command(cmd string) (*Reply, error) {
+	if err := c.WriteLine(cmd); err != nil {
+		return nil, err
+	}
+	return c.ReadReply()
+}
+
+// WriteLine sends one line to the bridge. Lines from different goroutines
+// don't get mixed up.
+func (c *Conn) WriteLine(line string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Write([]byte(line + "\n"))
+	return err
+}
+
+// ReadReply reads one reply line from the bridge
+func (c *Conn) ReadReply() (*Reply, error) {
+	line, err := c.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	return ParseReply(line)
+}
+
+// ReadLine reads a line from the bridge, without its line ending
+func (c *Conn) ReadLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Read reads through the buffer, in case the bridge sent data along with its
+// last reply.
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Reply is a parsed line from the SAM bridge, like
+// "STREAM STATUS RESULT=CANT_REACH_PEER MESSAGE=..."
+type Reply struct {
+	Topic string
+	Type  string
+	Pairs map[string]string
+}
+
+// ParseReply splits a reply line into its words and KEY=VALUE pairs. Values
+// may be double quoted, with backslash escapes.
+func ParseReply(line string) (*Reply, error) {
+	words, err := splitWords(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) < 2 {
+		return nil, fmt.Errorf("unable to parse SAM reply %q", line)
+	}
+	r := &Reply{Topic: words[0], Type: words[1], Pairs: map[string]string{}}
+	for _, w := range words[2:] {
+		kv := strings.SplitN(w, "=", 2)
+		if len(kv) == 2 {
+			r.Pairs[kv[0]] = kv[1]
+		} else {
+			r.Pairs[kv[0]] = ""
+		}
+	}
+	return r, nil
+}
+
+// Result is the RESULT= of the reply
+func (r *Reply) Result() string {
+	return r.Pairs["RESULT"]
+}
+
+// Message is the MESSAGE= of the reply, or the result if there isn't one
+func (r *Reply) Message() string {
+	if m, ok := r.Pairs["MESSAGE"]; ok && m != "" {
+		return m
+	}
+	return r.Result()
+}
+
+// Err turns anything but RESULT=OK into an *Error
+func (r *Reply) Err() error {
+	if r.Result() == "OK" {
+		return nil
+	}
+	return newError(r)
+}
+
+// splitWords splits a SAM line on spaces, keeping double quoted runs together
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var cur strings.Builder
+	inWord, inQuote, escaped := false, false, false
+	for _, c := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(c)
+			escaped = false
+		case inQuote && c == '\\':
+			escaped = true
+		case c == '"':
+			inQuote = !inQuote
+			inWord = true
+		case !inQuote && (c == ' ' || c == '\t'):
+			if inWord {
+				words = append(words, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(c)
+			inWord = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote in SAM line %q", line)
+	}
+	if inWord {
+		words = append(words, cur.String())
+	}
+	return words, nil
+}
+
+// quote makes a value safe to send, quoting it if it has spaces or quotes
+func quote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"\\=") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,106 @@
+package i2pbridge
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeSAM answers HELLO on every connection it accepts with whatever reply
+// returns, and records the HELLO lines it got.
+func fakeSAM(t *testing.T, reply func(hello string) string) (addr string, hellos chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	hellos = make(chan string, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				line, err := bufio.NewReader(c).ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimSpace(line)
+				hellos <- line
+				c.Write([]byte(reply(line) + "\n"))
+			}(c)
+		}
+	}()
+	return l.Addr().String(), hellos
+}
+
+func TestDialSendsCredentials(t *testing.T) {
+	addr, hellos := fakeSAM(t, func(hello string) string {
+		r, _ := ParseReply(hello)
+		if r.Pairs["USER"] == "alice" && r.Pairs["PASSWORD"] == `pa ss"word` {
+			return "HELLO REPLY RESULT=OK VERSION=3.2"
+		}
+		return `HELLO REPLY RESULT=I2P_ERROR MESSAGE="Authentication failed"`
+	})
+	b := &Bridge{Address: addr, User: "alice", Password: `pa ss"word`}
+	c, err := b.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Version != (Version{3, 2}) {
+		t.Errorf("got version %s, want 3.2", c.Version)
+	}
+	if h := <-hellos; !strings.Contains(h, "MIN=3.2") {
+		t.Errorf("authenticating HELLO should ask for 3.2 at least: %s", h)
+	}
+}
+
+func TestDialAuthFailed(t *testing.T) {
+	addr, _ := fakeSAM(t, func(string) string {
+		return `HELLO REPLY RESULT=I2P_ERROR MESSAGE="Authentication failed"`
+	})
+	b := &Bridge{Address: addr, User: "alice", Password: "wrong"}
+	_, err := b.Dial()
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("got %v, want ErrAuthFailed", err)
+	}
+	if strings.Contains(err.Error(), "wrong") {
+		t.Errorf("error leaks the password: %s", err)
+	}
+}
+
+func TestDialWithoutCredentials(t *testing.T) {
+	addr, hellos := fakeSAM(t, func(string) string {
+		return "HELLO REPLY RESULT=OK VERSION=3.1"
+	})
+	c, err := (&Bridge{Address: addr}).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if h := <-hellos; strings.Contains(h, "USER") || strings.Contains(h, "PASSWORD") {
+		t.Errorf("sent credentials we don't have: %s", h)
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	r, err := ParseReply(`STREAM STATUS RESULT=CANT_REACH_PEER MESSAGE="Can't \"reach\" peer"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Topic != "STREAM" || r.Type != "STATUS" || r.Result() != "CANT_REACH_PEER" {
+		t.Errorf("parsed %+v", r)
+	}
+	if m := r.Message(); m != `Can't "reach" peer` {
+		t.Errorf("got message %q", m)
+	}
+	if _, err := ParseReply(`HELLO REPLY MESSAGE="oops`); err == nil {
+		t.Error("unterminated quote should fail")
+	}
+}
@@ -0,0 +1,120 @@
+package i2pbridge
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// The RESULT codes the bridge fails with. A failed reply comes back as an
+// *Error, which matches one of these with errors.Is.
+var (
+	// ErrCantReachPeer means the peer exists but couldn't be reached, usually
+	// because our tunnels or theirs aren't up yet.
+	ErrCantReachPeer = errors.New("can't reach peer")
+	// ErrPeerNotFound means the peer's lease set couldn't be found. Name
+	// lookups that fail with KEY_NOT_FOUND match it too.
+	ErrPeerNotFound = errors.New("peer not found")
+	// ErrInvalidKey means a destination or private key was malformed
+	ErrInvalidKey = errors.New("invalid key")
+	// ErrInvalidID means there's no session with that ID
+	ErrInvalidID = errors.New("invalid session ID")
+	// ErrDuplicatedID means a session with that ID already exists
+	ErrDuplicatedID = errors.New("duplicated session ID")
+	// ErrDuplicatedDest means another session is already using the keys
+	ErrDuplicatedDest = errors.New("duplicated destination")
+	// ErrTimeout means the router gave up waiting
+	ErrTimeout = errors.New("timeout")
+	// ErrI2PError is the router's catch all, and what any result code we
+	// don't know about is treated as.
+	ErrI2PError = errors.New("I2P error")
+)
+
+var resultErrors = map[string]error{
+	"CANT_REACH_PEER": ErrCantReachPeer,
+	"PEER_NOT_FOUND":  ErrPeerNotFound,
+	"KEY_NOT_FOUND":   ErrPeerNotFound,
+	"INVALID_KEY":     ErrInvalidKey,
+	"INVALID_ID":      ErrInvalidID,
+	"DUPLICATED_ID":   ErrDuplicatedID,
+	"DUPLICATED_DEST": ErrDuplicatedDest,
+	"TIMEOUT":         ErrTimeout,
+	"I2P_ERROR":       ErrI2PError,
+}
+
+// retryable are the failures that may well go away if tried again later.
+// The rest are down to our keys, IDs or configuration and won't.
+var retryable = map[error]bool{
+	ErrCantReachPeer: true,
+	ErrPeerNotFound:  true,
+	ErrTimeout:       true,
+	ErrI2PError:      true,
+}
+
+// Error is a failed reply from the bridge
+type Error struct {
+	// Topic and Type are the reply's first two words, like "STREAM STATUS"
+	Topic   string
+	Type    string
+	Result  string
+	Message string
+	err     error
+}
+
+func newError(r *Reply) *Error {
+	err, ok := resultErrors[r.Result()]
+	if !ok {
+		err = ErrI2PError
+	}
+	return &Error{
+		Topic:   r.Topic,
+		Type:    r.Type,
+		Result:  r.Result(),
+		Message: r.Pairs["MESSAGE"],
+		err:     err,
+	}
+}
+
+func (e *Error) Error() string {
+	s := "SAM " + e.Topic + " " + e.Type + " failed: " + e.Result
+	if e.Result == "" {
+		s += "no result"
+	}
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+// Unwrap returns the sentinel for the result code, so errors.Is works
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Temporary is true if trying again later might work, see IsRetryable
+func (e *Error) Temporary() bool {
+	return retryable[e.err]
+}
+
+// IsRetryable says whether an error from the bridge might go away if the same
+// thing is tried again later: unreachable or unknown peers, timeouts and
+// router errors, network errors that say they're temporary, and the bridge
+// refusing or dropping the connection, as it does while the router restarts.
+// Bad keys, clashing session IDs or destinations, failed authentication and
+// missing SAM versions are permanent.
+func IsRetryable(err error) bool {
+	var samErr *Error
+	if errors.As(err, &samErr) {
+		return samErr.Temporary()
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+	return false
+}
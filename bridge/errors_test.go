@@ -0,0 +1,86 @@
+package i2pbridge
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestReplyErrors(t *testing.T) {
+	cases := []struct {
+		result    string
+		sentinel  error
+		retryable bool
+	}{
+		{"CANT_REACH_PEER", ErrCantReachPeer, true},
+		{"PEER_NOT_FOUND", ErrPeerNotFound, true},
+		{"KEY_NOT_FOUND", ErrPeerNotFound, true},
+		{"INVALID_KEY", ErrInvalidKey, false},
+		{"INVALID_ID", ErrInvalidID, false},
+		{"DUPLICATED_ID", ErrDuplicatedID, false},
+		{"DUPLICATED_DEST", ErrDuplicatedDest, false},
+		{"TIMEOUT", ErrTimeout, true},
+		{"I2P_ERROR", ErrI2PError, true},
+		{"SOMETHING_NEW", ErrI2PError, true},
+	}
+	for _, c := range cases {
+		r, err := ParseReply(`STREAM STATUS RESULT=` + c.result + ` MESSAGE="it went wrong"`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fmt.Errorf("dialing: %w", r.Err())
+		if !errors.Is(err, c.sentinel) {
+			t.Errorf("%s: %v isn't %v", c.result, err, c.sentinel)
+		}
+		if !strings.Contains(err.Error(), "it went wrong") {
+			t.Errorf("%s: lost the message: %v", c.result, err)
+		}
+		if IsRetryable(err) != c.retryable {
+			t.Errorf("%s: retryable should be %v", c.result, c.retryable)
+		}
+		var samErr *Error
+		if !errors.As(err, &samErr) || samErr.Result != c.result || samErr.Topic != "STREAM" {
+			t.Errorf("%s: got %#v", c.result, samErr)
+		}
+	}
+	r, _ := ParseReply("STREAM STATUS RESULT=OK")
+	if r.Err() != nil {
+		t.Error("RESULT=OK is not an error")
+	}
+}
+
+func TestPermanentErrors(t *testing.T) {
+	for _, err := range []error{ErrAuthFailed, ErrVersionUnsupported, errors.New("anything else")} {
+		if IsRetryable(fmt.Errorf("wrapped: %w", err)) {
+			t.Errorf("%v should be permanent", err)
+		}
+	}
+}
+
+func TestNetworkErrors(t *testing.T) {
+	// what dialing a router that's restarting, or reading from one that's
+	// gone, looks like
+	dial := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{dial(syscall.ECONNREFUSED), true},
+		{dial(syscall.ECONNRESET), true},
+		{fmt.Errorf("reading reply: %w", io.EOF), true},
+		{fmt.Errorf("reading reply: %w", io.ErrUnexpectedEOF), true},
+		{dial(syscall.EACCES), false},
+	}
+	for _, c := range cases {
+		if IsRetryable(c.err) != c.retryable {
+			t.Errorf("%v: retryable should be %v", c.err, c.retryable)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package i2pbridge
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSupervisorIdle(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	s := fastSupervisor(r.bridge())
+	s.IdleTimeout = 100 * time.Millisecond
+	defer s.Close()
+	ctx := context.Background()
+	stream, err := s.DialContextI2P(ctx, "", testPeer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := s.Current()
+
+	// an open stream keeps the session
+	time.Sleep(3 * s.IdleTimeout)
+	if s.Current() != first {
+		t.Fatal("session closed with a stream open")
+	}
+	stream.Close()
+	e := waitStatus(t, s, StatusIdle)
+	if e.Session != first.ID() || !first.dead() || s.Current() != nil {
+		t.Fatal("idle session not closed")
+	}
+	if s.Status() != StatusIdle {
+		t.Errorf("status %s", s.Status())
+	}
+
+	// and the next dial makes a new one
+	stream, err = s.DialContextI2P(ctx, "", testPeer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+	if s.Current() == first || s.Current() == nil {
+		t.Error("dial didn't bring the session back")
+	}
+	if n := r.sessionCount(); n != 2 {
+		t.Errorf("created %d sessions, want 2", n)
+	}
+}
+
+func TestSupervisorIdleListener(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	s := fastSupervisor(r.bridge())
+	s.IdleTimeout = 100 * time.Millisecond
+	defer s.Close()
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	l, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := l.AcceptI2P()
+		if err == nil {
+			c.Close()
+		}
+		accepted <- err
+	}()
+	<-r.accepts
+
+	// the listener doesn't keep the session, nor bring it back by itself
+	waitStatus(t, s, StatusIdle)
+	time.Sleep(3 * s.IdleTimeout)
+	if n := r.sessionCount(); n != 1 {
+		t.Fatalf("listener brought the session back, %d sessions", n)
+	}
+
+	// a dial does, and the listener goes back to accepting on it
+	stream, err := s.DialContextI2P(ctx, "", testPeer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	select {
+	case c := <-r.accepts:
+		c.Write([]byte("peerdest FROM_PORT=0 TO_PORT=0\n"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener didn't come back")
+	}
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSupervisorIdleKeepListening(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	s := fastSupervisor(r.bridge())
+	s.IdleTimeout = 50 * time.Millisecond
+	s.ListenersKeepAlive = true
+	defer s.Close()
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	first := s.Current()
+	l, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * s.IdleTimeout)
+	if s.Current() != first || first.dead() {
+		t.Fatal("session closed under a listener that keeps it")
+	}
+	// with the listener gone it can go idle
+	l.Close()
+	waitStatus(t, s, StatusIdle)
+
+	// and a listener opened then brings it back by itself
+	l, err = s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := l.AcceptI2P()
+		if err == nil {
+			c.Close()
+		}
+		accepted <- err
+	}()
+	select {
+	case c := <-r.accepts:
+		c.Write([]byte("peerdest FROM_PORT=0 TO_PORT=0\n"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener didn't bring the session back")
+	}
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+	if n := r.sessionCount(); n != 2 {
+		t.Errorf("created %d sessions, want 2", n)
+	}
+}
+
+func TestSupervisorIdleTiny(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	s := fastSupervisor(r.bridge())
+	// too short to divide into checks, it mustn't panic the watcher
+	s.IdleTimeout = time.Nanosecond
+	defer s.Close()
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, s, StatusIdle)
+}
+
+func TestReconfigureIdle(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	s := fastSupervisor(r.bridge())
+	s.IdleTimeout = 50 * time.Millisecond
+	defer s.Close()
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, s, StatusIdle)
+	if err := s.Reconfigure(ctx, []string{"inbound.length=2"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.sessionCount(); n != 1 {
+		t.Fatalf("reconfiguring woke the session, %d sessions", n)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.lastCreate()["inbound.length"]; got != "2" {
+		t.Errorf("woken session made with inbound.length=%q", got)
+	}
+}
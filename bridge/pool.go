@@ -0,0 +1,427 @@
+package i2pbridge
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SessionPool keeps sessions with transient destinations built ahead of time.
+// Building tunnels takes anything from 10 seconds to a minute, so a session
+// that's wanted right away, like one per peer, is taken ready-made from the
+// pool, and the pool builds another in the background.
+type SessionPool struct {
+	// MinBackoff and MaxBackoff bound the wait between tries at building a
+	// session for the pool.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Primary makes the sessions PRIMARY ones where it can, see
+	// Supervisor.Primary
+	Primary bool
+
+	bridges []*Bridge
+	size    int
+	options []string
+
+	mu      sync.Mutex
+	ready   []*StreamSession
+	filling int
+	started bool
+	closed  bool
+	done    chan struct{}
+	// gen counts SetOptions, so sessions built with old options are dropped
+	gen int
+	// for Stats
+	hits, misses uint64
+	refills      int
+	lastRefill   time.Duration
+	totalRefill  time.Duration
+}
+
+// PoolStats is how a SessionPool is doing
+type PoolStats struct {
+	// Size is how many sessions the pool keeps ready, Ready how many it has
+	// right now and Building how many are on the way.
+	Size     int
+	Ready    int
+	Building int
+	// Hits are sessions handed out ready-made, Misses ones that had to be
+	// built while the caller waited because the pool was empty.
+	Hits   uint64
+	Misses uint64
+	// LastRefill and AvgRefill are how long building a session for the pool
+	// took, retries included.
+	LastRefill time.Duration
+	AvgRefill  time.Duration
+}
+
+// HitRate is the share of sessions handed out ready-made, 0 to 1
+func (s PoolStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// NewSessionPool sets up a pool of size sessions on the first of bridges that
+// works, made with options. It doesn't build any until Start or the first Get.
+func NewSessionPool(bridges []*Bridge, size int, options []string) *SessionPool {
+	if len(bridges) == 0 {
+		bridges = []*Bridge{Default()}
+	}
+	return &SessionPool{
+		MinBackoff: time.Second,
+		MaxBackoff: time.Minute,
+		bridges:    append([]*Bridge{}, bridges...),
+		size:       size,
+		options:    append([]string{}, options...),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start begins filling the pool, it doesn't wait for it
+func (p *SessionPool) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.started = true
+	p.fill()
+}
+
+// Get takes a ready session from the pool, or builds one there and then if
+// the pool is empty, and has the pool build a replacement. The session is the
+// caller's to close.
+func (p *SessionPool) Get(ctx context.Context) (*StreamSession, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+	p.started = true
+	var ss *StreamSession
+	for ss == nil && len(p.ready) > 0 {
+		ss, p.ready = p.ready[0], p.ready[1:]
+		if ss.dead() {
+			ss.Close()
+			ss = nil
+		}
+	}
+	if ss != nil {
+		p.hits++
+	} else {
+		p.misses++
+	}
+	p.fill()
+	options := p.options
+	p.mu.Unlock()
+	if ss != nil {
+		return ss, nil
+	}
+	return p.build(ctx, options)
+}
+
+// SetOptions changes the options sessions are made with. Ready sessions made
+// with the old ones are closed and built again.
+func (p *SessionPool) SetOptions(options []string) {
+	p.mu.Lock()
+	p.options = append([]string{}, options...)
+	p.gen++
+	stale := p.ready
+	p.ready = nil
+	if p.started {
+		p.fill()
+	}
+	p.mu.Unlock()
+	for _, ss := range stale {
+		ss.Close()
+	}
+}
+
+// Stats reports the pool's depth, refill times and hit rate
+func (p *SessionPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := PoolStats{
+		Size:       p.size,
+		Ready:      len(p.ready),
+		Building:   p.filling,
+		Hits:       p.hits,
+		Misses:     p.misses,
+		LastRefill: p.lastRefill,
+	}
+	if p.refills > 0 {
+		s.AvgRefill = p.totalRefill / time.Duration(p.refills)
+	}
+	return s
+}
+
+// Close closes the sessions in the pool and stops building new ones. Sessions
+// already handed out are left alone.
+func (p *SessionPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	for _, ss := range p.ready {
+		ss.Close()
+	}
+	p.ready = nil
+	return nil
+}
+
+// fill starts building sessions until there are enough ready or on the way.
+// It's called with mu held.
+func (p *SessionPool) fill() {
+	for !p.closed && len(p.ready)+p.filling < p.size {
+		p.filling++
+		go p.refill()
+	}
+}
+
+// refill builds a session for the pool, trying until it works or the pool is
+// closed
+func (p *SessionPool) refill() {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		p.mu.Lock()
+		options, gen := p.options, p.gen
+		p.mu.Unlock()
+		ss, err := p.build(context.Background(), options)
+		if err == nil {
+			p.mu.Lock()
+			if p.gen != gen && !p.closed {
+				// made with options that have been changed since
+				p.mu.Unlock()
+				ss.Close()
+				continue
+			}
+			p.filling--
+			p.refills++
+			p.lastRefill = time.Since(start)
+			p.totalRefill += p.lastRefill
+			if p.closed {
+				p.mu.Unlock()
+				ss.Close()
+				return
+			}
+			p.ready = append(p.ready, ss)
+			p.mu.Unlock()
+			return
+		}
+		select {
+		case <-time.After(backoff(p.MinBackoff, p.MaxBackoff, attempt)):
+		case <-p.done:
+			p.mu.Lock()
+			p.filling--
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// build makes a session on the first bridge that works
+func (p *SessionPool) build(ctx context.Context, options []string) (*StreamSession, error) {
+	var lastErr error
+	for _, b := range p.bridges {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ss, err := openSession(b, transientKeys, options, p.Primary)
+		if err == nil {
+			return ss, nil
+		}
+		lastErr = err
+	}
+	if len(p.bridges) > 1 {
+		lastErr = fmt.Errorf("none of %d SAM bridges worked, the last said: %w", len(p.bridges), lastErr)
+	}
+	return nil, lastErr
+}
+
+// dead says whether the session's control socket has gone
+func (ss *StreamSession) dead() bool {
+	select {
+	case <-ss.ctl.dead:
+		return true
+	default:
+		return false
+	}
+}
+
+// PeerSessions gives each remote peer a transient destination of its own to
+// dial from, so that peers can't tell our streams to them apart from anyone
+// else's. A peer's session is taken from a SessionPool on its first dial, and
+// closed, destination and all, once the last stream to the peer is.
+type PeerSessions struct {
+	pool *SessionPool
+	max  int
+
+	mu     sync.Mutex
+	peers  map[string]*peerSession
+	closed bool
+}
+
+type peerSession struct {
+	ss      *StreamSession
+	streams int
+	// ready is closed once ss is set, or err says why it couldn't be
+	ready chan struct{}
+	err   error
+}
+
+// gone says whether ps had a session that has since died
+func (ps *peerSession) gone() bool {
+	select {
+	case <-ps.ready:
+		return ps.ss != nil && ps.ss.dead()
+	default:
+		return false
+	}
+}
+
+// NewPeerSessions keeps up to max peer sessions at a time, taken from pool
+func NewPeerSessions(pool *SessionPool, max int) *PeerSessions {
+	return &PeerSessions{pool: pool, max: max, peers: map[string]*peerSession{}}
+}
+
+// Start pre-warms the pool
+func (p *PeerSessions) Start() {
+	p.pool.Start()
+}
+
+// Pool is where peer sessions come from
+func (p *PeerSessions) Pool() *SessionPool {
+	return p.pool
+}
+
+// DialWith dials addr from peer's own session with options, see
+// Supervisor.DialWith. peer can be anything that names the remote side, like
+// its peer ID.
+func (p *PeerSessions) DialWith(ctx context.Context, peer string, options []string, addr string) (*SAMConn, error) {
+	ps, err := p.acquire(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := ps.ss.WithOptions(options)
+	if err != nil {
+		p.release(peer, ps)
+		return nil, err
+	}
+	c, err := sub.DialContextI2P(ctx, "", addr)
+	if err != nil {
+		releaseSub(ps.ss, sub)
+		p.release(peer, ps)
+		return nil, err
+	}
+	c.release = func() {
+		releaseSub(ps.ss, sub)
+		p.release(peer, ps)
+	}
+	return c, nil
+}
+
+// Sessions are the peers' sessions that are up right now
+func (p *PeerSessions) Sessions() []*StreamSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var sessions []*StreamSession
+	for _, ps := range p.peers {
+		select {
+		case <-ps.ready:
+			if ps.ss != nil && !ps.ss.dead() {
+				sessions = append(sessions, ps.ss)
+			}
+		default:
+		}
+	}
+	return sessions
+}
+
+// Len is how many peers have a session right now
+func (p *PeerSessions) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.peers)
+}
+
+// Close closes every peer's session and the pool
+func (p *PeerSessions) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	peers := p.peers
+	p.peers = map[string]*peerSession{}
+	p.mu.Unlock()
+	for _, ps := range peers {
+		<-ps.ready
+		if ps.ss != nil {
+			ps.ss.Close()
+		}
+	}
+	return p.pool.Close()
+}
+
+// acquire returns peer's session, taking one from the pool if it hasn't got a
+// live one, and counts a stream on it.
+func (p *PeerSessions) acquire(ctx context.Context, peer string) (*peerSession, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+	ps := p.peers[peer]
+	if ps != nil && ps.gone() {
+		// the bridge forgot it, whatever streams it had are gone too
+		delete(p.peers, peer)
+		ps = nil
+	}
+	if ps != nil {
+		ps.streams++
+		p.mu.Unlock()
+		select {
+		case <-ps.ready:
+		case <-ctx.Done():
+			p.release(peer, ps)
+			return nil, ctx.Err()
+		}
+		if ps.err != nil {
+			p.release(peer, ps)
+			return nil, ps.err
+		}
+		return ps, nil
+	}
+	if len(p.peers) >= p.max {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("already dialing %d peers from sessions of their own, that's the most allowed", p.max)
+	}
+	ps = &peerSession{streams: 1, ready: make(chan struct{})}
+	p.peers[peer] = ps
+	p.mu.Unlock()
+
+	ps.ss, ps.err = p.pool.Get(ctx)
+	close(ps.ready)
+	if ps.err != nil {
+		p.release(peer, ps)
+		return nil, ps.err
+	}
+	return ps, nil
+}
+
+// release counts a stream off ps, and closes it once there are none left
+func (p *PeerSessions) release(peer string, ps *peerSession) {
+	p.mu.Lock()
+	ps.streams--
+	if ps.streams > 0 {
+		p.mu.Unlock()
+		return
+	}
+	if p.peers[peer] == ps {
+		delete(p.peers, peer)
+	}
+	p.mu.Unlock()
+	if ps.ss != nil {
+		ps.ss.Close()
+	}
+}
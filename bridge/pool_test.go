@@ -0,0 +1,136 @@
+package i2pbridge
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitSessions waits until the router has made n sessions
+func waitSessions(t *testing.T, r *fakeRouter, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for r.sessionCount() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("router made %d sessions, want %d", r.sessionCount(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSessionPool(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	p := NewSessionPool([]*Bridge{r.bridge()}, 2, nil)
+	defer p.Close()
+	p.Start()
+	waitSessions(t, r, 2)
+
+	a, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Addr() == b.Addr() {
+		t.Error("two sessions from the pool share a destination")
+	}
+	// both taken, so two more are built to replace them
+	waitSessions(t, r, 4)
+	a.Close()
+	b.Close()
+	waitReady(t, p, 2)
+	stats := p.Stats()
+	if stats.Size != 2 || stats.Hits != 2 || stats.Misses != 0 || stats.HitRate() != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+	if stats.LastRefill <= 0 || stats.AvgRefill <= 0 {
+		t.Errorf("refill times %s and %s", stats.LastRefill, stats.AvgRefill)
+	}
+}
+
+func TestSessionPoolMiss(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	p := NewSessionPool([]*Bridge{r.bridge()}, 0, nil)
+	defer p.Close()
+	ss, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.Close()
+	if stats := p.Stats(); stats.Misses != 1 || stats.Hits != 0 || stats.Ready != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+// waitReady waits until the pool has n sessions ready
+func waitReady(t *testing.T, p *SessionPool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Stats().Ready < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool has %d sessions ready, want %d", p.Stats().Ready, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPeerSessions(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	peers := NewPeerSessions(NewSessionPool([]*Bridge{r.bridge()}, 1, nil), 2)
+	defer peers.Close()
+	ctx := context.Background()
+	dest := testPeer(t)
+
+	a1, err := peers.DialWith(ctx, "a", nil, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2, err := peers.DialWith(ctx, "a", nil, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := peers.DialWith(ctx, "b", nil, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a1.LocalAddr() != a2.LocalAddr() {
+		t.Error("streams to the same peer came from different destinations")
+	}
+	if a1.LocalAddr() == b.LocalAddr() {
+		t.Error("streams to different peers came from the same destination")
+	}
+	if _, err := peers.DialWith(ctx, "c", nil, dest); err == nil {
+		t.Error("dialed a third peer with a limit of 2")
+	}
+
+	a1.Close()
+	if n := peers.Len(); n != 2 {
+		t.Errorf("%d peer sessions with a stream to each peer still open", n)
+	}
+	a2.Close()
+	a2.Close()
+	if n := peers.Len(); n != 1 {
+		t.Errorf("%d peer sessions after a's streams closed, want 1", n)
+	}
+	c, err := peers.DialWith(ctx, "c", nil, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	b.Close()
+}
+
+func TestSessionPoolSetOptions(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	p := NewSessionPool([]*Bridge{r.bridge()}, 1, []string{"inbound.length=1"})
+	defer p.Close()
+	p.Start()
+	waitReady(t, p, 1)
+	p.SetOptions([]string{"inbound.length=2"})
+	waitReady(t, p, 1)
+	if got := r.lastCreate()["inbound.length"]; got != "2" {
+		t.Errorf("pool refilled with inbound.length=%q", got)
+	}
+}
@@ -0,0 +1,217 @@
+package i2pbridge
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eyedeekay/sam3/i2pkeys"
+)
+
+const (
+	// maxSubsessions bounds how many different sets of per-dial options a
+	// PRIMARY session keeps subsessions for
+	maxSubsessions = 16
+	// commandTimeout bounds waiting for the answer to a command on a
+	// session's control socket
+	commandTimeout = 30 * time.Second
+)
+
+// control reads a session's control socket: it answers PING, passes PONGs
+// and command replies on, and notices when the socket dies.
+type control struct {
+	conn    *Conn
+	cmdMu   sync.Mutex
+	pongs   chan string
+	replies chan string
+	dead    chan struct{}
+	err     error
+}
+
+func newControl(c *Conn) *control {
+	ctl := &control{
+		conn:    c,
+		pongs:   make(chan string, 1),
+		replies: make(chan string, 1),
+		dead:    make(chan struct{}),
+	}
+	go ctl.read()
+	return ctl
+}
+
+func (ctl *control) read() {
+	for {
+		line, err := ctl.conn.ReadLine()
+		if err != nil {
+			ctl.err = err
+			close(ctl.dead)
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			ctl.conn.WriteLine("PONG" + strings.TrimPrefix(line, "PING"))
+		case strings.HasPrefix(line, "PONG"):
+			select {
+			case ctl.pongs <- strings.TrimSpace(strings.TrimPrefix(line, "PONG")):
+			default:
+			}
+		default:
+			// anything else answers a command, if nobody asked it's dropped
+			select {
+			case ctl.replies <- line:
+			default:
+			}
+		}
+	}
+}
+
+// command sends cmd on the control socket and waits for its reply
+func (ctl *control) command(cmd string) (*Reply, error) {
+	ctl.cmdMu.Lock()
+	defer ctl.cmdMu.Unlock()
+	// a reply that came after an earlier command gave up isn't ours
+	select {
+	case <-ctl.replies:
+	default:
+	}
+	if err := ctl.conn.WriteLine(cmd); err != nil {
+		return nil, err
+	}
+	select {
+	case line := <-ctl.replies:
+		return ParseReply(line)
+	case <-ctl.dead:
+		return nil, ctl.err
+	case <-time.After(commandTimeout):
+		return nil, fmt.Errorf("SAM bridge didn't answer %s within %s", strings.Join(strings.Fields(cmd)[:2], " "), commandTimeout)
+	}
+}
+
+// NewPrimarySession creates a PRIMARY session, which needs SAM 3.3, and a
+// STREAM subsession of it with the same options to dial and accept on. The
+// session returned is that subsession, and closing it closes the whole PRIMARY
+// session. Unlike a plain stream session, it can dial with other streaming
+// options through WithOptions.
+func (s *SAM) NewPrimarySession(id string, keys i2pkeys.I2PKeys, options []string) (*StreamSession, error) {
+	if err := s.conn.Version.require(featurePrimary); err != nil {
+		return nil, err
+	}
+	ss, err := s.createSession("PRIMARY", id, keys, options)
+	if err != nil {
+		return nil, err
+	}
+	var streaming []string
+	for _, o := range options {
+		if strings.HasPrefix(o, "i2p.streaming.") {
+			streaming = append(streaming, o)
+		}
+	}
+	ss.primaryID = id
+	ss.id = id + "-0"
+	if err := ss.add(ss.id, 0, streaming); err != nil {
+		ss.Close()
+		return nil, err
+	}
+	return ss, nil
+}
+
+// add adds a STREAM subsession, listening on port if it isn't 0
+func (ss *StreamSession) add(id string, port int, options []string) error {
+	cmd := "SESSION ADD STYLE=STREAM ID=" + id
+	if port != 0 {
+		p := strconv.Itoa(port)
+		cmd += " FROM_PORT=" + p + " LISTEN_PORT=" + p
+	}
+	r, err := ss.ctl.command(strings.TrimSpace(cmd + " " + strings.Join(options, " ")))
+	if err != nil {
+		return err
+	}
+	return r.Err()
+}
+
+// WithOptions returns a session dialing with different streaming options,
+// "i2p.streaming.profile=2" and so on, from the same destination. It's a
+// subsession of the PRIMARY session, made the first time those options are
+// asked for and shared by everyone asking for them after. Each caller closes
+// it once done, and the last to do so removes it from the bridge. Streams it
+// dials come from a port of their own, so their replies find their way back
+// to it.
+func (ss *StreamSession) WithOptions(options []string) (*StreamSession, error) {
+	if len(options) == 0 {
+		return ss, nil
+	}
+	if ss.parent != nil {
+		return ss.parent.WithOptions(options)
+	}
+	if ss.primaryID == "" {
+		if err := ss.conn.Version.require(featurePrimary); err != nil {
+			return nil, fmt.Errorf("per-dial streaming options: %w", err)
+		}
+		return nil, fmt.Errorf("per-dial streaming options need a PRIMARY session, see NewPrimarySession and Supervisor.Primary")
+	}
+	key := strings.Join(options, " ")
+	ss.subMu.Lock()
+	defer ss.subMu.Unlock()
+	if sub, ok := ss.subs[key]; ok {
+		sub.users++
+		return sub, nil
+	}
+	if len(ss.subs) >= maxSubsessions {
+		return nil, fmt.Errorf("session already has %d sets of per-dial streaming options in use", maxSubsessions)
+	}
+	port := ss.freePort()
+	id := ss.primaryID + "-" + strconv.Itoa(port)
+	if err := ss.add(id, port, options); err != nil {
+		return nil, err
+	}
+	sub := &StreamSession{
+		bridge: ss.bridge,
+		id:     id,
+		conn:   ss.conn,
+		ctl:    ss.ctl,
+		addr:   ss.addr,
+		parent: ss,
+		port:   port,
+		users:  1,
+	}
+	if ss.subs == nil {
+		ss.subs = map[string]*StreamSession{}
+	}
+	ss.subs[key] = sub
+	return sub, nil
+}
+
+// freePort is the lowest port no subsession is using, subMu has to be held
+func (ss *StreamSession) freePort() int {
+	used := map[int]bool{}
+	for _, sub := range ss.subs {
+		used[sub.port] = true
+	}
+	port := 1
+	for used[port] {
+		port++
+	}
+	return port
+}
+
+// release gives up a subsession WithOptions handed out, and removes it once
+// nobody is using it
+func (ss *StreamSession) release(sub *StreamSession) error {
+	ss.subMu.Lock()
+	defer ss.subMu.Unlock()
+	if sub.users--; sub.users > 0 {
+		return nil
+	}
+	for key, s := range ss.subs {
+		if s == sub {
+			delete(ss.subs, key)
+		}
+	}
+	r, err := ss.ctl.command("SESSION REMOVE ID=" + sub.id)
+	if err != nil {
+		return err
+	}
+	return r.Err()
+}
@@ -0,0 +1,126 @@
+package i2pbridge
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/eyedeekay/sam3/i2pkeys"
+)
+
+func testPeer(t *testing.T) string {
+	t.Helper()
+	addr, err := i2pkeys.NewI2PAddrFromBytes(make([]byte, 387))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr.Base64()
+}
+
+func primarySupervisor(b *Bridge) *Supervisor {
+	s := fastSupervisor(b)
+	s.Primary = true
+	return s
+}
+
+func TestDialWithOptions(t *testing.T) {
+	r := newFakeRouter(t, "3.3")
+	s := primarySupervisor(r.bridge())
+	defer s.Close()
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimSuffix(s.Current().ID(), "-0")
+	peer := testPeer(t)
+	interactive := []string{"i2p.streaming.profile=2"}
+	var conns []*SAMConn
+	for _, opts := range [][]string{nil, interactive, interactive, {"i2p.streaming.maxWindowSize=8"}} {
+		c, err := s.DialWith(ctx, opts, peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	want := []string{
+		"SESSION ADD STYLE=STREAM ID=" + id + "-0",
+		"STREAM CONNECT ID=" + id + "-0 DESTINATION=" + peer + " SILENT=false",
+		"SESSION ADD STYLE=STREAM ID=" + id + "-1 FROM_PORT=1 LISTEN_PORT=1 i2p.streaming.profile=2",
+		"STREAM CONNECT ID=" + id + "-1 DESTINATION=" + peer + " SILENT=false",
+		"STREAM CONNECT ID=" + id + "-1 DESTINATION=" + peer + " SILENT=false",
+		"SESSION ADD STYLE=STREAM ID=" + id + "-2 FROM_PORT=2 LISTEN_PORT=2 i2p.streaming.maxWindowSize=8",
+		"STREAM CONNECT ID=" + id + "-2 DESTINATION=" + peer + " SILENT=false",
+		// -1 goes once both its streams are closed
+		"SESSION REMOVE ID=" + id + "-1",
+		"SESSION REMOVE ID=" + id + "-2",
+	}
+	if got := r.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("bridge got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDialWithOptionsReleased(t *testing.T) {
+	r := newFakeRouter(t, "3.3")
+	s := primarySupervisor(r.bridge())
+	defer s.Close()
+	ctx := context.Background()
+	peer := testPeer(t)
+	// more sets of options than a session can have subsessions, but never
+	// more than one in use at a time
+	for i := 0; i < 2*maxSubsessions; i++ {
+		c, err := s.DialWith(ctx, []string{"i2p.streaming.maxWindowSize=" + strconv.Itoa(i+1)}, peer)
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		c.Close()
+	}
+	var removed int
+	for _, line := range r.received() {
+		if strings.HasPrefix(line, "SESSION REMOVE") {
+			removed++
+		}
+	}
+	if removed != 2*maxSubsessions {
+		t.Errorf("removed %d subsessions, want %d", removed, 2*maxSubsessions)
+	}
+}
+
+func TestPrimaryOptIn(t *testing.T) {
+	r := newFakeRouter(t, "3.3")
+	s := fastSupervisor(r.bridge())
+	defer s.Close()
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if style := r.lastCreate()["STYLE"]; style != "STREAM" {
+		t.Errorf("made a %s session without Primary", style)
+	}
+	if _, err := s.DialWith(ctx, []string{"i2p.streaming.profile=2"}, testPeer(t)); err == nil || !strings.Contains(err.Error(), "PRIMARY") {
+		t.Errorf("got %v, want a dial asking for a PRIMARY session", err)
+	}
+	if _, err := s.DialWith(ctx, nil, testPeer(t)); err != nil {
+		t.Errorf("dial without options: %v", err)
+	}
+}
+
+func TestDialWithOptionsNeedsPrimary(t *testing.T) {
+	r := newFakeRouter(t, "3.2")
+	s := fastSupervisor(r.bridge())
+	defer s.Close()
+	ctx := context.Background()
+	_, err := s.DialWith(ctx, []string{"i2p.streaming.profile=2"}, testPeer(t))
+	if !errors.Is(err, ErrVersionUnsupported) {
+		t.Fatalf("got %v, want ErrVersionUnsupported", err)
+	}
+	// the session itself is fine
+	if s.Status() == StatusClosed {
+		t.Error("a dial with options closed the session")
+	}
+}
@@ -0,0 +1,102 @@
+package i2pbridge
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/eyedeekay/sam3/i2pkeys"
+)
+
+// Ready is closed once the session is up and its lease set has been
+// published, which is when others can actually reach it. Sessions that don't
+// publish one are ready as soon as they're up. If the session is
+// lost, the next one gets a new channel, so ask again after a StatusLost.
+func (s *Supervisor) Ready() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ready
+}
+
+// WaitReady starts the supervisor if need be and waits until Ready. If ctx is
+// done first, the error says why, including the last failed lookup.
+func (s *Supervisor) WaitReady(ctx context.Context) error {
+	for {
+		if _, err := s.Session(ctx); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		ready, gone := s.ready, s.gone
+		s.mu.Unlock()
+		select {
+		case <-ready:
+			return nil
+		case <-gone:
+			// lost before it was published, wait for the next one
+		case <-s.done:
+			return ErrClosed
+		case <-ctx.Done():
+			s.mu.Lock()
+			lookupErr := s.lookupErr
+			s.mu.Unlock()
+			if lookupErr != nil {
+				return fmt.Errorf("%w waiting for our lease set to be published, the last lookup said: %v", ctx.Err(), lookupErr)
+			}
+			return fmt.Errorf("%w waiting for our lease set to be published", ctx.Err())
+		}
+	}
+}
+
+// confirm looks the session's own b32 up on the bridge until it resolves to
+// us, which it only does once the lease set is out there.
+func (s *Supervisor) confirm(ss *StreamSession) {
+	name := ss.Addr().Base32()
+	for {
+		var addr i2pkeys.I2PAddr
+		var err error
+		if !s.publishes() {
+			// there's no lease set coming, the session is as ready as
+			// it gets
+			addr = ss.Addr()
+		} else {
+			addr, err = ss.Lookup(name)
+		}
+		if err == nil && addr.Base32() != name {
+			err = fmt.Errorf("%s resolved to %s", name, addr.Base32())
+		}
+		s.mu.Lock()
+		if s.session != ss {
+			s.mu.Unlock()
+			return
+		}
+		if err == nil {
+			s.published = true
+			close(s.ready)
+			s.mu.Unlock()
+			s.emit(Event{Status: StatusPublished, Session: ss.ID()})
+			return
+		}
+		s.lookupErr = err
+		gone := s.gone
+		s.mu.Unlock()
+		select {
+		case <-time.After(s.LookupInterval):
+		case <-gone:
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// publishes says whether sessions publish their lease set at all
+func (s *Supervisor) publishes() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.options {
+		if o == "i2cp.dontPublishLeaseSet=true" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,169 @@
+package i2pbridge
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// drainCheck is how often a draining session is checked for open streams
+	drainCheck = 100 * time.Millisecond
+	// remakeTries is how many times a drained session's replacement is tried
+	// while the router still has the destination
+	remakeTries = 5
+)
+
+// swap asks run to move from the session it's watching to next. Without next,
+// run drains the session and makes a new one in its place, going back to prev
+// and saying why in err if the bridge won't have the new options.
+type swap struct {
+	next *StreamSession
+	prev []string
+	err  error
+	done chan struct{}
+}
+
+// Options are the options sessions are made with
+func (s *Supervisor) Options() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.options...)
+}
+
+// Reconfigure moves the supervisor over to a session with new options, with
+// the same keys, without dropping what's going on. A new session is made
+// alongside the current one, new dials and accepts go to it, and the old one
+// is closed once its streams are done, or after DrainTimeout.
+//
+// Most bridges won't have one destination in two sessions at once, and say
+// so with ErrDuplicatedDest. Then the old session stops taking new streams,
+// its streams get DrainTimeout to finish, and only then is the new one made;
+// dials in the meantime wait for it. Either way Reconfigure returns once the
+// new session is up. An idle supervisor just keeps the options for its next
+// session. If the bridge turns the new options down, the supervisor keeps the
+// old ones: the old session carries on as it was, or, if it had already made
+// way, a new one is made with them before Reconfigure returns the error.
+func (s *Supervisor) Reconfigure(ctx context.Context, options []string) error {
+	return s.reconfigure(ctx, options, true)
+}
+
+// TryReconfigure is Reconfigure without the drain: if the bridge won't have
+// the destination in two sessions at once, it fails with ErrDuplicatedDest
+// and the session carries on as it was, without holding up any dials.
+func (s *Supervisor) TryReconfigure(ctx context.Context, options []string) error {
+	return s.reconfigure(ctx, options, false)
+}
+
+// reconfigure is Reconfigure, with drain saying what to do about
+// ErrDuplicatedDest
+func (s *Supervisor) reconfigure(ctx context.Context, options []string, drain bool) error {
+	s.reconfMu.Lock()
+	defer s.reconfMu.Unlock()
+	s.mu.Lock()
+	if s.idle {
+		// no need to wake it, the next session gets them
+		s.options = append([]string{}, options...)
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+	old, err := s.Session(ctx)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	prev := s.options
+	// whatever session is made from here on, it has the new options
+	s.options = append([]string{}, options...)
+	s.mu.Unlock()
+
+	sw := &swap{prev: prev, done: make(chan struct{})}
+	sw.next, err = s.newSession(old.bridge)
+	if err != nil && (!drain || !errors.Is(err, ErrDuplicatedDest)) {
+		s.mu.Lock()
+		s.options = prev
+		s.mu.Unlock()
+		return err
+	}
+	select {
+	case s.swaps <- sw:
+	case <-ctx.Done():
+		if sw.next != nil {
+			sw.next.Close()
+		}
+		return ctx.Err()
+	case <-s.done:
+		if sw.next != nil {
+			sw.next.Close()
+		}
+		return ErrClosed
+	}
+	select {
+	case <-sw.done:
+	case <-s.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return sw.err
+}
+
+// remake makes the session a drained one made way for, giving the router a
+// moment to let go of the destination
+func (s *Supervisor) remake(b *Bridge) (*StreamSession, error) {
+	for attempt := 1; ; attempt++ {
+		ss, err := s.newSession(b)
+		if !errors.Is(err, ErrDuplicatedDest) || attempt == remakeTries {
+			return ss, err
+		}
+		select {
+		case <-time.After(s.backoff(attempt)):
+		case <-s.done:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// moveTo makes next the session, and drains old in the background
+func (s *Supervisor) moveTo(old, next *StreamSession) {
+	s.mu.Lock()
+	s.session = next
+	s.addr = next.Addr()
+	republish := !s.published
+	if next.Addr() != old.Addr() {
+		// a different destination, with a lease set of its own to wait for
+		close(s.gone)
+		s.gone = make(chan struct{})
+		if s.published {
+			s.ready = make(chan struct{})
+			s.published = false
+		}
+		republish = true
+	}
+	s.mu.Unlock()
+	s.emit(Event{Status: StatusReady, Session: next.ID()})
+	if republish {
+		go s.confirm(next)
+	}
+	old.stopAccepting()
+	go s.drain(old)
+}
+
+// drain waits for ss's streams to be closed, for up to DrainTimeout, then
+// closes it
+func (s *Supervisor) drain(ss *StreamSession) {
+	defer ss.Close()
+	deadline := time.After(s.DrainTimeout)
+	ticker := time.NewTicker(drainCheck)
+	defer ticker.Stop()
+	for ss.Streams() > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
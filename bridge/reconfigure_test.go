@@ -0,0 +1,227 @@
+package i2pbridge
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconfigure(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	s := fastSupervisor(r.bridge())
+	defer s.Close()
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	old := s.Current()
+	stream, err := s.DialContextI2P(ctx, "", testPeer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := l.AcceptI2P()
+		if err == nil {
+			c.Close()
+		}
+		accepted <- err
+	}()
+	<-r.accepts
+
+	if err := s.Reconfigure(ctx, []string{"inbound.length=2"}); err != nil {
+		t.Fatal(err)
+	}
+	next := s.Current()
+	if next == old {
+		t.Fatal("still on the old session")
+	}
+	if got := r.lastCreate()["inbound.length"]; got != "2" {
+		t.Errorf("new session made with inbound.length=%q", got)
+	}
+	if got := s.Options(); len(got) != 1 || got[0] != "inbound.length=2" {
+		t.Errorf("options %v", got)
+	}
+
+	// the listener moves over to the new session
+	select {
+	case c := <-r.accepts:
+		c.Write([]byte("peerdest FROM_PORT=0 TO_PORT=0\n"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener didn't move to the new session")
+	}
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+	accepts := 0
+	for _, cmd := range r.received() {
+		if strings.HasPrefix(cmd, "STREAM ACCEPT ID="+next.ID()+" ") {
+			accepts++
+		}
+	}
+	if accepts != 1 {
+		t.Errorf("%d accepts on the new session, want 1", accepts)
+	}
+
+	// the old session is kept for the stream still open on it
+	time.Sleep(3 * drainCheck)
+	if old.dead() {
+		t.Fatal("old session closed with a stream still open")
+	}
+	stream.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !old.dead() {
+		if time.Now().After(deadline) {
+			t.Fatal("old session not closed once drained")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.Current() != next {
+		t.Error("closing the old session disturbed the new one")
+	}
+}
+
+func TestReconfigureDuplicatedDest(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	r.uniqueDests = true
+	s := fastSupervisor(r.bridge())
+	defer s.Close()
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	old := s.Current()
+	stream, err := s.DialContextI2P(ctx, "", testPeer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Reconfigure(ctx, []string{"inbound.length=2"})
+	}()
+	// the old session can't make way until its stream is done
+	time.Sleep(3 * drainCheck)
+	select {
+	case err := <-done:
+		t.Fatalf("reconfigured with a stream still open on the old session: %v", err)
+	default:
+	}
+	if s.Status() != StatusConnecting {
+		t.Errorf("status %s while draining", s.Status())
+	}
+	stream.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if s.Current() == old || !old.dead() {
+		t.Error("old session still in use")
+	}
+	if got := r.lastCreate()["inbound.length"]; got != "2" {
+		t.Errorf("new session made with inbound.length=%q", got)
+	}
+}
+
+func TestReconfigureDuplicatedDestRejected(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	r.uniqueDests = true
+	r.reject = func(req map[string]string) bool {
+		return req["inbound.length"] == "2"
+	}
+	s := fastSupervisor(r.bridge())
+	defer s.Close()
+	ctx := context.Background()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	old := s.Current()
+
+	// the old session makes way before the bridge turns the options down,
+	// so the supervisor has to come back with the old ones
+	if err := s.Reconfigure(ctx, []string{"inbound.length=2"}); err == nil {
+		t.Fatal("Reconfigure should have failed")
+	}
+	if got := s.Options(); len(got) != 1 || got[0] != "inbound.length=1" {
+		t.Errorf("options %v", got)
+	}
+	next := s.Current()
+	if next == nil || next == old {
+		t.Fatal("no session with the old options")
+	}
+	if got := r.lastCreate()["inbound.length"]; got != "1" {
+		t.Errorf("session made with inbound.length=%q", got)
+	}
+	if s.Status() == StatusConnecting || s.Status() == StatusClosed {
+		t.Errorf("status %s", s.Status())
+	}
+}
+
+func TestReconfigureDrainTimeout(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	r.uniqueDests = true
+	s := fastSupervisor(r.bridge())
+	s.DrainTimeout = 50 * time.Millisecond
+	defer s.Close()
+	ctx := context.Background()
+	stream, err := s.DialContextI2P(ctx, "", testPeer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if err := s.Reconfigure(ctx, []string{"inbound.length=2"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconfigureDuplicatedDestDialsWait(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	r.uniqueDests = true
+	s := fastSupervisor(r.bridge())
+	defer s.Close()
+	ctx := context.Background()
+	stream, err := s.DialContextI2P(ctx, "", testPeer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Reconfigure(ctx, []string{"inbound.length=2"})
+	}()
+	time.Sleep(3 * drainCheck)
+
+	// while the old session drains there's no session to dial on, so dials
+	// wait for the new one, or give up with their context
+	short, cancel := context.WithTimeout(ctx, 2*drainCheck)
+	defer cancel()
+	if _, err := s.DialContextI2P(short, "", testPeer(t)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the dial to wait out the drain", err)
+	}
+	waiting := make(chan error, 1)
+	go func() {
+		c, err := s.DialContextI2P(ctx, "", testPeer(t))
+		if err == nil {
+			c.Close()
+		}
+		waiting <- err
+	}()
+	stream.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-waiting:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial didn't go out on the new session")
+	}
+}
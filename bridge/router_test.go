@@ -0,0 +1,118 @@
+package i2pbridge
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// testBridgeEnv names a real SAM bridge, i2pd's or Java I2P's, to run the
+// client against. These tests are skipped without one, the rest of the
+// package only talks to fakes.
+const testBridgeEnv = "I2P_SAM_TEST_BRIDGE"
+
+// realBridge is the bridge from $I2P_SAM_TEST_BRIDGE, authenticating with
+// $I2P_SAM_USER and $I2P_SAM_PASSWORD if they're set
+func realBridge(t *testing.T) *Bridge {
+	addr := os.Getenv(testBridgeEnv)
+	if addr == "" {
+		t.Skipf("set $%s to a SAM bridge's host:port to test against a real router", testBridgeEnv)
+	}
+	return &Bridge{Address: addr, User: os.Getenv("I2P_SAM_USER"), Password: os.Getenv("I2P_SAM_PASSWORD")}
+}
+
+func TestRealBridgeHello(t *testing.T) {
+	b := realBridge(t)
+	sam, err := NewSAM(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sam.Close()
+	t.Logf("%s speaks SAM %s", b, sam.Version())
+	if b.User != "" && !sam.Capabilities().Auth {
+		t.Errorf("authenticated on SAM %s, which has no authentication", sam.Version())
+	}
+	keys, err := sam.NewKeys("EdDSA_SHA512_Ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Addr().ToBytes(); err != nil {
+		t.Fatalf("bridge made a destination we can't read: %s", err)
+	}
+	if _, err := sam.Lookup("nonexistent-" + newSessionID() + ".i2p"); err == nil {
+		t.Error("looked up a name nobody has")
+	}
+}
+
+// TestRealBridgeStream sends data between two sessions on the bridge, which
+// takes a few minutes on a router that's just started.
+func TestRealBridgeStream(t *testing.T) {
+	if testing.Short() {
+		t.Skip("building tunnels takes minutes")
+	}
+	b := realBridge(t)
+	session := func() *StreamSession {
+		sam, err := NewSAM(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := sam.NewKeys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss, err := sam.NewStreamSession(newSessionID(), keys, []string{"inbound.length=1", "outbound.length=1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ss.Close() })
+		return ss
+	}
+	server, client := session(), session()
+	l, err := server.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan string, 1)
+	go func() {
+		c, err := l.AcceptI2P()
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			got <- err.Error()
+			return
+		}
+		got <- string(buf)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	for {
+		c, err := client.DialContextI2P(ctx, "", server.Addr().Base64())
+		if err == nil {
+			defer c.Close()
+			if _, err := c.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		// the server's lease set takes a while to be found
+		if ctx.Err() != nil || !IsRetryable(err) {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+	select {
+	case s := <-got:
+		if s != "ping" {
+			t.Fatalf("server got %q", s)
+		}
+	case <-ctx.Done():
+		t.Fatal("nothing arrived")
+	}
+}
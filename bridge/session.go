@@ -0,0 +1,432 @@
+package i2pbridge
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eyedeekay/sam3/i2pkeys"
+)
+
+// SAM is a control connection to the bridge, used to make keys, look up names
+// and create sessions.
+type SAM struct {
+	bridge *Bridge
+	conn   *Conn
+}
+
+// NewSAM opens a control connection to the bridge
+func NewSAM(b *Bridge) (*SAM, error) {
+	if b == nil {
+		b = Default()
+	}
+	c, err := b.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return &SAM{bridge: b, conn: c}, nil
+}
+
+// Bridge returns the bridge the control connection goes to
+func (s *SAM) Bridge() *Bridge {
+	return s.bridge
+}
+
+// Version is the SAM version the bridge agreed to
+func (s *SAM) Version() Version {
+	return s.conn.Version
+}
+
+// Capabilities says what the bridge can do, going by the version it agreed to
+func (s *SAM) Capabilities() Capabilities {
+	return s.conn.Capabilities()
+}
+
+// Close closes the control connection
+func (s *SAM) Close() error {
+	return s.conn.Close()
+}
+
+// NewKeys asks the bridge for a new destination, optionally of a particular
+// signature type like "EdDSA_SHA512_Ed25519".
+func (s *SAM) NewKeys(sigType ...string) (i2pkeys.I2PKeys, error) {
+	cmd := "DEST GENERATE"
+	if len(sigType) > 0 && sigType[0] != "" {
+		if err := s.conn.Version.require(featureSignatureTypes); err != nil {
+			return i2pkeys.I2PKeys{}, err
+		}
+		cmd += " SIGNATURE_TYPE=" + strings.TrimPrefix(sigType[0], "SIGNATURE_TYPE=")
+	}
+	r, err := s.conn.Command(cmd)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, err
+	}
+	pub, priv := r.Pairs["PUB"], r.Pairs["PRIV"]
+	if r.Topic != "DEST" || pub == "" || priv == "" {
+		if err := r.Err(); err != nil {
+			return i2pkeys.I2PKeys{}, err
+		}
+		return i2pkeys.I2PKeys{}, fmt.Errorf("failed to parse keys from the SAM bridge")
+	}
+	return i2pkeys.NewKeys(i2pkeys.I2PAddr(pub), priv), nil
+}
+
+// Lookup resolves a .i2p or .b32.i2p name to a full destination
+func (s *SAM) Lookup(name string) (i2pkeys.I2PAddr, error) {
+	r, err := s.conn.Command("NAMING LOOKUP NAME=" + name)
+	if err != nil {
+		return "", err
+	}
+	if err := r.Err(); err != nil {
+		return "", fmt.Errorf("unable to resolve %s: %w", name, err)
+	}
+	return i2pkeys.I2PAddr(r.Pairs["VALUE"]), nil
+}
+
+// NewStreamSession creates a STREAM session with the given keys and
+// I2CP/streaming options. The session lives as long as the control
+// connection, which it takes over.
+func (s *SAM) NewStreamSession(id string, keys i2pkeys.I2PKeys, options []string) (*StreamSession, error) {
+	return s.createSession("STREAM", id, keys, options)
+}
+
+// createSession sends SESSION CREATE and hands the control connection over
+// to the session
+func (s *SAM) createSession(style, id string, keys i2pkeys.I2PKeys, options []string) (*StreamSession, error) {
+	if err := s.conn.Version.checkOptions(options); err != nil {
+		return nil, err
+	}
+	if err := s.conn.WriteLine("SESSION CREATE STYLE=" + style + " ID=" + id + " DESTINATION=" + keys.String() + " " + strings.Join(options, " ")); err != nil {
+		return nil, err
+	}
+	r, err := s.conn.ReadReply()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	addr := keys.Addr()
+	if IsTransient(keys) {
+		// the bridge made the keys up, and only tells us the private ones
+		if addr, err = destinationOf(r.Pairs["DESTINATION"]); err != nil {
+			return nil, err
+		}
+	}
+	return &StreamSession{
+		bridge: s.bridge,
+		id:     id,
+		conn:   s.conn,
+		ctl:    newControl(s.conn),
+		addr:   addr,
+	}, nil
+}
+
+// StreamSession is a STREAM style session, and can dial and accept streams
+// over I2P. It may also be a STREAM subsession of a PRIMARY session, see
+// NewPrimarySession.
+type StreamSession struct {
+	// streams counts open streams, and read and written the bytes through
+	// them, on the main session for the subsessions too. They come first
+	// to be 64-bit aligned for sync/atomic.
+	streams int64
+	read    uint64
+	written uint64
+
+	bridge *Bridge
+	id     string
+	conn   *Conn
+	ctl    *control
+	addr   i2pkeys.I2PAddr
+
+	// primaryID is set on the main subsession of a PRIMARY session, which
+	// keeps the subsessions WithOptions made in subs. parent is set on those,
+	// with the port they dial from and how many are using them, guarded by
+	// the parent's subMu.
+	primaryID string
+	parent    *StreamSession
+	subMu     sync.Mutex
+	subs      map[string]*StreamSession
+	port      int
+	users     int
+
+	// accepting are the connections waiting in STREAM ACCEPT
+	acceptMu  sync.Mutex
+	accepting map[*Conn]bool
+}
+
+// ID returns the local tunnel name of the session
+func (ss *StreamSession) ID() string {
+	return ss.id
+}
+
+// Addr returns the I2P destination of the session
+func (ss *StreamSession) Addr() i2pkeys.I2PAddr {
+	return ss.addr
+}
+
+// root is the session that owns the control connection
+func (ss *StreamSession) root() *StreamSession {
+	if ss.parent != nil {
+		return ss.parent
+	}
+	return ss
+}
+
+// Streams is how many streams dialed or accepted on the session, or its
+// subsessions, are still open
+func (ss *StreamSession) Streams() int {
+	return int(atomic.LoadInt64(&ss.root().streams))
+}
+
+// Traffic is how many bytes have been read from and written to the session's
+// streams, and its subsessions', so far
+func (ss *StreamSession) Traffic() (read, written uint64) {
+	root := ss.root()
+	return atomic.LoadUint64(&root.read), atomic.LoadUint64(&root.written)
+}
+
+// track counts c as a stream of the session until it's closed
+func (ss *StreamSession) track(c *Conn, laddr, raddr i2pkeys.I2PAddr) *SAMConn {
+	root := ss.root()
+	atomic.AddInt64(&root.streams, 1)
+	return &SAMConn{laddr: laddr, raddr: raddr, conn: c, session: root}
+}
+
+// stopAccepting ends any STREAM ACCEPT waiting on the session, so that
+// listeners move on to whichever session comes next
+func (ss *StreamSession) stopAccepting() {
+	ss.acceptMu.Lock()
+	defer ss.acceptMu.Unlock()
+	for c := range ss.accepting {
+		c.Close()
+	}
+}
+
+func (ss *StreamSession) setAccepting(c *Conn, on bool) {
+	ss.acceptMu.Lock()
+	defer ss.acceptMu.Unlock()
+	if !on {
+		delete(ss.accepting, c)
+		return
+	}
+	if ss.accepting == nil {
+		ss.accepting = map[*Conn]bool{}
+	}
+	ss.accepting[c] = true
+}
+
+// Close ends the session by closing its control connection. Closing a
+// subsession made by WithOptions only gives it up, see WithOptions.
+func (ss *StreamSession) Close() error {
+	if ss.parent != nil {
+		return ss.parent.release(ss)
+	}
+	return ss.conn.Close()
+}
+
+// Lookup resolves a name on a fresh connection to the bridge
+func (ss *StreamSession) Lookup(name string) (i2pkeys.I2PAddr, error) {
+	sam, err := NewSAM(ss.bridge)
+	if err != nil {
+		return "", err
+	}
+	defer sam.Close()
+	return sam.Lookup(name)
+}
+
+// DialI2P opens a stream to an I2P destination
+func (ss *StreamSession) DialI2P(addr i2pkeys.I2PAddr) (*SAMConn, error) {
+	return ss.DialContextI2P(context.Background(), "", addr.Base64())
+}
+
+// DialContextI2P opens a stream to addr, which may be a base64 destination or
+// a .i2p name. Cancelling ctx aborts the dial.
+func (ss *StreamSession) DialContextI2P(ctx context.Context, n, addr string) (*SAMConn, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	dest := i2pkeys.I2PAddr(addr)
+	if strings.HasSuffix(addr, ".i2p") {
+		var err error
+		if dest, err = ss.Lookup(addr); err != nil {
+			return nil, err
+		}
+	} else if _, err := i2pkeys.NewI2PAddrFromString(addr); err != nil {
+		return nil, err
+	}
+	c, err := ss.bridge.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := closeOnDone(ctx, c)
+	r, err := c.Command("STREAM CONNECT ID=" + ss.id + " DESTINATION=" + dest.Base64() + " SILENT=false")
+	if !stop() {
+		c.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := r.Err(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return ss.track(c, ss.addr, dest), nil
+}
+
+// Listen returns a listener for streams to the session's destination
+func (ss *StreamSession) Listen() (*StreamListener, error) {
+	return &StreamListener{session: ss}, nil
+}
+
+// StreamListener accepts streams for a StreamSession
+type StreamListener struct {
+	session *StreamSession
+}
+
+// Addr returns the destination streams are accepted on
+func (l *StreamListener) Addr() net.Addr {
+	return l.session.addr
+}
+
+// Close closes the listener's session
+func (l *StreamListener) Close() error {
+	return l.session.Close()
+}
+
+// Accept waits for the next stream, implements net.Listener
+func (l *StreamListener) Accept() (net.Conn, error) {
+	return l.AcceptI2P()
+}
+
+// AcceptI2P waits for the next stream to our destination
+func (l *StreamListener) AcceptI2P() (*SAMConn, error) {
+	c, err := l.session.bridge.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return l.session.accept(c)
+}
+
+// accept waits for a stream on c, a fresh connection to the bridge, and closes
+// c if that fails.
+func (ss *StreamSession) accept(c *Conn) (*SAMConn, error) {
+	ss.setAccepting(c, true)
+	defer ss.setAccepting(c, false)
+	r, err := c.Command("STREAM ACCEPT ID=" + ss.id + " SILENT=false")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := r.Err(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	// once a peer connects, the bridge tells us who it is on its own line
+	line, err := c.ReadLine()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	dest := strings.Fields(line)
+	if len(dest) == 0 {
+		c.Close()
+		return nil, fmt.Errorf("SAM bridge sent an empty peer destination")
+	}
+	return ss.track(c, ss.addr, i2pkeys.I2PAddr(dest[0])), nil
+}
+
+// SAMConn is a stream over I2P, it implements net.Conn
+type SAMConn struct {
+	laddr i2pkeys.I2PAddr
+	raddr i2pkeys.I2PAddr
+	conn  *Conn
+	// session counts the stream until it's closed, and release, if set, is
+	// called then too
+	session *StreamSession
+	release func()
+	once    sync.Once
+}
+
+// Read implements net.Conn
+func (sc *SAMConn) Read(buf []byte) (int, error) {
+	n, err := sc.conn.Read(buf)
+	if sc.session != nil {
+		atomic.AddUint64(&sc.session.read, uint64(n))
+	}
+	return n, err
+}
+
+// Write implements net.Conn
+func (sc *SAMConn) Write(buf []byte) (int, error) {
+	n, err := sc.conn.Write(buf)
+	if sc.session != nil {
+		atomic.AddUint64(&sc.session.written, uint64(n))
+	}
+	return n, err
+}
+
+// Close implements net.Conn
+func (sc *SAMConn) Close() error {
+	err := sc.conn.Close()
+	sc.once.Do(func() {
+		if sc.session != nil {
+			atomic.AddInt64(&sc.session.streams, -1)
+		}
+		if sc.release != nil {
+			sc.release()
+		}
+	})
+	return err
+}
+
+// LocalAddr implements net.Conn
+func (sc *SAMConn) LocalAddr() net.Addr {
+	return sc.laddr
+}
+
+// RemoteAddr implements net.Conn
+func (sc *SAMConn) RemoteAddr() net.Addr {
+	return sc.raddr
+}
+
+// SetDeadline implements net.Conn
+func (sc *SAMConn) SetDeadline(t time.Time) error {
+	return sc.conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn
+func (sc *SAMConn) SetReadDeadline(t time.Time) error {
+	return sc.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn
+func (sc *SAMConn) SetWriteDeadline(t time.Time) error {
+	return sc.conn.SetWriteDeadline(t)
+}
+
+// closeOnDone closes c if ctx is cancelled before the returned stop function
+// is called. stop reports false if ctx got there first.
+func closeOnDone(ctx context.Context, c net.Conn) (stop func() bool) {
+	done := make(chan struct{})
+	cancelled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+			cancelled <- true
+		case <-done:
+			cancelled <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return !<-cancelled
+	}
+}
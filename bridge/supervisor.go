@@ -0,0 +1,969 @@
+package i2pbridge
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eyedeekay/sam3/i2pkeys"
+)
+
+// Status is how a Supervisor's session is doing
+type Status int
+
+const (
+	// StatusConnecting means there's no session yet, or it's being recreated
+	StatusConnecting Status = iota
+	// StatusReady means the session is up and can dial and accept streams
+	StatusReady
+	// StatusLost means the control socket died, a new session will be made
+	StatusLost
+	// StatusClosed means the supervisor has stopped, for good
+	StatusClosed
+	// StatusPublished means the session is up and its lease set has been
+	// published, so that others can reach it
+	StatusPublished
+	// StatusIdle means the session was closed for lack of use, the next
+	// dial makes a new one
+	StatusIdle
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusConnecting:
+		return "connecting"
+	case StatusReady:
+		return "ready"
+	case StatusLost:
+		return "lost"
+	case StatusClosed:
+		return "closed"
+	case StatusPublished:
+		return "published"
+	case StatusIdle:
+		return "idle"
+	}
+	return "Status(" + strconv.Itoa(int(s)) + ")"
+}
+
+// Event reports what a Supervisor is doing
+type Event struct {
+	Status Status
+	// Bridge is the bridge the event is about, without its password
+	Bridge string
+	// Session is the ID of the session once it's ready
+	Session string
+	// Attempt counts the tries at making a session since the last one worked
+	Attempt int
+	// Err is why a try failed, why the session was lost, or why the
+	// supervisor gave up
+	Err  error
+	Time time.Time
+}
+
+// KeySource hands the supervisor the keys to create a session with on bridge
+// b. It's asked every time a session is made, so the keys needn't be kept in
+// memory between times.
+type KeySource func(b *Bridge) (i2pkeys.I2PKeys, error)
+
+// BridgeHealth is what the last health check of a bridge found
+type BridgeHealth struct {
+	Bridge  string
+	Healthy bool
+	Checked time.Time
+	Err     error
+}
+
+// ErrClosed is returned once a Supervisor or Listener has been closed
+var ErrClosed = errors.New("SAM session closed")
+
+const (
+	// eventBuffer is how many events can queue up before new ones are dropped
+	eventBuffer = 32
+	// idleChecks is how many times per IdleTimeout the session is checked
+	// for streams, but never more often than every minIdleCheck
+	idleChecks   = 10
+	minIdleCheck = 10 * time.Millisecond
+)
+
+// errIdle is why a session was closed for lack of use
+var errIdle = errors.New("SAM session idle")
+
+// Supervisor keeps a stream session alive. If the router restarts and the
+// control socket dies, it notices, either because the socket closes or because
+// the bridge stops answering PING, and makes a new session with the same keys
+// and options, backing off between tries. Dials and listeners made through the
+// Supervisor carry on with the new session.
+//
+// A Supervisor can be given more than one bridge, in order of preference. It
+// uses the first one that works, and fails over to the next when the one it's
+// on goes away. Bridges that failed their last health check are tried last.
+type Supervisor struct {
+	// PingInterval is how often the bridge is pinged, if it speaks SAM 3.2,
+	// and PingTimeout how long it has to answer.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+	// MinBackoff and MaxBackoff bound the wait between tries at making a
+	// session.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// HealthInterval is how often every bridge is checked with a HELLO, when
+	// there's more than one.
+	HealthInterval time.Duration
+	// LookupInterval is how often a new session looks itself up until its
+	// lease set is found, see Ready.
+	LookupInterval time.Duration
+	// DrainTimeout is how long streams on a session that's been replaced by
+	// Reconfigure get to finish before it's closed under them.
+	DrainTimeout time.Duration
+	// IdleTimeout, if set, closes the session after that long without a
+	// stream, see StatusIdle. Listeners don't count unless
+	// ListenersKeepAlive is set; without it they wait for a dial to bring
+	// the session back rather than bringing it back themselves.
+	IdleTimeout        time.Duration
+	ListenersKeepAlive bool
+	// Primary makes PRIMARY sessions on bridges that speak SAM 3.3, so that
+	// DialWith can dial with streaming options of its own. Without it
+	// sessions are plain STREAM ones, which every bridge handles the same.
+	Primary bool
+
+	bridges []*Bridge
+	keys    KeySource
+
+	// reconfMu keeps Reconfigure to one at a time, and swaps hands run the
+	// session to move to
+	reconfMu sync.Mutex
+	swaps    chan *swap
+
+	mu      sync.Mutex
+	options []string
+	session *StreamSession
+	active  int
+	health  []BridgeHealth
+	addr    i2pkeys.I2PAddr
+	up      chan struct{}
+	failed  chan struct{}
+	// ready is closed once the session's lease set is published, and gone
+	// once the session is lost
+	ready     chan struct{}
+	gone      chan struct{}
+	published bool
+	lookupErr error
+	// idle is set while the session is closed for lack of use, and wake is
+	// closed when it's brought back. listeners counts open Listeners.
+	idle      bool
+	wake      chan struct{}
+	listeners int
+	started   bool
+	ran       bool
+	closed    bool
+	err       error
+	done      chan struct{}
+	events    chan Event
+}
+
+// NewSupervisor sets up a supervisor for a session on the first of bridges
+// that works. It doesn't connect until Start is called.
+func NewSupervisor(bridges []*Bridge, keys KeySource, options []string) *Supervisor {
+	if len(bridges) == 0 {
+		bridges = []*Bridge{Default()}
+	}
+	health := make([]BridgeHealth, len(bridges))
+	for i, b := range bridges {
+		health[i] = BridgeHealth{Bridge: b.String(), Healthy: true}
+	}
+	return &Supervisor{
+		PingInterval:   time.Minute,
+		PingTimeout:    30 * time.Second,
+		MinBackoff:     time.Second,
+		MaxBackoff:     time.Minute,
+		HealthInterval: time.Minute,
+		LookupInterval: 5 * time.Second,
+		DrainTimeout:   2 * time.Minute,
+		bridges:        bridges,
+		keys:           keys,
+		options:        append([]string{}, options...),
+		health:         health,
+		up:             make(chan struct{}),
+		failed:         make(chan struct{}),
+		ready:          make(chan struct{}),
+		gone:           make(chan struct{}),
+		done:           make(chan struct{}),
+		events:         make(chan Event, eventBuffer),
+		swaps:          make(chan *swap),
+		wake:           make(chan struct{}),
+	}
+}
+
+// Events reports status changes. Nobody has to listen, if the channel fills up
+// new events are dropped rather than holding the supervisor up.
+func (s *Supervisor) Events() <-chan Event {
+	return s.events
+}
+
+// Bridge is the bridge the session is on, or was last on
+func (s *Supervisor) Bridge() *Bridge {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bridges[s.active]
+}
+
+// Active is the bridge the session is on, or nil while there's no session
+func (s *Supervisor) Active() *Bridge {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session == nil {
+		return nil
+	}
+	return s.bridges[s.active]
+}
+
+// Bridges are all the bridges the supervisor can use, most preferred first
+func (s *Supervisor) Bridges() []*Bridge {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Bridge{}, s.bridges...)
+}
+
+// SetBridges replaces the bridges to use. It's only allowed until the
+// supervisor first starts, for when the bridge isn't known until then.
+func (s *Supervisor) SetBridges(bridges []*Bridge) error {
+	if len(bridges) == 0 {
+		return fmt.Errorf("no SAM bridges given")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ran || s.closed {
+		return fmt.Errorf("can't change SAM bridges once the supervisor has started")
+	}
+	s.bridges = append([]*Bridge{}, bridges...)
+	s.health = make([]BridgeHealth, len(bridges))
+	for i, b := range bridges {
+		s.health[i] = BridgeHealth{Bridge: b.String(), Healthy: true}
+	}
+	return nil
+}
+
+// Health reports the last check of every bridge, in order of preference
+func (s *Supervisor) Health() []BridgeHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]BridgeHealth{}, s.health...)
+}
+
+// Addr is the session's destination, once it has been up
+func (s *Supervisor) Addr() i2pkeys.I2PAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+// Status says whether the session is up right now
+func (s *Supervisor) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.closed:
+		return StatusClosed
+	case s.idle:
+		return StatusIdle
+	case s.session != nil && s.published:
+		return StatusPublished
+	case s.session != nil:
+		return StatusReady
+	}
+	return StatusConnecting
+}
+
+// Start starts supervising and waits for the first session. It gives up early
+// if the bridge isn't there at all or turns us down in a way that trying again
+// won't fix, like bad credentials, otherwise it keeps trying until ctx is done.
+// Once a session has been up, losing the bridge only ever means retrying.
+//
+// Nothing touches the network until Start, or the first Session, dial or
+// accept, which start the supervisor too. If the bridge wasn't there, the next
+// call tries again, but bad credentials and the like close the supervisor.
+func (s *Supervisor) Start(ctx context.Context) error {
+	_, err := s.Session(ctx)
+	return err
+}
+
+// Current is the session if it's up right now, it never starts or waits for
+// one.
+func (s *Supervisor) Current() *StreamSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session
+}
+
+// Session returns the current session, starting the supervisor if need be and
+// waiting for one if it's being made.
+func (s *Supervisor) Session(ctx context.Context) (*StreamSession, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for {
+		s.mu.Lock()
+		if s.closed {
+			err := s.err
+			s.mu.Unlock()
+			if err == nil {
+				err = ErrClosed
+			}
+			return nil, err
+		}
+		if s.session != nil {
+			ss := s.session
+			s.mu.Unlock()
+			return ss, nil
+		}
+		if !s.started {
+			s.started = true
+			s.err = nil
+			if s.idle {
+				s.idle = false
+				close(s.wake)
+				s.wake = make(chan struct{})
+			}
+			if !s.ran && len(s.bridges) > 1 && s.HealthInterval > 0 {
+				go s.checkHealth()
+			}
+			s.ran = true
+			go s.run()
+		}
+		up, failed := s.up, s.failed
+		s.mu.Unlock()
+		select {
+		case <-up:
+		case <-failed:
+			s.mu.Lock()
+			err := s.err
+			s.mu.Unlock()
+			return nil, err
+		case <-s.done:
+		case <-ctx.Done():
+			s.mu.Lock()
+			lastErr := s.err
+			s.mu.Unlock()
+			if lastErr != nil {
+				return nil, fmt.Errorf("%s, last error: %w", ctx.Err(), lastErr)
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close stops supervising and closes the session
+func (s *Supervisor) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	ss := s.session
+	s.session = nil
+	close(s.done)
+	s.mu.Unlock()
+	s.emit(Event{Status: StatusClosed})
+	if ss != nil {
+		return ss.Close()
+	}
+	return nil
+}
+
+// DialContextI2P dials addr on the current session, see
+// StreamSession.DialContextI2P. If the dial shows the session is gone, the
+// supervisor starts making a new one.
+func (s *Supervisor) DialContextI2P(ctx context.Context, n, addr string) (*SAMConn, error) {
+	ss, err := s.Session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ss.DialContextI2P(ctx, n, addr)
+	if err != nil {
+		s.checkLost(ss, err)
+	}
+	return c, err
+}
+
+// DialWith is DialContextI2P with streaming options of its own, see
+// StreamSession.WithOptions. Without options it dials on the session itself.
+func (s *Supervisor) DialWith(ctx context.Context, options []string, addr string) (*SAMConn, error) {
+	ss, err := s.Session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := ss.WithOptions(options)
+	if err != nil {
+		s.checkLost(ss, err)
+		return nil, err
+	}
+	c, err := sub.DialContextI2P(ctx, "", addr)
+	if err != nil {
+		releaseSub(ss, sub)
+		s.checkLost(ss, err)
+		return nil, err
+	}
+	c.release = func() { releaseSub(ss, sub) }
+	return c, nil
+}
+
+// releaseSub gives up sub if WithOptions made it for a dial on ss
+func releaseSub(ss, sub *StreamSession) {
+	if sub != ss {
+		sub.Close()
+	}
+}
+
+// Listen returns a listener that keeps accepting across new sessions
+func (s *Supervisor) Listen() (*Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	s.listeners++
+	return &Listener{supervisor: s, done: make(chan struct{})}, nil
+}
+
+// fatal are the errors that making a session again won't fix
+func fatal(err error) bool {
+	return errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrVersionUnsupported) || errors.Is(err, ErrInvalidKey) ||
+		untrusted(err)
+}
+
+// unreachable says whether err is from failing to connect to the bridge at all
+func unreachable(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// wasUp is true once there has been a session. Until then a bridge that isn't
+// there at all is reported straight away instead of being waited for.
+func (s *Supervisor) wasUp() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr != ""
+}
+
+// sessionGone says whether the bridge forgot about ss, or ss's own control
+// socket went. A refused dial or a stream's socket dropping doesn't mean that
+// by itself, if the bridge really went the watcher sees it on the control
+// socket.
+func sessionGone(ss *StreamSession, err error) bool {
+	return errors.Is(err, ErrInvalidID) || ss.root().dead()
+}
+
+// brokenConn says whether err is from the connection to the bridge failing,
+// rather than the bridge refusing what was asked.
+func brokenConn(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		(errors.As(err, &netErr) && !netErr.Timeout())
+}
+
+// checkLost drops ss if err says it's gone
+func (s *Supervisor) checkLost(ss *StreamSession, err error) {
+	if sessionGone(ss, err) {
+		// closing the control socket wakes the watcher, which takes it
+		// from there
+		ss.Close()
+	}
+}
+
+func (s *Supervisor) emit(e Event) {
+	e.Time = time.Now()
+	if e.Bridge == "" {
+		e.Bridge = s.Bridge().String()
+	}
+	select {
+	case s.events <- e:
+	default:
+	}
+}
+
+// run makes sessions and watches them until the supervisor is closed
+func (s *Supervisor) run() {
+	// ss is the session a drain made way for, if it's been made already, and
+	// pending the Reconfigure waiting on it
+	var ss *StreamSession
+	var pending *swap
+	defer func() {
+		if pending != nil {
+			close(pending.done)
+		}
+	}()
+	for {
+		var err error
+		if ss == nil {
+			ss, err = s.connect()
+		}
+		if err != nil {
+			if pending != nil && pending.err == nil {
+				pending.err = err
+			}
+			s.mu.Lock()
+			if s.closed {
+				s.mu.Unlock()
+				return
+			}
+			s.err = err
+			if fatal(err) {
+				s.mu.Unlock()
+				s.Close()
+				return
+			}
+			// the bridge wasn't there, whoever asks next tries again
+			s.started = false
+			close(s.failed)
+			s.failed = make(chan struct{})
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			ss.Close()
+			return
+		}
+		s.session = ss
+		s.addr = ss.Addr()
+		s.err = nil
+		s.lookupErr = nil
+		close(s.up)
+		s.mu.Unlock()
+		s.emit(Event{Status: StatusReady, Session: ss.ID()})
+		go s.confirm(ss)
+		if pending != nil {
+			close(pending.done)
+			pending = nil
+		}
+
+		var sw *swap
+		for {
+			sw, err = s.watch(ss)
+			if sw == nil || sw.next == nil {
+				break
+			}
+			s.moveTo(ss, sw.next)
+			close(sw.done)
+			ss = sw.next
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		s.session = nil
+		s.up = make(chan struct{})
+		close(s.gone)
+		s.gone = make(chan struct{})
+		if s.published {
+			s.ready = make(chan struct{})
+			s.published = false
+		}
+		s.err = err
+		if err == errIdle {
+			// whoever wants the session next starts it again
+			s.err = nil
+			s.idle = true
+			s.started = false
+			s.mu.Unlock()
+			ss.stopAccepting()
+			ss.Close()
+			s.emit(Event{Status: StatusIdle, Session: ss.ID()})
+			return
+		}
+		active := s.active
+		s.mu.Unlock()
+		if sw != nil {
+			// reconfiguring in place: dials wait for the session with
+			// the new options while the old one's streams finish
+			ss.stopAccepting()
+			s.drain(ss)
+			pending = sw
+			if ss, sw.err = s.remake(ss.bridge); sw.err != nil {
+				// the old options worked, the session comes back with them
+				s.mu.Lock()
+				s.options = sw.prev
+				s.mu.Unlock()
+			}
+			continue
+		}
+		// try the other bridges first, if there are any
+		s.setHealth(active, err)
+		ss.Close()
+		s.emit(Event{Status: StatusLost, Session: ss.ID(), Err: err})
+		ss = nil
+	}
+}
+
+// connect tries to make a session until it works, the supervisor is closed or
+// every bridge says something trying again won't fix.
+func (s *Supervisor) connect() (*StreamSession, error) {
+	for attempt := 1; ; attempt++ {
+		var lastErr error
+		allFatal, allUnreachable := true, true
+		for _, i := range s.order() {
+			b := s.bridges[i]
+			s.emit(Event{Status: StatusConnecting, Bridge: b.String(), Attempt: attempt})
+			ss, err := s.newSession(b)
+			s.setHealth(i, err)
+			if err == nil {
+				s.mu.Lock()
+				s.active = i
+				s.mu.Unlock()
+				return ss, nil
+			}
+			s.emit(Event{Status: StatusConnecting, Bridge: b.String(), Attempt: attempt, Err: err})
+			lastErr = err
+			allFatal = allFatal && fatal(err)
+			allUnreachable = allUnreachable && unreachable(err)
+		}
+		if len(s.bridges) > 1 {
+			lastErr = fmt.Errorf("none of %d SAM bridges worked, the last said: %w", len(s.bridges), lastErr)
+		}
+		if allFatal || (!s.wasUp() && allUnreachable) {
+			return nil, lastErr
+		}
+		s.mu.Lock()
+		s.err = lastErr
+		s.mu.Unlock()
+		select {
+		case <-time.After(s.backoff(attempt)):
+		case <-s.done:
+			return nil, ErrClosed
+		}
+	}
+}
+
+func (s *Supervisor) newSession(b *Bridge) (*StreamSession, error) {
+	keys, err := s.keys(b)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	options := s.options
+	s.mu.Unlock()
+	return openSession(b, keys, options, s.Primary)
+}
+
+// openSession makes a session on b, a PRIMARY one if primary is set and the
+// bridge can do that, since those can dial with per-dial streaming options as
+// well.
+func openSession(b *Bridge, keys i2pkeys.I2PKeys, options []string, primary bool) (*StreamSession, error) {
+	sam, err := NewSAM(b)
+	if err != nil {
+		return nil, err
+	}
+	newSession := sam.NewStreamSession
+	if primary && sam.Capabilities().Primary {
+		newSession = sam.NewPrimarySession
+	}
+	ss, err := newSession(newSessionID(), keys, options)
+	if err != nil {
+		sam.Close()
+		return nil, err
+	}
+	return ss, nil
+}
+
+// order is the order to try the bridges in: healthy ones first, each group in
+// order of preference.
+func (s *Supervisor) order() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var healthy, unhealthy []int
+	for i, h := range s.health {
+		if h.Healthy {
+			healthy = append(healthy, i)
+		} else {
+			unhealthy = append(unhealthy, i)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (s *Supervisor) setHealth(i int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health[i].Healthy = err == nil
+	s.health[i].Checked = time.Now()
+	s.health[i].Err = err
+}
+
+// checkHealth says HELLO to every bridge now and then, so that when the
+// session has to move, it moves to a bridge that's known to be up.
+func (s *Supervisor) checkHealth() {
+	ticker := time.NewTicker(s.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		for i, b := range s.Bridges() {
+			c, err := b.Dial()
+			if err == nil {
+				c.Close()
+			}
+			s.setHealth(i, err)
+		}
+	}
+}
+
+// backoff doubles from MinBackoff up to MaxBackoff, give or take a little so
+// that many nodes behind one router don't all come back at once.
+func (s *Supervisor) backoff(attempt int) time.Duration {
+	return backoff(s.MinBackoff, s.MaxBackoff, attempt)
+}
+
+func backoff(min, max time.Duration, attempt int) time.Duration {
+	d := min
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d - d/10 + time.Duration(mrand.Int63n(int64(d)/5+1))
+}
+
+// watch blocks until the session's control socket is lost, the supervisor is
+// closed or Reconfigure wants the session swapped. Bridges that speak SAM 3.2
+// are pinged, so that a router which hangs without closing the socket is
+// noticed too.
+func (s *Supervisor) watch(ss *StreamSession) (*swap, error) {
+	c := ss.conn
+	var tick <-chan time.Time
+	if c.Capabilities().Ping && s.PingInterval > 0 {
+		ticker := time.NewTicker(s.PingInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var idleTick <-chan time.Time
+	if s.IdleTimeout > 0 {
+		every := s.IdleTimeout / idleChecks
+		if every < minIdleCheck {
+			every = minIdleCheck
+		}
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		idleTick = ticker.C
+	}
+	busy := time.Now()
+	var waiting string
+	var timeout <-chan time.Time
+	for {
+		select {
+		case <-s.done:
+			return nil, ErrClosed
+		case sw := <-s.swaps:
+			return sw, nil
+		case now := <-idleTick:
+			if ss.Streams() > 0 || s.keptAlive() {
+				busy = now
+			} else if now.Sub(busy) >= s.IdleTimeout {
+				return nil, errIdle
+			}
+		case <-ss.ctl.dead:
+			return nil, fmt.Errorf("SAM control socket to %s lost: %w", ss.bridge, ss.ctl.err)
+		case <-tick:
+			if waiting != "" {
+				continue
+			}
+			waiting = strconv.FormatInt(time.Now().UnixNano(), 36)
+			if err := c.WriteLine("PING " + waiting); err != nil {
+				return nil, fmt.Errorf("SAM control socket to %s lost: %w", ss.bridge, err)
+			}
+			timeout = time.After(s.PingTimeout)
+		case p := <-ss.ctl.pongs:
+			if p == waiting {
+				waiting, timeout = "", nil
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("SAM bridge %s didn't answer PING within %s", ss.bridge, s.PingTimeout)
+		}
+	}
+}
+
+// newSessionID makes a session ID that won't clash with an old session the
+// router hasn't cleaned up yet.
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "garlictcp-" + hex.EncodeToString(b)
+}
+
+// Listener accepts streams on a Supervisor's session, whichever session that
+// happens to be. If the session is lost while waiting, it waits for the next
+// one and carries on accepting.
+type Listener struct {
+	supervisor *Supervisor
+
+	mu     sync.Mutex
+	accept *Conn
+	closed bool
+	done   chan struct{}
+}
+
+// Addr returns the destination streams are accepted on
+func (l *Listener) Addr() net.Addr {
+	return l.supervisor.Addr()
+}
+
+// Close stops accepting. The session itself stays up for dialing.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	l.supervisor.mu.Lock()
+	l.supervisor.listeners--
+	l.supervisor.mu.Unlock()
+	if l.accept != nil {
+		l.accept.Close()
+	}
+	return nil
+}
+
+// Accept waits for the next stream, implements net.Listener
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.AcceptI2P()
+}
+
+// AcceptI2P waits for the next stream to our destination
+func (l *Listener) AcceptI2P() (*SAMConn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-l.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for first := true; ; first = false {
+		// the first try brings an idle session back, later ones wait for
+		// a dial to, once it's gone idle under the listener
+		if !first {
+			if err := l.supervisor.waitAwake(ctx); err != nil {
+				return nil, err
+			}
+		}
+		ss, err := l.supervisor.Session(ctx)
+		if err != nil {
+			if l.isClosed() {
+				return nil, ErrClosed
+			}
+			return nil, err
+		}
+		c, err := ss.bridge.DialContext(ctx)
+		if err != nil {
+			if l.isClosed() {
+				return nil, ErrClosed
+			}
+			l.supervisor.checkLost(ss, err)
+			if err := l.pause(ctx); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !l.setAccept(c) {
+			c.Close()
+			return nil, ErrClosed
+		}
+		sc, err := ss.accept(c)
+		l.setAccept(nil)
+		if err == nil {
+			return sc, nil
+		}
+		if l.isClosed() {
+			return nil, ErrClosed
+		}
+		if l.supervisor.Current() != ss {
+			// Reconfigure moved the session on, accept on the new one
+			continue
+		}
+		if !sessionGone(ss, err) && !brokenConn(err) {
+			return nil, err
+		}
+		l.supervisor.checkLost(ss, err)
+		if err := l.pause(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// pause waits a moment before trying to accept again, so that a bridge that's
+// going away isn't hammered before the supervisor notices.
+func (l *Listener) pause(ctx context.Context) error {
+	select {
+	case <-time.After(l.supervisor.MinBackoff):
+		return nil
+	case <-ctx.Done():
+		return ErrClosed
+	}
+}
+
+func (l *Listener) setAccept(c *Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.accept = c
+	return true
+}
+
+func (l *Listener) isClosed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// keptAlive says whether open listeners keep the session from going idle
+func (s *Supervisor) keptAlive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ListenersKeepAlive && s.listeners > 0
+}
+
+// waitAwake waits while the session is closed for lack of use, for a dial to
+// bring it back. Listeners wait here, unless they keep the session alive.
+func (s *Supervisor) waitAwake(ctx context.Context) error {
+	s.mu.Lock()
+	idle, wake := s.idle, s.wake
+	s.mu.Unlock()
+	if !idle {
+		return nil
+	}
+	select {
+	case <-wake:
+		return nil
+	case <-s.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ErrClosed
+	}
+}
@@ -0,0 +1,484 @@
+package i2pbridge
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eyedeekay/sam3/i2pkeys"
+)
+
+// fakeRouter is just enough of a SAM bridge to create stream sessions, accept
+// streams and answer PING. restart drops every connection, like a router
+// restarting would.
+type fakeRouter struct {
+	t       *testing.T
+	l       net.Listener
+	version string
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	sessions map[string]bool
+	accepts  chan net.Conn
+	noPong   bool
+	created  int
+	// unpublished keeps NAMING LOOKUP from finding sessions
+	unpublished bool
+	// commands are the SESSION ADD, SESSION REMOVE, STREAM CONNECT and
+	// STREAM ACCEPT lines received
+	commands []string
+	// uniqueDests turns down a destination already in a session, as real
+	// bridges do. dests are the destinations in use.
+	uniqueDests bool
+	dests       map[string]bool
+	// creates are what each SESSION CREATE asked for, and reject turns down
+	// the ones it matches
+	creates []map[string]string
+	reject  func(map[string]string) bool
+}
+
+func newFakeRouter(t *testing.T, version string) *fakeRouter {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRouter{t: t, l: l, version: version, sessions: map[string]bool{}, dests: map[string]bool{}, accepts: make(chan net.Conn, 10)}
+	t.Cleanup(func() {
+		l.Close()
+		r.restart()
+	})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.conns = append(r.conns, c)
+			r.mu.Unlock()
+			go r.serve(c)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRouter) bridge() *Bridge {
+	return &Bridge{Address: r.l.Addr().String()}
+}
+
+func (r *fakeRouter) restart() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.conns {
+		c.Close()
+	}
+	r.conns = nil
+	r.sessions = map[string]bool{}
+}
+
+func (r *fakeRouter) record(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = append(r.commands, strings.TrimSpace(line))
+}
+
+func (r *fakeRouter) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.commands...)
+}
+
+func (r *fakeRouter) sessionCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.created
+}
+
+func (r *fakeRouter) lastCreate() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.creates) == 0 {
+		return nil
+	}
+	return r.creates[len(r.creates)-1]
+}
+
+func (r *fakeRouter) serve(c net.Conn) {
+	br := bufio.NewReader(c)
+	// the session's destination is free again once its control socket goes
+	var dest string
+	defer func() {
+		r.mu.Lock()
+		delete(r.dests, dest)
+		r.mu.Unlock()
+	}()
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		req, err := ParseReply(strings.TrimSpace(line))
+		if err != nil {
+			return
+		}
+		switch req.Topic + " " + req.Type {
+		case "HELLO VERSION":
+			c.Write([]byte("HELLO REPLY RESULT=OK VERSION=" + r.version + "\n"))
+		case "SESSION CREATE":
+			dest = req.Pairs["DESTINATION"]
+			if dest == "TRANSIENT" {
+				dest = transientPriv(r.t)
+			}
+			r.mu.Lock()
+			if r.uniqueDests && r.dests[dest] {
+				r.mu.Unlock()
+				dest = ""
+				c.Write([]byte("SESSION STATUS RESULT=DUPLICATED_DEST\n"))
+				continue
+			}
+			if r.reject != nil && r.reject(req.Pairs) {
+				r.mu.Unlock()
+				dest = ""
+				c.Write([]byte("SESSION STATUS RESULT=I2P_ERROR MESSAGE=\"options turned down\"\n"))
+				continue
+			}
+			r.dests[dest] = true
+			r.sessions[req.Pairs["ID"]] = true
+			r.created++
+			r.creates = append(r.creates, req.Pairs)
+			r.mu.Unlock()
+			c.Write([]byte("SESSION STATUS RESULT=OK DESTINATION=" + dest + "\n"))
+		case "NAMING LOOKUP":
+			r.mu.Lock()
+			unpublished := r.unpublished
+			r.mu.Unlock()
+			if unpublished {
+				c.Write([]byte("NAMING REPLY RESULT=KEY_NOT_FOUND NAME=" + req.Pairs["NAME"] + "\n"))
+				continue
+			}
+			// every session the tests make uses the same keys
+			keys, _ := testKeySource(nil)
+			c.Write([]byte("NAMING REPLY RESULT=OK NAME=" + req.Pairs["NAME"] + " VALUE=" + string(keys.Addr()) + "\n"))
+		case "SESSION ADD", "SESSION REMOVE":
+			r.record(line)
+			c.Write([]byte("SESSION STATUS RESULT=OK\n"))
+		case "STREAM CONNECT":
+			r.record(line)
+			c.Write([]byte("STREAM STATUS RESULT=OK\n"))
+			return
+		case "STREAM ACCEPT":
+			r.record(line)
+			r.mu.Lock()
+			ok := r.sessions[req.Pairs["ID"]]
+			r.mu.Unlock()
+			if !ok {
+				c.Write([]byte("STREAM STATUS RESULT=INVALID_ID\n"))
+				continue
+			}
+			c.Write([]byte("STREAM STATUS RESULT=OK\n"))
+			r.accepts <- c
+			return
+		default:
+			if strings.HasPrefix(line, "PING") {
+				r.mu.Lock()
+				noPong := r.noPong
+				r.mu.Unlock()
+				if !noPong {
+					c.Write([]byte("PONG" + strings.TrimPrefix(line, "PING")))
+				}
+			}
+		}
+	}
+}
+
+func testKeySource(*Bridge) (i2pkeys.I2PKeys, error) {
+	return i2pkeys.NewKeys(i2pkeys.I2PAddr("fakepub"), "fakepriv"), nil
+}
+
+func fastSupervisor(b *Bridge) *Supervisor {
+	return fastFailover(b)
+}
+
+func fastFailover(bridges ...*Bridge) *Supervisor {
+	s := NewSupervisor(bridges, testKeySource, []string{"inbound.length=1"})
+	s.MinBackoff = 10 * time.Millisecond
+	s.MaxBackoff = 50 * time.Millisecond
+	s.PingInterval = 20 * time.Millisecond
+	s.PingTimeout = 50 * time.Millisecond
+	s.HealthInterval = 20 * time.Millisecond
+	s.LookupInterval = 20 * time.Millisecond
+	return s
+}
+
+func waitStatus(t *testing.T, s *Supervisor, want Status) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-s.Events():
+			if e.Status == want {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", want)
+		}
+	}
+}
+
+func TestSupervisorRecovers(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	s := fastSupervisor(r.bridge())
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first := waitStatus(t, s, StatusReady)
+
+	l, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := l.AcceptI2P()
+		if err == nil {
+			c.Close()
+		}
+		accepted <- err
+	}()
+	// let the listener get its accept in against the first session
+	<-r.accepts
+
+	r.restart()
+	if e := waitStatus(t, s, StatusLost); e.Err == nil {
+		t.Error("lost event should say why")
+	}
+	second := waitStatus(t, s, StatusReady)
+	if second.Session == first.Session {
+		t.Error("new session reused the old ID")
+	}
+	if n := r.sessionCount(); n != 2 {
+		t.Errorf("created %d sessions, want 2", n)
+	}
+
+	// the listener should be accepting on the new session by now
+	select {
+	case c := <-r.accepts:
+		c.Write([]byte("peerdest FROM_PORT=0 TO_PORT=0\n"))
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener didn't come back")
+	}
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSupervisorPingTimeout(t *testing.T) {
+	r := newFakeRouter(t, "3.2")
+	s := fastSupervisor(r.bridge())
+	defer s.Close()
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, s, StatusReady)
+	r.mu.Lock()
+	r.noPong = true
+	r.mu.Unlock()
+	e := waitStatus(t, s, StatusLost)
+	if e.Err == nil || !strings.Contains(e.Err.Error(), "PING") {
+		t.Errorf("got %v, want a PING timeout", e.Err)
+	}
+	r.mu.Lock()
+	r.noPong = false
+	r.mu.Unlock()
+	waitStatus(t, s, StatusReady)
+}
+
+func TestSupervisorStartGivesUp(t *testing.T) {
+	addr, _ := fakeSAM(t, func(string) string {
+		return `HELLO REPLY RESULT=I2P_ERROR MESSAGE="Authentication failed"`
+	})
+	s := fastSupervisor(&Bridge{Address: addr, User: "alice", Password: "wrong"})
+	err := s.Start(context.Background())
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("got %v, want ErrAuthFailed", err)
+	}
+	if s.Status() != StatusClosed {
+		t.Error("supervisor should stop after a fatal error")
+	}
+}
+
+func TestSupervisorStartUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	s := fastSupervisor(&Bridge{Address: addr})
+	defer s.Close()
+	err = s.Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("got %v, want connection refused", err)
+	}
+}
+
+func TestSupervisorStartTimeout(t *testing.T) {
+	// a bridge that accepts connections but never says HELLO
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s := fastSupervisor(&Bridge{Address: l.Addr().String()})
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Start(ctx); !errors.Is(err, context.DeadlineExceeded) && !strings.Contains(err.Error(), "deadline") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestSupervisorFailover(t *testing.T) {
+	main := newFakeRouter(t, "3.1")
+	fallback := newFakeRouter(t, "3.1")
+	s := fastFailover(main.bridge(), fallback.bridge())
+	defer s.Close()
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if a := s.Active(); a == nil || a.Address != main.bridge().Address {
+		t.Fatalf("should start on the main bridge, got %v", a)
+	}
+
+	// the main router goes away for good
+	main.l.Close()
+	main.restart()
+	waitStatus(t, s, StatusLost)
+	e := waitStatus(t, s, StatusReady)
+	if e.Bridge != fallback.bridge().String() {
+		t.Errorf("failed over to %s", e.Bridge)
+	}
+	if a := s.Active(); a == nil || a.Address != fallback.bridge().Address {
+		t.Errorf("active bridge is %v", a)
+	}
+	health := s.Health()
+	if len(health) != 2 || health[0].Healthy || health[0].Err == nil || !health[1].Healthy {
+		t.Errorf("health is %+v", health)
+	}
+}
+
+func TestSupervisorSkipsDeadBridge(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := &Bridge{Address: l.Addr().String()}
+	l.Close()
+	live := newFakeRouter(t, "3.1")
+	s := fastFailover(dead, live.bridge())
+	defer s.Close()
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if a := s.Active(); a == nil || a.Address != live.bridge().Address {
+		t.Errorf("active bridge is %v", a)
+	}
+}
+
+func TestSupervisorKeepsSessionOnRefusedDial(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	s := fastSupervisor(r.bridge())
+	defer s.Close()
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, s, StatusReady)
+	ss := s.Current()
+
+	// the bridge stops taking new connections, but the session's control
+	// socket is still there
+	r.l.Close()
+	_, err := s.DialContextI2P(context.Background(), "", testPeer(t))
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("got %v, want connection refused", err)
+	}
+	select {
+	case e := <-s.Events():
+		t.Fatalf("got a %s event, the session wasn't lost", e.Status)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if s.Current() != ss || s.Status() != StatusReady {
+		t.Errorf("status %s, session should have been kept", s.Status())
+	}
+}
+
+func TestDialContextI2PGivesUp(t *testing.T) {
+	// a bridge that accepts connections but never says HELLO
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ss := &StreamSession{bridge: &Bridge{Address: l.Addr().String()}, id: "test"}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := ss.DialContextI2P(ctx, "", testPeer(t)); err == nil {
+		t.Fatal("dial should fail")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("dial took %s to give up", d)
+	}
+}
+
+func TestSupervisorWaitReady(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	r.mu.Lock()
+	r.unpublished = true
+	r.mu.Unlock()
+	s := fastSupervisor(r.bridge())
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := s.WaitReady(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "KEY_NOT_FOUND") {
+		t.Fatalf("got %v, want a timeout saying the lookup failed", err)
+	}
+	if s.Status() != StatusReady {
+		t.Errorf("status %s, want ready but not published", s.Status())
+	}
+
+	r.mu.Lock()
+	r.unpublished = false
+	r.mu.Unlock()
+	if err := s.WaitReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, s, StatusPublished)
+	if s.Status() != StatusPublished {
+		t.Errorf("status %s", s.Status())
+	}
+
+	// a new session has to be published all over again
+	r.mu.Lock()
+	r.unpublished = true
+	r.mu.Unlock()
+	r.restart()
+	waitStatus(t, s, StatusReady)
+	select {
+	case <-s.Ready():
+		t.Error("new session ready before it was published")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
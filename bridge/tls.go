@@ -0,0 +1,98 @@
+package i2pbridge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrFingerprintMismatch is returned when the bridge's TLS certificate isn't
+// one of the pinned ones.
+var ErrFingerprintMismatch = errors.New("SAM bridge certificate doesn't match the pinned fingerprint")
+
+// Fingerprint is the hex SHA-256 of a certificate, the form pins are given in
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseFingerprint reads a hex SHA-256 fingerprint. Colons and spaces between
+// the bytes, as openssl and Java's keytool print them, are fine.
+func ParseFingerprint(s string) ([]byte, error) {
+	s = strings.NewReplacer(":", "", " ", "").Replace(strings.TrimSpace(s))
+	fp, err := hex.DecodeString(s)
+	if err != nil || len(fp) != sha256.Size {
+		return nil, fmt.Errorf("%q isn't a hex SHA-256 certificate fingerprint", s)
+	}
+	return fp, nil
+}
+
+// TLSConfig makes a TLS config that only trusts a SAM bridge whose certificate
+// is signed by one of roots, or whose SHA-256 fingerprint is one of
+// fingerprints. With both, the certificate has to pass both checks. With only
+// fingerprints the chain isn't checked at all, so a self-signed certificate,
+// which is what Java I2P makes for SAM, works. The system's CAs are never
+// trusted, at least one of the two has to be given.
+func TLSConfig(roots *x509.CertPool, fingerprints ...string) (*tls.Config, error) {
+	if roots == nil && len(fingerprints) == 0 {
+		return nil, fmt.Errorf("SAM over TLS needs a CA or a certificate fingerprint to pin")
+	}
+	var pins [][]byte
+	for _, f := range fingerprints {
+		fp, err := ParseFingerprint(f)
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, fp)
+	}
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    roots,
+	}
+	if len(pins) > 0 {
+		// checking the chain is left to crypto/tls when there are roots
+		cfg.InsecureSkipVerify = roots == nil
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return ErrFingerprintMismatch
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			for _, pin := range pins {
+				if bytes.Equal(sum[:], pin) {
+					return nil
+				}
+			}
+			return fmt.Errorf("%w: it's %s", ErrFingerprintMismatch, hex.EncodeToString(sum[:]))
+		}
+	}
+	return cfg, nil
+}
+
+// clientTLS is b's TLS config, naming the bridge's host if it doesn't say
+// which name to check the certificate against.
+func (b *Bridge) clientTLS() *tls.Config {
+	cfg := b.TLS.Clone()
+	if cfg.ServerName == "" {
+		if host, _, err := net.SplitHostPort(b.address()); err == nil {
+			cfg.ServerName = host
+		}
+	}
+	return cfg
+}
+
+// untrusted says whether err is the bridge's certificate being turned down
+func untrusted(err error) bool {
+	var (
+		unknownCA x509.UnknownAuthorityError
+		hostname  x509.HostnameError
+		invalid   x509.CertificateInvalidError
+	)
+	return errors.Is(err, ErrFingerprintMismatch) || errors.As(err, &unknownCA) ||
+		errors.As(err, &hostname) || errors.As(err, &invalid)
+}
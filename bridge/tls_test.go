@@ -0,0 +1,147 @@
+package i2pbridge
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSigned makes a certificate for 127.0.0.1 that is its own CA
+func selfSigned(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sam bridge"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+// tlsSAM is fakeSAM over TLS, answering every HELLO with SAM 3.1
+func tlsSAM(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				if _, err := bufio.NewReader(c).ReadString('\n'); err == nil {
+					c.Write([]byte("HELLO REPLY RESULT=OK VERSION=3.1\n"))
+				}
+			}(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTLSFingerprint(t *testing.T) {
+	cert, parsed := selfSigned(t)
+	addr := tlsSAM(t, cert)
+
+	// openssl style, with colons and in upper case
+	fp := strings.ToUpper(Fingerprint(parsed))
+	var pretty []string
+	for i := 0; i < len(fp); i += 2 {
+		pretty = append(pretty, fp[i:i+2])
+	}
+	cfg, err := TLSConfig(nil, strings.Join(pretty, ":"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := (&Bridge{Address: addr, TLS: cfg}).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if c.Version.String() != "3.1" {
+		t.Errorf("version %s", c.Version)
+	}
+
+	other, _ := selfSigned(t)
+	wrong, err := TLSConfig(nil, Fingerprint(mustParse(t, other)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&Bridge{Address: addr, TLS: wrong}).Dial()
+	if !errors.Is(err, ErrFingerprintMismatch) || !fatal(err) {
+		t.Fatalf("got %v, want ErrFingerprintMismatch", err)
+	}
+}
+
+func TestTLSRoots(t *testing.T) {
+	cert, parsed := selfSigned(t)
+	addr := tlsSAM(t, cert)
+	roots := x509.NewCertPool()
+	roots.AddCert(parsed)
+	cfg, err := TLSConfig(roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := (&Bridge{Address: addr, TLS: cfg}).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	_, other := selfSigned(t)
+	wrongRoots := x509.NewCertPool()
+	wrongRoots.AddCert(other)
+	wrong, _ := TLSConfig(wrongRoots)
+	if _, err := (&Bridge{Address: addr, TLS: wrong}).Dial(); err == nil || !fatal(err) {
+		t.Fatalf("got %v, want an untrusted certificate", err)
+	}
+}
+
+func TestTLSConfigNeedsPin(t *testing.T) {
+	if _, err := TLSConfig(nil); err == nil {
+		t.Error("TLS config without a CA or pin should fail")
+	}
+	if _, err := TLSConfig(nil, "abcd"); err == nil {
+		t.Error("short fingerprint accepted")
+	}
+}
+
+func mustParse(t *testing.T, cert tls.Certificate) *x509.Certificate {
+	t.Helper()
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
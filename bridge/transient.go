@@ -0,0 +1,38 @@
+package i2pbridge
+
+import (
+	"fmt"
+
+	"github.com/eyedeekay/sam3/i2pkeys"
+)
+
+// transientKeys stands in for keys when the bridge is to make up a throwaway
+// destination for the session
+var transientKeys = i2pkeys.NewKeys("", "TRANSIENT")
+
+// Transient is a KeySource for sessions with a new throwaway destination each
+// time, DESTINATION=TRANSIENT. Nothing is stored, and the destination is gone
+// with the session.
+func Transient(*Bridge) (i2pkeys.I2PKeys, error) {
+	return transientKeys, nil
+}
+
+// IsTransient says whether keys asks for a transient destination
+func IsTransient(keys i2pkeys.I2PKeys) bool {
+	return keys.String() == transientKeys.String()
+}
+
+// destinationOf takes the destination from the front of the private keys the
+// bridge sends back for a transient session: 384 bytes of keys, then a
+// certificate whose length is in its 2nd and 3rd bytes.
+func destinationOf(priv string) (i2pkeys.I2PAddr, error) {
+	b, err := i2pkeys.I2PAddr(priv).ToBytes()
+	if err != nil || len(b) < 387 {
+		return "", fmt.Errorf("SAM bridge sent back malformed keys for the transient session")
+	}
+	n := 387 + (int(b[385])<<8 | int(b[386]))
+	if len(b) < n {
+		return "", fmt.Errorf("SAM bridge sent back truncated keys for the transient session")
+	}
+	return i2pkeys.NewI2PAddrFromBytes(b[:n])
+}
@@ -0,0 +1,66 @@
+package i2pbridge
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/eyedeekay/sam3/i2pkeys"
+)
+
+// transientPriv makes up private keys the way a bridge does for
+// DESTINATION=TRANSIENT: a destination with a 4 byte key certificate, then the
+// private keys.
+func transientPriv(t *testing.T) string {
+	b := make([]byte, 384+7+64)
+	rand.Read(b)
+	copy(b[384:], []byte{5, 0, 4, 0, 7, 0, 0})
+	priv, err := i2pkeys.NewI2PAddrFromBytes(b)
+	if err != nil {
+		t.Error(err)
+	}
+	return string(priv)
+}
+
+func TestTransientSession(t *testing.T) {
+	r := newFakeRouter(t, "3.1")
+	r.mu.Lock()
+	r.unpublished = true
+	r.mu.Unlock()
+	s := NewSupervisor([]*Bridge{r.bridge()}, Transient, []string{"i2cp.dontPublishLeaseSet=true"})
+	s.MinBackoff = 10 * time.Millisecond
+	s.PingInterval = 20 * time.Millisecond
+	s.PingTimeout = 50 * time.Millisecond
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// nothing gets published, so it's ready as soon as it's up
+	if err := s.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first := s.Addr()
+	if b, _ := first.ToBytes(); len(b) < 391 || len(first.Base32()) != 60 {
+		t.Fatalf("transient destination %q", first)
+	}
+
+	r.restart()
+	waitStatus(t, s, StatusLost)
+	waitStatus(t, s, StatusReady)
+	if s.Addr() == first {
+		t.Error("new session kept the old transient destination")
+	}
+}
+
+func TestDestinationOf(t *testing.T) {
+	if _, err := destinationOf("TRANSIENT"); err == nil {
+		t.Error("short keys accepted")
+	}
+	b := make([]byte, 400)
+	b[385], b[386] = 1, 0 // a 256 byte certificate that isn't there
+	priv, _ := i2pkeys.NewI2PAddrFromBytes(b)
+	if _, err := destinationOf(string(priv)); err == nil {
+		t.Error("truncated keys accepted")
+	}
+}
@@ -0,0 +1,125 @@
+package i2pbridge
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a SAM protocol version, like 3.2
+type Version struct {
+	Major, Minor int
+}
+
+var (
+	// MinVersion and MaxVersion are the SAM versions we know how to speak
+	MinVersion = Version{3, 0}
+	MaxVersion = Version{3, 3}
+
+	// authVersion is the first version with USER and PASSWORD
+	authVersion = Version{3, 2}
+)
+
+// ErrVersionUnsupported is returned when something needs a newer SAM version
+// than the bridge agreed to.
+var ErrVersionUnsupported = errors.New("SAM version too old")
+
+// ParseVersion reads a version like "3.1"
+func ParseVersion(s string) (Version, error) {
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) != 2 {
+		return Version{}, fmt.Errorf("invalid SAM version %q", s)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid SAM version %q", s)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid SAM version %q", s)
+	}
+	return Version{major, minor}, nil
+}
+
+func (v Version) String() string {
+	return strconv.Itoa(v.Major) + "." + strconv.Itoa(v.Minor)
+}
+
+// AtLeast is true if v is the same as or newer than w
+func (v Version) AtLeast(w Version) bool {
+	return v.Major > w.Major || (v.Major == w.Major && v.Minor >= w.Minor)
+}
+
+// Capabilities says what the bridge can do, going by the SAM version it
+// agreed to.
+type Capabilities struct {
+	Version Version
+	// SignatureTypes is SIGNATURE_TYPE in DEST GENERATE and SESSION CREATE
+	SignatureTypes bool
+	// Ports is FROM_PORT and TO_PORT on sessions and streams
+	Ports bool
+	// Ping is PING and PONG on the control socket
+	Ping bool
+	// Auth is USER and PASSWORD in HELLO
+	Auth bool
+	// Primary is STYLE=PRIMARY sessions with subsessions
+	Primary bool
+	// DatagramForward is forwarding received datagrams to a local UDP port
+	DatagramForward bool
+}
+
+// feature is something that arrived in a particular SAM version
+type feature struct {
+	name    string
+	version Version
+}
+
+var (
+	featureSignatureTypes  = feature{"SIGNATURE_TYPE", Version{3, 1}}
+	featurePorts           = feature{"FROM_PORT/TO_PORT", Version{3, 2}}
+	featurePing            = feature{"PING", Version{3, 2}}
+	featureAuth            = feature{"authentication", authVersion}
+	featurePrimary         = feature{"PRIMARY sessions", Version{3, 3}}
+	featureDatagramForward = feature{"datagram forwarding", Version{3, 0}}
+)
+
+// CapabilitiesOf works out what a bridge speaking version v can do
+func CapabilitiesOf(v Version) Capabilities {
+	return Capabilities{
+		Version:         v,
+		SignatureTypes:  v.AtLeast(featureSignatureTypes.version),
+		Ports:           v.AtLeast(featurePorts.version),
+		Ping:            v.AtLeast(featurePing.version),
+		Auth:            v.AtLeast(featureAuth.version),
+		Primary:         v.AtLeast(featurePrimary.version),
+		DatagramForward: v.AtLeast(featureDatagramForward.version),
+	}
+}
+
+// require fails with ErrVersionUnsupported if v is too old for f
+func (v Version) require(f feature) error {
+	if v.AtLeast(f.version) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s needs SAM %s, the bridge only speaks %s", ErrVersionUnsupported, f.name, f.version, v)
+}
+
+// checkOptions makes sure the bridge will understand the session options,
+// rather than letting it fail with a bare I2P_ERROR.
+func (v Version) checkOptions(options []string) error {
+	for _, o := range options {
+		key := strings.SplitN(o, "=", 2)[0]
+		switch key {
+		case "FROM_PORT", "TO_PORT":
+			if err := v.require(featurePorts); err != nil {
+				return err
+			}
+		case "SIGNATURE_TYPE":
+			if err := v.require(featureSignatureTypes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package i2pbridge
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	addr, hellos := fakeSAM(t, func(string) string {
+		return "HELLO REPLY RESULT=OK VERSION=3.3"
+	})
+	caps, err := (&Bridge{Address: addr}).Capabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := <-hellos; !strings.Contains(h, "MIN=3.0 MAX=3.3") {
+		t.Errorf("didn't offer 3.0 to 3.3: %s", h)
+	}
+	want := Capabilities{Version{3, 3}, true, true, true, true, true, true}
+	if caps != want {
+		t.Errorf("got %+v, want %+v", caps, want)
+	}
+}
+
+func TestOldBridge(t *testing.T) {
+	addr, _ := fakeSAM(t, func(string) string {
+		return "HELLO REPLY RESULT=OK"
+	})
+	caps, err := (&Bridge{Address: addr}).Capabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Version != MinVersion || caps.Ports || caps.Ping || caps.Primary || !caps.DatagramForward {
+		t.Errorf("a bridge that doesn't say its version should be 3.0: %+v", caps)
+	}
+	err = caps.Version.checkOptions([]string{"inbound.length=3", "FROM_PORT=1234"})
+	if !errors.Is(err, ErrVersionUnsupported) || !strings.Contains(err.Error(), "3.2") {
+		t.Errorf("FROM_PORT on SAM 3.0 should say it needs 3.2, got %v", err)
+	}
+}
+
+func TestNoVersion(t *testing.T) {
+	addr, _ := fakeSAM(t, func(string) string {
+		return "HELLO REPLY RESULT=NOVERSION"
+	})
+	_, err := (&Bridge{Address: addr, User: "alice", Password: "secret"}).Dial()
+	if !errors.Is(err, ErrVersionUnsupported) || !strings.Contains(err.Error(), "3.2 to 3.3") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	v, err := ParseVersion("3.1")
+	if err != nil || v != (Version{3, 1}) || v.String() != "3.1" {
+		t.Errorf("got %v %v", v, err)
+	}
+	if !v.AtLeast(Version{3, 0}) || v.AtLeast(Version{3, 2}) || !(Version{4, 0}).AtLeast(v) {
+		t.Error("AtLeast is wrong")
+	}
+	for _, s := range []string{"", "3", "3.x", "three.one"} {
+		if _, err := ParseVersion(s); err == nil {
+			t.Errorf("%q should not parse", s)
+		}
+	}
+}
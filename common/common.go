@@ -2,15 +2,17 @@ package i2phelpers
 
 import (
 	"fmt"
-	"github.com/eyedeekay/sam3"
 	"github.com/eyedeekay/sam3/i2pkeys"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
 	ma "github.com/multiformats/go-multiaddr"
+
+	"github.com/RTradeLtd/go-garlic-tcp-transport/bridge"
 )
 
 const (
@@ -22,12 +24,14 @@ const (
 	EnvDir = "KEYS_PATH"
 )
 
+// Path returns the location of a file in the keys directory. filename may or
+// may not already end in extension.
 func Path(filename, extension string) (string, error) {
 	dir, err := PathRoot()
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(dir, filename, extension), nil
+	return filepath.Join(dir, strings.TrimSuffix(filename, extension)+extension), nil
 }
 
 // PathRoot returns the default configuration root directory
@@ -89,56 +93,63 @@ func isValidExtension(ext string) bool {
 	return false
 }
 
-// LoadKeys loads keys into our keys from files in the keys directory
+// LoadKeys loads keys into our keys from files in the keys directory, creating
+// them with the default SAM bridge if they don't exist yet, see
+// LoadOrCreateKeys.
 func LoadKeys(keysPath string) (i2pkeys.I2PKeys, error) {
-	title := filepath.Base(keysPath)
-	extension := strings.ToLower(filepath.Ext(title))
-	realPath, err := Path(title, extension)
+	return LoadOrCreateKeys(keysPath, i2pbridge.Default())
+}
+
+// LoadOrCreateKeys loads keys from files in the keys directory, asking the SAM
+// bridge b for new keys if there aren't any yet. Existing keys may be in
+// sam3's format, plain base64 or the binary format of Java I2P and i2pd, new
+// ones are written in the binary format if the file ends in ".dat". New keys
+// are written atomically and readable only by their owner, and existing keys
+// are refused if anybody else could have read them.
+func LoadOrCreateKeys(keysPath string, b *i2pbridge.Bridge) (i2pkeys.I2PKeys, error) {
+	realPath, err := KeysFile(keysPath)
 	if err != nil {
 		return i2pkeys.I2PKeys{}, err
 	}
+	extension := strings.ToLower(filepath.Ext(realPath))
 	if _, err := os.Stat(realPath); os.IsNotExist(err) {
-		keys, err := CreateEepServiceKey()
-		if err != nil {
-			return i2pkeys.I2PKeys{}, err
-		}
-		file, err := os.Create(realPath)
-		defer file.Close()
+		keys, err := CreateKeys(b)
 		if err != nil {
 			return i2pkeys.I2PKeys{}, err
 		}
-		err = i2pkeys.StoreKeysIncompat(keys, file)
-		if err != nil {
+		if err := WriteKeysFile(realPath, keys, formatForExtension(extension)); err != nil {
 			return i2pkeys.I2PKeys{}, err
 		}
+		// metadata is best effort, it's never worth failing to start over
+		info := newKeyInfo(realPath, keys, time.Now())
+		info.LastUsed = info.Created
+		writeKeyInfo(info)
 		return keys, nil
 	}
 	if isValidExtension(extension) {
-		file, err := os.Open(realPath)
-		defer file.Close()
-		if err != nil {
-			return i2pkeys.I2PKeys{}, err
-		}
-		keys, err := i2pkeys.LoadKeysIncompat(file)
+		keys, err := readStoredKeys(realPath)
 		if err != nil {
 			return i2pkeys.I2PKeys{}, err
 		}
+		TouchKeys(keysPath, "")
 		return keys, nil
 	}
 	return i2pkeys.I2PKeys{}, fmt.Errorf("Not permitted file extension was encountered.")
 }
 
+// CreateEepServiceKey makes new keys with the default SAM bridge
 func CreateEepServiceKey() (i2pkeys.I2PKeys, error) {
-	sam, err := sam3.NewSAM("127.0.0.1:7656")
+	return CreateKeys(i2pbridge.Default())
+}
+
+// CreateKeys asks the SAM bridge b to generate a new destination
+func CreateKeys(b *i2pbridge.Bridge) (i2pkeys.I2PKeys, error) {
+	sam, err := i2pbridge.NewSAM(b)
 	if err != nil {
 		return i2pkeys.I2PKeys{}, err
 	}
 	defer sam.Close()
-	k, err := sam.NewKeys()
-	if err != nil {
-		return i2pkeys.I2PKeys{}, err
-	}
-	return k, err
+	return sam.NewKeys()
 }
 
 func EepServiceMultiAddr() (*ma.Multiaddr, error) {
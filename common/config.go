@@ -0,0 +1,228 @@
+package i2phelpers
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/RTradeLtd/go-garlic-tcp-transport/bridge"
+)
+
+// ErrClientOnly is returned by Listen in client-only mode, where there's no
+// lasting destination to be reached at.
+var ErrClientOnly = errors.New("client-only mode can't listen, it dials from a transient destination nobody else knows")
+
+// Config is how a transport and the connections it makes reach the SAM bridge
+// and which keys they use. The transport hands its Config to every connection,
+// so they all end up on the same bridge with the same destination.
+type Config struct {
+	// SAMHost and SAMPort are kept normalized, see ParseSAMAddress
+	SAMHost string
+	SAMPort string
+	SAMUser string
+	SAMPass string
+	// SAMFallbacks are more bridges to fail over to, as normalized
+	// "host:port", in order of preference.
+	SAMFallbacks []string
+	// SAMTLS, if set, is used for every connection to every bridge, see
+	// SAMTLSConfig
+	SAMTLS *tls.Config
+
+	// KeysPath names the keys in the keys directory, see KeysFile
+	KeysPath string
+
+	OnlyGarlic bool
+	// ClientOnly only dials out, from a transient destination the bridge
+	// makes up for each session. No keys are stored and no lease set is
+	// published, so nothing can dial in and Listen fails with ErrClientOnly.
+	ClientOnly bool
+	// Isolation is which destination dials come from, see Isolation
+	Isolation Isolation
+	// Pool sets up the sessions IsolationPerPeer dials from
+	Pool PoolOptions
+	// Adaptive, if set, adds and drops tunnels with the load, see
+	// i2pbridge.Adaptive
+	Adaptive *i2pbridge.AdaptiveOptions
+	// Idle is what happens to the session once nobody's using it
+	Idle IdlePolicy
+	// Preset is the starting point for Tunnel and Streaming, whatever they
+	// set themselves wins
+	Preset Preset
+	// Tunnel are the typed I2CP options for the session's tunnels
+	Tunnel TunnelOptions
+	// Streaming are the typed streaming library options
+	Streaming StreamingOptions
+	// Primary makes the sessions PRIMARY ones on bridges that speak SAM
+	// 3.3, which dials with streaming options of their own need, see
+	// WithStreaming. Without it they're plain STREAM sessions.
+	Primary bool
+	// Options are raw I2CP and streaming options passed to SESSION CREATE
+	// after Tunnel's, for anything Tunnel doesn't cover
+	Options []string
+}
+
+// DefaultConfig is the local unauthenticated SAM bridge with no keys chosen
+func DefaultConfig() Config {
+	return Config{
+		SAMHost: DefaultSAMHost,
+		SAMPort: DefaultSAMPort,
+		Options: []string{},
+	}
+}
+
+// SetSAMAddress validates and sets the SAM bridge, keeping the current port if
+// s doesn't have one.
+func (c *Config) SetSAMAddress(s string) error {
+	host, port, err := ParseSAMAddress(s)
+	if err != nil {
+		return err
+	}
+	c.SAMHost = host
+	if port != "" {
+		c.SAMPort = port
+	}
+	return nil
+}
+
+// SetSAMPort validates and sets the SAM bridge's port
+func (c *Config) SetSAMPort(s string) error {
+	port, err := ParseSAMPort(s)
+	if err != nil {
+		return err
+	}
+	c.SAMPort = port
+	return nil
+}
+
+// SetSAMAddresses validates and sets a list of SAM bridges, most preferred
+// first. The first becomes the main bridge and the rest its fallbacks. Bridges
+// without a port get the current one.
+func (c *Config) SetSAMAddresses(addrs []string) error {
+	if len(addrs) == 0 {
+		return fmt.Errorf("no SAM addresses given")
+	}
+	if err := c.SetSAMAddress(addrs[0]); err != nil {
+		return err
+	}
+	c.SAMFallbacks = nil
+	seen := map[string]bool{c.SAMAddress(): true}
+	for _, a := range addrs[1:] {
+		host, port, err := ParseSAMAddress(a)
+		if err != nil {
+			return err
+		}
+		if port == "" {
+			port = c.SAMPort
+		}
+		addr := JoinSAMAddress(host, port)
+		if seen[addr] {
+			return fmt.Errorf("SAM bridge %s is listed twice", addr)
+		}
+		seen[addr] = true
+		c.SAMFallbacks = append(c.SAMFallbacks, addr)
+	}
+	return nil
+}
+
+// SAMAddress is the "host:port" of the SAM bridge
+func (c Config) SAMAddress() string {
+	return JoinSAMAddress(c.SAMHost, c.SAMPort)
+}
+
+// Bridge returns the SAM bridge with the configured credentials
+func (c Config) Bridge() *i2pbridge.Bridge {
+	return &i2pbridge.Bridge{
+		Address:  c.SAMAddress(),
+		User:     c.SAMUser,
+		Password: c.SAMPass,
+		TLS:      c.SAMTLS,
+	}
+}
+
+// Bridges returns the main SAM bridge followed by the fallbacks, all with the
+// configured credentials.
+func (c Config) Bridges() []*i2pbridge.Bridge {
+	bridges := []*i2pbridge.Bridge{c.Bridge()}
+	for _, a := range c.SAMFallbacks {
+		bridges = append(bridges, &i2pbridge.Bridge{
+			Address:  a,
+			User:     c.SAMUser,
+			Password: c.SAMPass,
+			TLS:      c.SAMTLS,
+		})
+	}
+	return bridges
+}
+
+// Check makes sure the configuration is usable, and picks a random keys path
+// if none was given.
+func (c *Config) Check() error {
+	if c.SAMPass != "" && c.SAMUser == "" {
+		return fmt.Errorf("SAMPass needs SAMUser, SAM authentication takes both")
+	}
+	if _, ok := isolationNames[c.Isolation]; !ok {
+		return fmt.Errorf("there's no isolation policy %s", c.Isolation)
+	}
+	if err := c.Pool.Validate(); err != nil {
+		return err
+	}
+	if c.Adaptive != nil {
+		if err := c.Adaptive.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.Idle.Validate(); err != nil {
+		return err
+	}
+	if _, err := c.SessionOptions(); err != nil {
+		return err
+	}
+	if c.KeysPath == "" {
+		c.KeysPath = "dht-" + RandTunName()
+	}
+	return nil
+}
+
+// SessionOptions are all the options passed to SESSION CREATE: the preset's
+// with the idle policy's and Tunnel and Streaming on top, then the raw
+// Options. Client-only mode adds i2cp.dontPublishLeaseSet=true. Keys set twice to
+// different values are an error.
+func (c Config) SessionOptions() ([]string, error) {
+	if _, ok := presetNames[c.Preset]; !ok {
+		return nil, fmt.Errorf("there's no preset %s", c.Preset)
+	}
+	t := c.Preset.Tunnel().Override(c.Idle.Tunnel()).Override(c.Tunnel)
+	if c.ClientOnly {
+		if t.DontPublishLeaseSet != nil && !*t.DontPublishLeaseSet {
+			return nil, fmt.Errorf("client-only mode doesn't publish a lease set, DontPublishLeaseSet can't be false")
+		}
+		t.DontPublishLeaseSet = Bool(true)
+	}
+	tunnel, err := t.SAMOptions()
+	if err != nil {
+		return nil, err
+	}
+	streaming, err := c.Preset.Streaming().Override(c.Streaming).SAMOptions()
+	if err != nil {
+		return nil, err
+	}
+	return MergeSAMOptions(tunnel, streaming, c.Options)
+}
+
+// Copy returns a Config that doesn't share its Options with c
+func (c Config) Copy() Config {
+	c.Options = append([]string{}, c.Options...)
+	c.Tunnel.Extra = append([]string(nil), c.Tunnel.Extra...)
+	c.Tunnel.LeaseSetEncTypes = append([]int(nil), c.Tunnel.LeaseSetEncTypes...)
+	c.Pool.Tunnel.Extra = append([]string(nil), c.Pool.Tunnel.Extra...)
+	c.Pool.Tunnel.LeaseSetEncTypes = append([]int(nil), c.Pool.Tunnel.LeaseSetEncTypes...)
+	c.SAMFallbacks = append([]string(nil), c.SAMFallbacks...)
+	if c.Adaptive != nil {
+		a := *c.Adaptive
+		c.Adaptive = &a
+	}
+	if c.Idle.ReduceQuantity != nil {
+		c.Idle.ReduceQuantity = Int(*c.Idle.ReduceQuantity)
+	}
+	return c
+}
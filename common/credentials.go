@@ -0,0 +1,43 @@
+package i2phelpers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	// EnvSAMUser is the environment variable SAM credentials are read from
+	EnvSAMUser = "I2P_SAM_USER"
+	// EnvSAMPassword is the environment variable holding the SAM password
+	EnvSAMPassword = "I2P_SAM_PASSWORD"
+)
+
+// SAMCredentialsFromFile reads SAM credentials from a file holding a single
+// "user:password" line. Like key files, it must only be readable by its owner.
+func SAMCredentialsFromFile(path string) (user, pass string, err error) {
+	if err := CheckPrivateFile(path); err != nil {
+		return "", "", err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	parts := strings.SplitN(strings.TrimRight(line, "\r"), ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("%s should contain user:password", path)
+	}
+	return parts[0], parts[1], nil
+}
+
+// SAMCredentialsFromEnv reads SAM credentials from $I2P_SAM_USER and
+// $I2P_SAM_PASSWORD.
+func SAMCredentialsFromEnv() (user, pass string, err error) {
+	user, pass = os.Getenv(EnvSAMUser), os.Getenv(EnvSAMPassword)
+	if user == "" || pass == "" {
+		return "", "", fmt.Errorf("$%s and $%s must both be set", EnvSAMUser, EnvSAMPassword)
+	}
+	return user, pass, nil
+}
@@ -0,0 +1,50 @@
+package i2phelpers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSAMCredentialsFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "samcreds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sam.creds")
+	if err := ioutil.WriteFile(path, []byte("alice:pa:ss\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := SAMCredentialsFromFile(path); err == nil {
+		t.Fatal("read credentials from a file others can read")
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	user, pass, err := SAMCredentialsFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "alice" || pass != "pa:ss" {
+		t.Errorf("got %q %q", user, pass)
+	}
+}
+
+func TestSAMCredentialsFromEnv(t *testing.T) {
+	defer os.Setenv(EnvSAMUser, os.Getenv(EnvSAMUser))
+	defer os.Setenv(EnvSAMPassword, os.Getenv(EnvSAMPassword))
+	os.Setenv(EnvSAMUser, "alice")
+	os.Setenv(EnvSAMPassword, "")
+	if _, _, err := SAMCredentialsFromEnv(); err == nil {
+		t.Error("accepted a user without a password")
+	}
+	os.Setenv(EnvSAMPassword, "secret")
+	if user, pass, err := SAMCredentialsFromEnv(); err != nil || user != "alice" || pass != "secret" {
+		t.Errorf("got %q %q %v", user, pass, err)
+	}
+}
@@ -0,0 +1,178 @@
+package i2phelpers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+
+	"github.com/RTradeLtd/go-garlic-tcp-transport/bridge"
+)
+
+const (
+	// EnvSAM and EnvSAMAddress can point discovery straight at a bridge
+	EnvSAM        = "I2P_SAM"
+	EnvSAMAddress = "SAM_ADDRESS"
+)
+
+// probeAddresses are where i2pd and Java I2P put SAM out of the box. Both use
+// 7656, but may only listen on one of the loopback addresses.
+var probeAddresses = []string{"127.0.0.1:7656", "[::1]:7656"}
+
+// i2pdConfigs lists the places i2pd's config file usually lives
+var i2pdConfigs = func() []string {
+	var paths []string
+	if home, err := homedir.Dir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".i2pd", "i2pd.conf"))
+	}
+	if appData := os.Getenv("APPDATA"); appData != "" {
+		paths = append(paths, filepath.Join(appData, "i2pd", "i2pd.conf"))
+	}
+	return append(paths,
+		"/var/lib/i2pd/i2pd.conf",
+		"/etc/i2pd/i2pd.conf",
+		"/usr/local/etc/i2pd/i2pd.conf",
+	)
+}
+
+// DiscoveryAttempt is one place discovery looked for a bridge
+type DiscoveryAttempt struct {
+	Address string
+	// Source says where the address came from, like "$I2P_SAM" or a config
+	// file
+	Source string
+	Err    error
+}
+
+// Discovery is the SAM bridge discovery found, and how it got there
+type Discovery struct {
+	Address string
+	Source  string
+	Version i2pbridge.Version
+	// Tried is every place that was looked at, in order, including the one
+	// that was picked
+	Tried []DiscoveryAttempt
+}
+
+// String says which bridge was picked and why
+func (d *Discovery) String() string {
+	return fmt.Sprintf("SAM %s bridge at %s, found via %s", d.Version, d.Address, d.Source)
+}
+
+// ErrNoSAMBridge is returned when discovery doesn't find a bridge anywhere
+var ErrNoSAMBridge = errors.New("no SAM bridge found")
+
+// DiscoverSAM looks for a SAM bridge: first wherever $I2P_SAM or $SAM_ADDRESS
+// say, then on the ports i2pd and Java I2P use by default, then wherever i2pd's
+// config file says. Each candidate has to answer HELLO, with user and pass if
+// they're given. If nothing does, the error lists everything that was tried and
+// what went wrong, including a SAM bridge switched off in i2pd's config.
+func DiscoverSAM(ctx context.Context, user, pass string) (*Discovery, error) {
+	d := &Discovery{}
+	try := func(addr, source string) bool {
+		host, port, err := ParseSAMAddress(addr)
+		if err == nil {
+			addr = JoinSAMAddress(host, port)
+			b := &i2pbridge.Bridge{Address: addr, User: user, Password: pass}
+			var c *i2pbridge.Conn
+			if c, err = b.DialContext(ctx); err == nil {
+				d.Address, d.Source, d.Version = addr, source, c.Version
+				c.Close()
+			}
+		}
+		d.Tried = append(d.Tried, DiscoveryAttempt{Address: addr, Source: source, Err: err})
+		return err == nil
+	}
+	for _, env := range []string{EnvSAM, EnvSAMAddress} {
+		if addr := os.Getenv(env); addr != "" && try(addr, "$"+env) {
+			return d, nil
+		}
+	}
+	for _, addr := range probeAddresses {
+		if try(addr, "default port") {
+			return d, nil
+		}
+	}
+	for _, path := range i2pdConfigs() {
+		addr, enabled, err := readI2PDConfig(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil && !enabled {
+			err = fmt.Errorf("SAM is disabled, set enabled = true in the [sam] section")
+		}
+		if err != nil {
+			d.Tried = append(d.Tried, DiscoveryAttempt{Address: addr, Source: path, Err: err})
+			continue
+		}
+		if try(addr, path) {
+			return d, nil
+		}
+	}
+	if ctx.Err() != nil {
+		return d, ctx.Err()
+	}
+	return d, d.failure()
+}
+
+// failure explains why nothing was found
+func (d *Discovery) failure() error {
+	if len(d.Tried) == 0 {
+		return ErrNoSAMBridge
+	}
+	var why []string
+	for _, a := range d.Tried {
+		why = append(why, fmt.Sprintf("%s (%s): %s", a.Address, a.Source, a.Err))
+	}
+	return fmt.Errorf("%w, tried %s", ErrNoSAMBridge, strings.Join(why, "; "))
+}
+
+// readI2PDConfig finds the SAM bridge in an i2pd.conf. Its settings can be in
+// a [sam] section or written as sam.address and so on, and SAM is on at
+// 127.0.0.1:7656 unless it says otherwise.
+func readI2PDConfig(path string) (addr string, enabled bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	host, port, enabled := DefaultSAMHost, DefaultSAMPort, true
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		value := strings.TrimSpace(kv[1])
+		if section != "" {
+			key = section + "." + key
+		}
+		switch key {
+		case "sam.enabled":
+			enabled = strings.EqualFold(value, "true")
+		case "sam.address":
+			host = value
+		case "sam.port":
+			port = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", false, err
+	}
+	return JoinSAMAddress(host, port), enabled, nil
+}
@@ -0,0 +1,145 @@
+package i2phelpers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// helloServer answers HELLO like a SAM 3.1 bridge
+func helloServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if _, err := bufio.NewReader(c).ReadString('\n'); err == nil {
+					c.Write([]byte("HELLO REPLY RESULT=OK VERSION=3.1\n"))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// deadAddress is somewhere nothing is listening
+func deadAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// isolateDiscovery points discovery at the given probes and config files only
+func isolateDiscovery(t *testing.T, probes, configs []string) {
+	t.Helper()
+	oldProbes, oldConfigs := probeAddresses, i2pdConfigs
+	probeAddresses = probes
+	i2pdConfigs = func() []string { return configs }
+	for _, env := range []string{EnvSAM, EnvSAMAddress} {
+		old, ok := os.LookupEnv(env)
+		os.Unsetenv(env)
+		env := env
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(env, old)
+			}
+		})
+	}
+	t.Cleanup(func() {
+		probeAddresses, i2pdConfigs = oldProbes, oldConfigs
+	})
+}
+
+func writeI2PDConfig(t *testing.T, conf string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "i2pd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "i2pd.conf")
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDiscoverSAMFromEnv(t *testing.T) {
+	live := helloServer(t)
+	isolateDiscovery(t, []string{deadAddress(t)}, nil)
+	os.Setenv(EnvSAMAddress, live)
+	d, err := DiscoverSAM(context.Background(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Address != live || d.Source != "$"+EnvSAMAddress {
+		t.Errorf("found %s", d)
+	}
+	if d.Version.String() != "3.1" {
+		t.Errorf("version %s", d.Version)
+	}
+}
+
+func TestDiscoverSAMProbes(t *testing.T) {
+	dead, live := deadAddress(t), helloServer(t)
+	isolateDiscovery(t, []string{dead, live}, nil)
+	os.Setenv(EnvSAM, deadAddress(t))
+	d, err := DiscoverSAM(context.Background(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Address != live || d.Source != "default port" {
+		t.Errorf("found %s", d)
+	}
+	if len(d.Tried) != 3 || d.Tried[0].Err == nil || d.Tried[1].Err == nil || d.Tried[2].Err != nil {
+		t.Errorf("tried %+v", d.Tried)
+	}
+}
+
+func TestDiscoverSAMFromI2PDConfig(t *testing.T) {
+	live := helloServer(t)
+	host, port, _ := net.SplitHostPort(live)
+	path := writeI2PDConfig(t, "# i2pd\nlog = stdout\n\n[sam]\nenabled = true\naddress = "+host+"\nport = "+port+"\n\n[bob]\nport = 2827\n")
+	isolateDiscovery(t, []string{deadAddress(t)}, []string{filepath.Join(filepath.Dir(path), "missing.conf"), path})
+	d, err := DiscoverSAM(context.Background(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Address != live || d.Source != path {
+		t.Errorf("found %s", d)
+	}
+}
+
+func TestDiscoverSAMDisabled(t *testing.T) {
+	path := writeI2PDConfig(t, "sam.enabled = false\n")
+	isolateDiscovery(t, []string{deadAddress(t)}, []string{path})
+	_, err := DiscoverSAM(context.Background(), "", "")
+	if !errors.Is(err, ErrNoSAMBridge) {
+		t.Fatalf("got %v, want ErrNoSAMBridge", err)
+	}
+	for _, want := range []string{"refused", path, "enabled = true"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q doesn't mention %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package i2phelpers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RTradeLtd/go-garlic-tcp-transport/bridge"
+)
+
+// IdleMode is what an IdlePolicy does once the session has been idle long
+// enough
+type IdleMode int
+
+const (
+	// IdleClose closes the SAM session, tunnels and all, and makes a new one
+	// on the next dial
+	IdleClose IdleMode = iota
+	// IdleReduce leaves it to the router, which drops to fewer tunnels with
+	// i2cp.reduceOnIdle and builds them back up when there's traffic again
+	IdleReduce
+)
+
+var idleModeNames = map[IdleMode]string{
+	IdleClose:  "close",
+	IdleReduce: "reduce",
+}
+
+func (m IdleMode) String() string {
+	if name, ok := idleModeNames[m]; ok {
+		return name
+	}
+	return "IdleMode(" + strconv.Itoa(int(m)) + ")"
+}
+
+// ParseIdleMode reads an idle mode by name, "close" or "reduce"
+func ParseIdleMode(s string) (IdleMode, error) {
+	for m, name := range idleModeNames {
+		if strings.EqualFold(s, name) {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("there's no idle mode %q", s)
+}
+
+// IdlePolicy is what happens to a session nobody's using. Idle tunnels cost
+// the router bandwidth, and a node whose tunnels come and go with its use is
+// harder to watch than one that's always up. i2cp.closeOnIdle isn't offered,
+// the supervisor would take the closed session for a lost one and rebuild it
+// straight away.
+type IdlePolicy struct {
+	// After is how long the session goes without streams before Mode kicks
+	// in, 0 never does. IdleReduce needs at least 5 minutes.
+	After time.Duration
+	Mode  IdleMode
+	// ReduceQuantity is how many tunnels IdleReduce keeps, the router's
+	// default if nil
+	ReduceQuantity *int
+	// KeepListening keeps the session up while something's listening on it,
+	// for nodes that have to stay reachable. Without it an IdleClose
+	// session is closed under its listeners, who wait for the next dial to
+	// bring it back, so listener-only nodes want it.
+	KeepListening bool
+}
+
+// Validate checks the policy makes sense
+func (p IdlePolicy) Validate() error {
+	var problems []string
+	if _, ok := idleModeNames[p.Mode]; !ok {
+		problems = append(problems, fmt.Sprintf("there's no idle mode %s", p.Mode))
+	}
+	if p.After < 0 {
+		problems = append(problems, "After can't be negative")
+	}
+	if p.Mode == IdleReduce {
+		if p.After != 0 && p.After < minIdleTime {
+			problems = append(problems, fmt.Sprintf("After is %s, reducing tunnels needs at least %s", p.After, minIdleTime))
+		}
+	} else if p.ReduceQuantity != nil {
+		problems = append(problems, "ReduceQuantity only goes with IdleReduce")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid idle policy: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Tunnel are the I2CP options IdleReduce needs, nothing for IdleClose
+func (p IdlePolicy) Tunnel() TunnelOptions {
+	if p.After == 0 || p.Mode != IdleReduce {
+		return TunnelOptions{}
+	}
+	return TunnelOptions{
+		ReduceOnIdle:   Bool(true),
+		ReduceIdleTime: p.After,
+		ReduceQuantity: p.ReduceQuantity,
+	}
+}
+
+// Supervise sets s up to close its session under IdleClose
+func (p IdlePolicy) Supervise(s *i2pbridge.Supervisor) {
+	if p.Mode != IdleClose {
+		return
+	}
+	s.IdleTimeout = p.After
+	s.ListenersKeepAlive = p.KeepListening
+}
@@ -0,0 +1,50 @@
+package i2phelpers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/go-garlic-tcp-transport/bridge"
+)
+
+func TestIdlePolicy(t *testing.T) {
+	c := DefaultConfig()
+	c.Idle = IdlePolicy{After: 10 * time.Minute, Mode: IdleReduce, ReduceQuantity: Int(1)}
+	opts, err := c.SessionOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := ParseSAMOptions(opts)
+	if m["i2cp.reduceOnIdle"] != "true" || m["i2cp.reduceIdleTime"] != "600000" || m["i2cp.reduceQuantity"] != "1" {
+		t.Errorf("options %v", opts)
+	}
+
+	c.Idle = IdlePolicy{After: time.Minute, Mode: IdleClose}
+	if opts, _ := c.SessionOptions(); len(opts) != 0 {
+		t.Errorf("closing on idle set options %v", opts)
+	}
+	s := i2pbridge.NewSupervisor(c.Bridges(), i2pbridge.Transient, nil)
+	c.Idle.Supervise(s)
+	if s.IdleTimeout != time.Minute || s.ListenersKeepAlive {
+		t.Errorf("idle timeout %s, listeners keep it %t", s.IdleTimeout, s.ListenersKeepAlive)
+	}
+	c.Idle.KeepListening = true
+	c.Idle.Supervise(s)
+	if !s.ListenersKeepAlive {
+		t.Error("KeepListening didn't keep the session for listeners")
+	}
+
+	for _, p := range []IdlePolicy{
+		{After: time.Minute, Mode: IdleReduce},
+		{After: time.Minute, ReduceQuantity: Int(1)},
+		{After: -time.Minute},
+		{Mode: IdleMode(7)},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("%+v passed", p)
+		}
+	}
+	if m, err := ParseIdleMode("Reduce"); err != nil || m != IdleReduce {
+		t.Errorf("got %s, %v", m, err)
+	}
+}
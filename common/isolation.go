@@ -0,0 +1,63 @@
+package i2phelpers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Isolation is which destination outbound streams come from, and so how much
+// the peers we dial can tell about us from it.
+type Isolation int
+
+const (
+	// IsolationShared dials from the destination we listen on, so every
+	// peer sees the same one
+	IsolationShared Isolation = iota
+	// IsolationSeparate dials from a second, transient destination shared
+	// by all dials, so peers can't tie our dials to the address we publish
+	IsolationSeparate
+	// IsolationPerPeer gives each peer a transient destination of its own,
+	// so peers can't tie our dials to each other either
+	IsolationPerPeer
+)
+
+var isolationNames = map[Isolation]string{
+	IsolationShared:   "shared",
+	IsolationSeparate: "separate",
+	IsolationPerPeer:  "per-peer",
+}
+
+func (i Isolation) String() string {
+	if name, ok := isolationNames[i]; ok {
+		return name
+	}
+	return "Isolation(" + strconv.Itoa(int(i)) + ")"
+}
+
+// ParseIsolation finds an isolation policy by the name String gives it
+func ParseIsolation(name string) (Isolation, error) {
+	for i, n := range isolationNames {
+		if strings.EqualFold(name, n) {
+			return i, nil
+		}
+	}
+	return IsolationShared, fmt.Errorf("unknown isolation policy %q", name)
+}
+
+// IsolatedOptions are the options for sessions that only ever dial, under an
+// Isolation other than IsolationShared: the session's own, except that they
+// never publish a lease set.
+func (c Config) IsolatedOptions() ([]string, error) {
+	c = c.Copy()
+	c.ClientOnly = false
+	c.Tunnel.DontPublishLeaseSet = Bool(true)
+	var opts []string
+	for _, o := range c.Options {
+		if !strings.HasPrefix(o, "i2cp.dontPublishLeaseSet=") {
+			opts = append(opts, o)
+		}
+	}
+	c.Options = opts
+	return c.SessionOptions()
+}
@@ -0,0 +1,106 @@
+package i2phelpers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeysFile resolves a keys path, as passed to LoadKeys, to the file it names
+// in the keys directory.
+func KeysFile(keysPath string) (string, error) {
+	title := filepath.Base(keysPath)
+	return Path(title, strings.ToLower(filepath.Ext(title)))
+}
+
+// CheckPrivateFile refuses a file of secrets, like keys or SAM credentials,
+// that anybody but its owner can get at.
+func CheckPrivateFile(realPath string) error {
+	fi, err := os.Stat(realPath)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", realPath)
+	}
+	return checkKeysPermissions(realPath, fi)
+}
+
+// writeKeysFile stores data at realPath with owner-only permissions. It is
+// written to a temporary file in the same directory and renamed into
+// place, so a failure part way through never leaves a truncated key file.
+func writeKeysFile(realPath string, data []byte) error {
+	dir := filepath.Dir(realPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, "."+filepath.Base(realPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	fail := func(err error) error {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Chmod(0600); err != nil {
+		return fail(err)
+	}
+	if _, err := file.Write(data); err != nil {
+		return fail(err)
+	}
+	if err := file.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, realPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// KeysLock is an advisory lock on a key file. Only one transport, in this
+// process or any other, can hold the lock for a given set of keys.
+type KeysLock struct {
+	path string
+	file *os.File
+}
+
+// LockKeys takes the lock for the keys named by keysPath, it fails straight
+// away if somebody else has it. The lock lives in a ".lock" file next to the
+// keys and is released when the process exits, even if Unlock is never called.
+func LockKeys(keysPath string) (*KeysLock, error) {
+	realPath, err := KeysFile(keysPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(realPath), 0700); err != nil {
+		return nil, err
+	}
+	lockPath := realPath + ".lock"
+	file, err := lockFile(lockPath)
+	if err != nil {
+		return nil, fmt.Errorf("keys %s are in use by another transport: %s", realPath, err)
+	}
+	return &KeysLock{path: lockPath, file: file}, nil
+}
+
+// Unlock releases the lock, it's safe to call more than once.
+func (l *KeysLock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	err := unlockFile(l.file)
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	l.file = nil
+	return err
+}
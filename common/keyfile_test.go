@@ -0,0 +1,91 @@
+package i2phelpers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func tempKeysDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "i2pkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Getenv(EnvDir)
+	os.Setenv(EnvDir, dir)
+	return func() {
+		os.Setenv(EnvDir, old)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestKeysFileWrittenPrivately(t *testing.T) {
+	defer tempKeysDir(t)()
+	keys := generateKeys(t, EdDSA_SHA512_Ed25519)
+	realPath, err := KeysFile("hardened.i2pkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteKeysFile(realPath, keys, KeysFormatIncompat); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(realPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0600 {
+		t.Fatalf("keys written with mode %#o", fi.Mode().Perm())
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(realPath), ".*.tmp*"))
+	if len(leftovers) != 0 {
+		t.Fatalf("temporary files left behind: %v", leftovers)
+	}
+	loaded, err := LoadKeys("hardened.i2pkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.String() != keys.String() || loaded.Addr() != keys.Addr() {
+		t.Fatal("loaded keys don't match the stored ones")
+	}
+}
+
+func TestLoadKeysRefusesReadableFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not meaningful on windows")
+	}
+	defer tempKeysDir(t)()
+	realPath, _ := KeysFile("shared.i2pkeys")
+	if err := WriteKeysFile(realPath, generateKeys(t, EdDSA_SHA512_Ed25519), KeysFormatIncompat); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(realPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeys("shared.i2pkeys"); err == nil {
+		t.Fatal("expected world-readable keys to be refused")
+	}
+}
+
+func TestLockKeys(t *testing.T) {
+	defer tempKeysDir(t)()
+	l, err := LockKeys("locked.i2pkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockKeys("locked.i2pkeys"); err == nil {
+		t.Fatal("keys were locked twice")
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = LockKeys("locked.i2pkeys")
+	if err != nil {
+		t.Fatalf("couldn't relock released keys: %s", err)
+	}
+	l.Unlock()
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package i2phelpers
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func checkKeysPermissions(realPath string, fi os.FileInfo) error {
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("%s is accessible by group or others (mode %#o), it should be 0600", realPath, perm)
+	}
+	return nil
+}
+
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,33 @@
+//go:build windows
+// +build windows
+
+package i2phelpers
+
+import (
+	"os"
+	"syscall"
+)
+
+// Windows uses ACLs rather than mode bits, the inherited ACL of the keys
+// directory is all we have to go on.
+func checkKeysPermissions(realPath string, fi os.FileInfo) error {
+	return nil
+}
+
+// lockFile opens path with no sharing allowed, so any other open of the lock
+// file fails until our handle is closed.
+func lockFile(path string) (*os.File, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(p, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
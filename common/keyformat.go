@@ -0,0 +1,180 @@
+package i2phelpers
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/eyedeekay/sam3/i2pkeys"
+)
+
+// KeysFormat is one of the ways a destination's private keys can be stored on
+// disk.
+type KeysFormat int
+
+const (
+	// KeysFormatIncompat is sam3's two line format, the base64 destination
+	// followed by the base64 private keys.
+	KeysFormatIncompat KeysFormat = iota
+	// KeysFormatBinary is the raw private key file Java I2P (privKeyFile,
+	// eepPriv.dat) and i2pd (keys.dat) write.
+	KeysFormatBinary
+	// KeysFormatBase64 is the private keys alone, base64 encoded on one line
+	// like SAM's DEST GENERATE returns them.
+	KeysFormatBase64
+)
+
+func (f KeysFormat) String() string {
+	switch f {
+	case KeysFormatIncompat:
+		return "incompat"
+	case KeysFormatBinary:
+		return "binary"
+	case KeysFormatBase64:
+		return "base64"
+	}
+	return fmt.Sprintf("KeysFormat(%d)", int(f))
+}
+
+// formatForExtension picks the format new keys are written in. ".dat" files are
+// the binary format everywhere else in I2P, so we write them that way too.
+func formatForExtension(extension string) KeysFormat {
+	if extension == ".dat" {
+		return KeysFormatBinary
+	}
+	return KeysFormatIncompat
+}
+
+// keysFromBinary checks that b is a complete private key blob and wraps it up
+// as I2PKeys.
+func keysFromBinary(b []byte) (i2pkeys.I2PKeys, error) {
+	d, _, err := parsePrivateKeys(b)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, err
+	}
+	addr := i2pkeys.I2PAddr(I2PEncoding.EncodeToString(b[:d.Len]))
+	return i2pkeys.NewKeys(addr, I2PEncoding.EncodeToString(b)), nil
+}
+
+// DecodeKeys works out which format data is in and reads the keys out of it.
+func DecodeKeys(data []byte) (i2pkeys.I2PKeys, KeysFormat, error) {
+	text := strings.TrimSpace(string(data))
+	lines := strings.Fields(text)
+	if len(lines) == 2 {
+		pub, perr := I2PEncoding.DecodeString(lines[0])
+		priv, err := I2PEncoding.DecodeString(lines[1])
+		if perr == nil && err == nil {
+			if _, err := keysFromBinary(priv); err != nil {
+				return i2pkeys.I2PKeys{}, KeysFormatIncompat, err
+			}
+			if !bytes.HasPrefix(priv, pub) {
+				return i2pkeys.I2PKeys{}, KeysFormatIncompat, fmt.Errorf("destination doesn't match the private keys")
+			}
+			return i2pkeys.NewKeys(i2pkeys.I2PAddr(lines[0]), lines[1]), KeysFormatIncompat, nil
+		}
+	}
+	if len(lines) == 1 {
+		if priv, err := I2PEncoding.DecodeString(lines[0]); err == nil {
+			keys, err := keysFromBinary(priv)
+			if err != nil {
+				return i2pkeys.I2PKeys{}, KeysFormatBase64, err
+			}
+			return i2pkeys.NewKeys(keys.Addr(), lines[0]), KeysFormatBase64, nil
+		}
+	}
+	keys, err := keysFromBinary(data)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, KeysFormatBinary, fmt.Errorf("not a private key file in any known format: %s", err)
+	}
+	return keys, KeysFormatBinary, nil
+}
+
+// EncodeKeys serializes keys in the given format
+func EncodeKeys(keys i2pkeys.I2PKeys, format KeysFormat) ([]byte, error) {
+	switch format {
+	case KeysFormatIncompat:
+		var buf bytes.Buffer
+		if err := i2pkeys.StoreKeysIncompat(keys, &buf); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case KeysFormatBinary:
+		return I2PEncoding.DecodeString(keys.String())
+	case KeysFormatBase64:
+		return []byte(keys.String() + "\n"), nil
+	}
+	return nil, fmt.Errorf("unknown keys format %s", format)
+}
+
+// ReadKeysFile reads keys from any file, in any format we know about, and says
+// which format it found.
+func ReadKeysFile(path string) (i2pkeys.I2PKeys, KeysFormat, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, KeysFormatIncompat, err
+	}
+	keys, format, err := DecodeKeys(data)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, format, fmt.Errorf("%s: %s", path, err)
+	}
+	return keys, format, nil
+}
+
+// WriteKeysFile writes keys to path in the given format, atomically and with
+// owner-only permissions.
+func WriteKeysFile(path string, keys i2pkeys.I2PKeys, format KeysFormat) error {
+	data, err := EncodeKeys(keys, format)
+	if err != nil {
+		return err
+	}
+	return writeKeysFile(path, data)
+}
+
+// ImportKeys copies the keys of an existing destination, such as an eepsite's
+// privKeyFile or an i2pd keys.dat, into the keys directory under keysPath. The
+// transport can then be started with KeysPath(keysPath) to reuse that
+// destination as its garlic address.
+func ImportKeys(srcPath, keysPath string) (i2pkeys.I2PKeys, error) {
+	keys, _, err := ReadKeysFile(srcPath)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, err
+	}
+	realPath, err := KeysFile(keysPath)
+	if err != nil {
+		return i2pkeys.I2PKeys{}, err
+	}
+	extension := strings.ToLower(filepath.Ext(realPath))
+	if !isValidExtension(extension) {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("keys path %s must end in .i2pkeys or .dat", keysPath)
+	}
+	if err := WriteKeysFile(realPath, keys, formatForExtension(extension)); err != nil {
+		return i2pkeys.I2PKeys{}, err
+	}
+	return keys, nil
+}
+
+// ExportKeys writes the keys stored under keysPath to dstPath in another
+// format, for instance to hand a libp2p destination to an I2P router.
+func ExportKeys(keysPath, dstPath string, format KeysFormat) error {
+	realPath, err := KeysFile(keysPath)
+	if err != nil {
+		return err
+	}
+	keys, err := readStoredKeys(realPath)
+	if err != nil {
+		return err
+	}
+	return WriteKeysFile(dstPath, keys, format)
+}
+
+// readStoredKeys loads keys from the keys directory, whatever format they are
+// in, as long as nobody else could have read them.
+func readStoredKeys(realPath string) (i2pkeys.I2PKeys, error) {
+	if err := CheckPrivateFile(realPath); err != nil {
+		return i2pkeys.I2PKeys{}, err
+	}
+	keys, _, err := ReadKeysFile(realPath)
+	return keys, err
+}
@@ -0,0 +1,98 @@
+package i2phelpers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeysFormatsRoundTrip(t *testing.T) {
+	for _, st := range []SignatureType{DSA_SHA1, ECDSA_SHA512_P521, EdDSA_SHA512_Ed25519} {
+		keys := generateKeys(t, st)
+		for _, format := range []KeysFormat{KeysFormatIncompat, KeysFormatBinary, KeysFormatBase64} {
+			data, err := EncodeKeys(keys, format)
+			if err != nil {
+				t.Fatalf("%s/%s: %s", st, format, err)
+			}
+			decoded, found, err := DecodeKeys(data)
+			if err != nil {
+				t.Fatalf("%s/%s: %s", st, format, err)
+			}
+			if found != format {
+				t.Errorf("%s: %s keys detected as %s", st, format, found)
+			}
+			if decoded.Addr() != keys.Addr() || decoded.String() != keys.String() {
+				t.Errorf("%s/%s: keys changed in a round trip", st, format)
+			}
+		}
+	}
+}
+
+func TestDecodeKeysRejectsGarbage(t *testing.T) {
+	keys := generateKeys(t, EdDSA_SHA512_Ed25519)
+	other := generateKeys(t, EdDSA_SHA512_Ed25519)
+	for name, data := range map[string][]byte{
+		"empty":     {},
+		"text":      []byte("hello world"),
+		"truncated": []byte(keys.String()[:600]),
+		"mismatch":  []byte(other.Addr().Base64() + "\n" + keys.String()),
+	} {
+		if _, _, err := DecodeKeys(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// An eepsite's binary private key file can be imported and then loaded by name
+// like any other keys in the keys directory.
+func TestImportEepsiteKeys(t *testing.T) {
+	defer tempKeysDir(t)()
+	src, err := ioutil.TempDir("", "eepsite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	keys := generateKeys(t, EdDSA_SHA512_Ed25519)
+	privKeyFile := filepath.Join(src, "eepPriv.dat")
+	if err := WriteKeysFile(privKeyFile, keys, KeysFormatBinary); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportKeys(privKeyFile, "eepsite.i2pkeys"); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadKeys("eepsite.i2pkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Addr() != keys.Addr() || loaded.String() != keys.String() {
+		t.Fatal("imported keys don't match the eepsite's")
+	}
+	out := filepath.Join(src, "keys.dat")
+	if err := ExportKeys("eepsite.i2pkeys", out, KeysFormatBinary); err != nil {
+		t.Fatal(err)
+	}
+	exported, format, err := ReadKeysFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != KeysFormatBinary || exported.String() != keys.String() {
+		t.Fatal("exported keys don't match")
+	}
+}
+
+func TestLoadBinaryDatKeys(t *testing.T) {
+	defer tempKeysDir(t)()
+	keys := generateKeys(t, ECDSA_SHA256_P256)
+	realPath, _ := KeysFile("router.dat")
+	if err := WriteKeysFile(realPath, keys, KeysFormatBinary); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadKeys("router.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Addr() != keys.Addr() {
+		t.Fatal("binary keys loaded with the wrong destination")
+	}
+}
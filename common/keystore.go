@@ -0,0 +1,195 @@
+package i2phelpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eyedeekay/sam3/i2pkeys"
+)
+
+// metaSuffix is appended to a key file's name to get its metadata sidecar
+const metaSuffix = ".json"
+
+// touchInterval is how stale LastUsed may get before we bother rewriting it
+const touchInterval = time.Minute
+
+// KeyInfo is what we know about a set of keys in the keys directory. It is
+// kept in a JSON sidecar next to the key file, so it can be listed without
+// reading any private keys.
+type KeyInfo struct {
+	// Name is the keys path to pass to KeysPath to use these keys
+	Name           string    `json:"-"`
+	Path           string    `json:"-"`
+	Created        time.Time `json:"created"`
+	LastUsed       time.Time `json:"last_used"`
+	SignatureType  string    `json:"signature_type"`
+	EncryptionType uint16    `json:"encryption_type"`
+	Base32         string    `json:"b32"`
+	PeerID         string    `json:"peer_id,omitempty"`
+}
+
+func metaPath(realPath string) string {
+	return realPath + metaSuffix
+}
+
+// newKeyInfo describes keys that don't have any metadata yet
+func newKeyInfo(realPath string, keys i2pkeys.I2PKeys, created time.Time) *KeyInfo {
+	info := &KeyInfo{
+		Name:    filepath.Base(realPath),
+		Path:    realPath,
+		Created: created,
+		Base32:  keys.Addr().Base32(),
+	}
+	if d, err := DestinationFromAddr(keys.Addr()); err == nil {
+		info.SignatureType = d.SignatureType.String()
+		info.EncryptionType = d.CryptoType
+	}
+	return info
+}
+
+func readKeyInfo(realPath string) (*KeyInfo, error) {
+	data, err := ioutil.ReadFile(metaPath(realPath))
+	if err != nil {
+		return nil, err
+	}
+	var info KeyInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("%s: %s", metaPath(realPath), err)
+	}
+	info.Name = filepath.Base(realPath)
+	info.Path = realPath
+	return &info, nil
+}
+
+func writeKeyInfo(info *KeyInfo) error {
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeKeysFile(metaPath(info.Path), data)
+}
+
+// keyInfoFor returns the metadata of the keys at realPath, working it out from
+// the key file itself if there's no sidecar yet.
+func keyInfoFor(realPath string) (*KeyInfo, error) {
+	info, err := readKeyInfo(realPath)
+	if err == nil {
+		return info, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	fi, err := os.Stat(realPath)
+	if err != nil {
+		return nil, err
+	}
+	keys, _, err := ReadKeysFile(realPath)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyInfo(realPath, keys, fi.ModTime()), nil
+}
+
+// KeysInfo returns the metadata of the keys named by keysPath
+func KeysInfo(keysPath string) (*KeyInfo, error) {
+	realPath, err := KeysFile(keysPath)
+	if err != nil {
+		return nil, err
+	}
+	return keyInfoFor(realPath)
+}
+
+// TouchKeys records that the keys named by keysPath are in use, and by which
+// peer if peerID isn't empty.
+func TouchKeys(keysPath, peerID string) error {
+	realPath, err := KeysFile(keysPath)
+	if err != nil {
+		return err
+	}
+	info, err := keyInfoFor(realPath)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Sub(info.LastUsed) < touchInterval && (peerID == "" || peerID == info.PeerID) {
+		return nil
+	}
+	info.LastUsed = now
+	if peerID != "" {
+		info.PeerID = peerID
+	}
+	return writeKeyInfo(info)
+}
+
+// isKeysCandidate says whether a file in the keys directory might hold keys.
+// The directory is shared with the rest of the node's configuration, so only
+// names we'd have chosen, or that have metadata, are considered.
+func isKeysCandidate(dir, name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, metaSuffix) || strings.HasSuffix(name, ".lock") {
+		return false
+	}
+	if strings.HasPrefix(name, "dht-") || isValidExtension(strings.ToLower(filepath.Ext(name))) {
+		return true
+	}
+	_, err := os.Stat(metaPath(filepath.Join(dir, name)))
+	return err == nil
+}
+
+// ListKeys enumerates the keys in the keys directory, oldest first. Files that
+// look like keys but can't be read are skipped.
+func ListKeys() ([]*KeyInfo, error) {
+	dir, err := PathRoot()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var infos []*KeyInfo
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || !isKeysCandidate(dir, e.Name()) {
+			continue
+		}
+		info, err := keyInfoFor(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Created.Before(infos[j].Created)
+	})
+	return infos, nil
+}
+
+// DeleteKeys removes the keys named by keysPath along with their metadata. It
+// fails if a transport is using them. The lock file stays: removing it would
+// let two transports each lock a file by that name at once.
+func DeleteKeys(keysPath string) error {
+	lock, err := LockKeys(keysPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	realPath, err := KeysFile(keysPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(realPath); err != nil {
+		return err
+	}
+	if err := os.Remove(metaPath(realPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package i2phelpers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListKeys(t *testing.T) {
+	defer tempKeysDir(t)()
+	keys := generateKeys(t, EdDSA_SHA512_Ed25519)
+	realPath, _ := KeysFile("node.i2pkeys")
+	if err := WriteKeysFile(realPath, keys, KeysFormatIncompat); err != nil {
+		t.Fatal(err)
+	}
+	// not keys, and shouldn't be listed
+	dir, _ := PathRoot()
+	if err := writeKeysFile(filepath.Join(dir, "config"), []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := TouchKeys("node.i2pkeys", "QmPeer"); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("listed %d keys, want 1", len(infos))
+	}
+	info := infos[0]
+	if info.Name != "node.i2pkeys" || info.Base32 != keys.Addr().Base32() {
+		t.Errorf("unexpected key info %+v", info)
+	}
+	if info.SignatureType != "EdDSA_SHA512_Ed25519" || info.PeerID != "QmPeer" {
+		t.Errorf("unexpected key info %+v", info)
+	}
+	if info.LastUsed.IsZero() || info.Created.IsZero() {
+		t.Errorf("timestamps not recorded %+v", info)
+	}
+}
+
+func TestDeleteKeys(t *testing.T) {
+	defer tempKeysDir(t)()
+	realPath, _ := KeysFile("old.i2pkeys")
+	if err := WriteKeysFile(realPath, generateKeys(t, EdDSA_SHA512_Ed25519), KeysFormatIncompat); err != nil {
+		t.Fatal(err)
+	}
+	if err := TouchKeys("old.i2pkeys", ""); err != nil {
+		t.Fatal(err)
+	}
+	l, err := LockKeys("old.i2pkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteKeys("old.i2pkeys"); err == nil {
+		t.Fatal("deleted keys that are in use")
+	}
+	l.Unlock()
+	if err := DeleteKeys("old.i2pkeys"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(realPath); !os.IsNotExist(err) {
+		t.Fatal("key file still there")
+	}
+	if _, err := os.Stat(metaPath(realPath)); !os.IsNotExist(err) {
+		t.Fatal("metadata still there")
+	}
+	// the lock is left for whoever might be waiting on it
+	if _, err := os.Stat(realPath + ".lock"); err != nil {
+		t.Fatal("lock file removed")
+	}
+	l, err = LockKeys("old.i2pkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Unlock()
+}
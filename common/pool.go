@@ -0,0 +1,89 @@
+package i2phelpers
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// DefaultPoolSize is how many sessions IsolationPerPeer keeps built
+	// ahead of time
+	DefaultPoolSize = 2
+	// DefaultMaxIsolated is how many peers IsolationPerPeer dials from
+	// sessions of their own at once
+	DefaultMaxIsolated = 32
+)
+
+// PoolOptions set up the pool of transient sessions IsolationPerPeer takes a
+// session from for each new peer
+type PoolOptions struct {
+	// Size is how many sessions are kept ready, DefaultPoolSize if 0
+	Size int
+	// MaxPeers is how many peers get sessions of their own at once,
+	// DefaultMaxIsolated if 0
+	MaxPeers int
+	// Tunnel are tunnel options for the pool's sessions, on top of the
+	// transport's own. Shorter or fewer tunnels make sense here, as each
+	// session only carries streams to one peer.
+	Tunnel TunnelOptions
+}
+
+// Validate checks the sizes and tunnel options
+func (o PoolOptions) Validate() error {
+	var problems []string
+	if o.Size < 0 {
+		problems = append(problems, "Size can't be negative")
+	}
+	if o.MaxPeers < 0 {
+		problems = append(problems, "MaxPeers can't be negative")
+	}
+	if err := o.Tunnel.Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid session pool options: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// PoolSize is the pool's size, defaults filled in
+func (o PoolOptions) PoolSize() int {
+	if o.Size == 0 {
+		return DefaultPoolSize
+	}
+	return o.Size
+}
+
+// Peers is how many peers get sessions of their own at once, defaults filled
+// in
+func (o PoolOptions) Peers() int {
+	if o.MaxPeers == 0 {
+		return DefaultMaxIsolated
+	}
+	return o.MaxPeers
+}
+
+// PoolSessionOptions are the options the pool's sessions are made with: the
+// IsolatedOptions, with Pool.Tunnel on top.
+func (c Config) PoolSessionOptions() ([]string, error) {
+	c = c.Copy()
+	c.Tunnel = c.Tunnel.Override(c.Pool.Tunnel)
+	// Pool.Tunnel is meant to win over what the preset or raw options say
+	// too, so drop raw options it sets
+	set, err := c.Pool.Tunnel.SAMOptions()
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	for _, o := range set {
+		keys[strings.SplitN(o, "=", 2)[0]] = true
+	}
+	var opts []string
+	for _, o := range c.Options {
+		if !keys[strings.SplitN(o, "=", 2)[0]] {
+			opts = append(opts, o)
+		}
+	}
+	c.Options = opts
+	return c.IsolatedOptions()
+}
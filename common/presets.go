@@ -0,0 +1,93 @@
+package i2phelpers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Preset is a named trade off between anonymity and performance, setting
+// tunnel lengths, quantities, variance and the streaming profile together.
+// Anything set in Config.Tunnel or Config.Streaming takes precedence over the
+// preset, so it can be used as a starting point.
+type Preset int
+
+const (
+	// NoPreset leaves everything to the router's defaults
+	NoPreset Preset = iota
+	// HighAnonymity uses 3 hop tunnels plus up to 1 more at random, with
+	// spares, for when who we talk to matters more than how fast.
+	HighAnonymity
+	// Balanced uses 2 hop tunnels, fine for most nodes
+	Balanced
+	// LowLatency uses 1 hop tunnels and the interactive streaming profile,
+	// for DHT queries and the like. It hides much less.
+	LowLatency
+	// BulkTransfer uses 2 hop tunnels, more of them to spread the load, and
+	// the bulk streaming profile, for moving blocks around.
+	BulkTransfer
+)
+
+var presetNames = map[Preset]string{
+	NoPreset:      "none",
+	HighAnonymity: "high-anonymity",
+	Balanced:      "balanced",
+	LowLatency:    "low-latency",
+	BulkTransfer:  "bulk-transfer",
+}
+
+func (p Preset) String() string {
+	if name, ok := presetNames[p]; ok {
+		return name
+	}
+	return "Preset(" + strconv.Itoa(int(p)) + ")"
+}
+
+// ParsePreset finds a preset by the name String gives it, for config files
+// and flags
+func ParsePreset(name string) (Preset, error) {
+	for p, n := range presetNames {
+		if strings.EqualFold(name, n) {
+			return p, nil
+		}
+	}
+	return NoPreset, fmt.Errorf("unknown preset %q", name)
+}
+
+// Tunnel is the preset's tunnel options
+func (p Preset) Tunnel() TunnelOptions {
+	symmetric := func(length, variance, quantity, backup int) TunnelOptions {
+		return TunnelOptions{
+			InboundLength:          Int(length),
+			OutboundLength:         Int(length),
+			InboundLengthVariance:  Int(variance),
+			OutboundLengthVariance: Int(variance),
+			InboundQuantity:        Int(quantity),
+			OutboundQuantity:       Int(quantity),
+			InboundBackupQuantity:  Int(backup),
+			OutboundBackupQuantity: Int(backup),
+		}
+	}
+	switch p {
+	case HighAnonymity:
+		return symmetric(3, 1, 3, 1)
+	case Balanced:
+		return symmetric(2, 0, 3, 1)
+	case LowLatency:
+		return symmetric(1, 0, 4, 2)
+	case BulkTransfer:
+		return symmetric(2, 0, 6, 1)
+	}
+	return TunnelOptions{}
+}
+
+// Streaming is the preset's streaming options
+func (p Preset) Streaming() StreamingOptions {
+	switch p {
+	case LowLatency:
+		return StreamingOptions{Profile: ProfileInteractive}
+	case HighAnonymity, Balanced, BulkTransfer:
+		return StreamingOptions{Profile: ProfileBulk}
+	}
+	return StreamingOptions{}
+}
@@ -0,0 +1,45 @@
+package i2phelpers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPresets(t *testing.T) {
+	for _, p := range []Preset{HighAnonymity, Balanced, LowLatency, BulkTransfer} {
+		if _, err := p.Tunnel().SAMOptions(); err != nil {
+			t.Errorf("%s: %s", p, err)
+		}
+		if got, err := ParsePreset(p.String()); err != nil || got != p {
+			t.Errorf("%s parsed as %s, %v", p, got, err)
+		}
+	}
+	if _, err := ParsePreset("fast"); err == nil {
+		t.Error("parsed an unknown preset")
+	}
+}
+
+func TestPresetOverride(t *testing.T) {
+	c := DefaultConfig()
+	c.Preset = LowLatency
+	c.Tunnel.InboundLength = Int(2)
+	c.Streaming.Profile = ProfileBulk
+	opts, err := c.SessionOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"inbound.length=2",
+		"outbound.length=1",
+		"inbound.quantity=4",
+		"outbound.quantity=4",
+		"inbound.lengthVariance=0",
+		"outbound.lengthVariance=0",
+		"inbound.backupQuantity=2",
+		"outbound.backupQuantity=2",
+		"i2p.streaming.profile=1",
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("got %v, want %v", opts, want)
+	}
+}
@@ -0,0 +1,136 @@
+package i2phelpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/eyedeekay/sam3/i2pkeys"
+)
+
+// PrivateKeys holds a destination's keys without letting the private half
+// leak. Printing it in any format, or marshalling it to JSON, only ever shows
+// the b32 address. The private keys are kept as a byte slice so that they can
+// be wiped once they're no longer needed. Copies of a PrivateKeys share it and
+// are wiped together, Clone makes one that isn't.
+type PrivateKeys struct {
+	addr i2pkeys.I2PAddr
+	priv *secret
+}
+
+// secret is the private half, shared by copies of a PrivateKeys
+type secret struct {
+	mu sync.Mutex
+	b  []byte
+}
+
+// bytes runs f on the private keys, or returns false if they've been wiped
+func (k PrivateKeys) bytes(f func([]byte)) bool {
+	if k.priv == nil {
+		return false
+	}
+	k.priv.mu.Lock()
+	defer k.priv.mu.Unlock()
+	if len(k.priv.b) == 0 {
+		return false
+	}
+	f(k.priv.b)
+	return true
+}
+
+// NewPrivateKeys takes a copy of keys in a form that can be wiped
+func NewPrivateKeys(keys i2pkeys.I2PKeys) (PrivateKeys, error) {
+	if keys.String() == "" {
+		return PrivateKeys{addr: keys.Addr()}, nil
+	}
+	priv, err := I2PEncoding.DecodeString(keys.String())
+	if err != nil {
+		return PrivateKeys{}, fmt.Errorf("private keys are not valid base64")
+	}
+	return PrivateKeys{addr: keys.Addr(), priv: &secret{b: priv}}, nil
+}
+
+// Clone returns a copy of k with private keys of its own, which wiping k
+// doesn't touch, nor the other way round
+func (k PrivateKeys) Clone() PrivateKeys {
+	c := PrivateKeys{addr: k.addr}
+	k.bytes(func(b []byte) {
+		c.priv = &secret{b: append([]byte{}, b...)}
+	})
+	return c
+}
+
+// Addr returns the public destination, which survives wiping
+func (k PrivateKeys) Addr() i2pkeys.I2PAddr {
+	return k.addr
+}
+
+// IsZero is true if there are no keys at all, not even an address
+func (k PrivateKeys) IsZero() bool {
+	return k.addr == "" && !k.HasPrivate()
+}
+
+// HasPrivate is false once the keys have been wiped, through any copy
+func (k PrivateKeys) HasPrivate() bool {
+	return k.bytes(func([]byte) {})
+}
+
+// Keys returns the keys in the form sam3 wants them. The private keys end up
+// in an immutable string that can't be wiped, so only call this right before
+// handing them to the SAM bridge.
+func (k PrivateKeys) Keys() i2pkeys.I2PKeys {
+	var priv string
+	k.bytes(func(b []byte) {
+		priv = I2PEncoding.EncodeToString(b)
+	})
+	return i2pkeys.NewKeys(k.addr, priv)
+}
+
+// Wipe zeroes the private keys, for every copy of k, keeping the public
+// address
+func (k *PrivateKeys) Wipe() {
+	k.bytes(func(b []byte) {
+		wipe(b)
+		k.priv.b = nil
+	})
+}
+
+// String shows the b32 address and whether the private keys are still held
+func (k PrivateKeys) String() string {
+	if k.IsZero() {
+		return "PrivateKeys(none)"
+	}
+	if !k.HasPrivate() {
+		return "PrivateKeys(" + k.addr.Base32() + ", wiped)"
+	}
+	return "PrivateKeys(" + k.addr.Base32() + ", redacted)"
+}
+
+// GoString is the same as String, so %#v doesn't dump the key bytes
+func (k PrivateKeys) GoString() string {
+	return k.String()
+}
+
+// Format implements fmt.Formatter so that every verb, %x and %#v included,
+// prints the redacted form.
+func (k PrivateKeys) Format(f fmt.State, verb rune) {
+	io.WriteString(f, k.String())
+}
+
+// MarshalJSON only includes the public address
+func (k PrivateKeys) MarshalJSON() ([]byte, error) {
+	if k.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(struct {
+		Base32 string `json:"b32"`
+	}{k.addr.Base32()})
+}
+
+// wipe zeroes a buffer that held key material
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
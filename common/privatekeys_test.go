@@ -0,0 +1,69 @@
+package i2phelpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPrivateKeysRedacted(t *testing.T) {
+	keys := generateKeys(t, EdDSA_SHA512_Ed25519)
+	pk, err := NewPrivateKeys(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := keys.String()[len(keys.String())-64:]
+	j, err := json.Marshal(pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, out := range []string{
+		fmt.Sprint(pk),
+		fmt.Sprintf("%+v %#v %s %x %q", pk, pk, pk, pk, pk),
+		fmt.Sprintf("%+v", struct{ K PrivateKeys }{pk}),
+		string(j),
+	} {
+		if strings.Contains(out, secret) || strings.Contains(out, fmt.Sprintf("%x", pk.priv.b)) {
+			t.Fatalf("private keys leaked: %s", out)
+		}
+		if !strings.Contains(out, keys.Addr().Base32()) {
+			t.Errorf("address missing from %s", out)
+		}
+	}
+}
+
+func TestPrivateKeysWipe(t *testing.T) {
+	keys := generateKeys(t, EdDSA_SHA512_Ed25519)
+	pk, err := NewPrivateKeys(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pk.Keys().String() != keys.String() {
+		t.Fatal("keys changed on the way in")
+	}
+	if _, err := pk.Sign([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	buf := pk.priv.b
+	copied, clone := pk, pk.Clone()
+	pk.Wipe()
+	for _, b := range buf {
+		if b != 0 {
+			t.Fatal("key buffer not zeroed")
+		}
+	}
+	if pk.HasPrivate() || pk.Addr() != keys.Addr() {
+		t.Fatal("wipe should keep the address and drop the private keys")
+	}
+	if _, err := pk.Sign([]byte("x")); err == nil {
+		t.Fatal("signed with wiped keys")
+	}
+	// copies go with it, clones don't
+	if copied.HasPrivate() || copied.Keys().String() != "" {
+		t.Error("copy still has the keys after a wipe")
+	}
+	if !clone.HasPrivate() || clone.Keys().String() != keys.String() {
+		t.Error("wiping the original wiped its clone")
+	}
+}
@@ -0,0 +1,124 @@
+package i2phelpers
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// DefaultSAMHost is where the SAM bridge is looked for if no host is given
+	DefaultSAMHost = "127.0.0.1"
+	// DefaultSAMPort is the SAM bridge's usual port
+	DefaultSAMPort = "7656"
+)
+
+// ParseSAMAddress reads a SAM bridge endpoint in any of the forms people
+// write them in: "host:port", a bare host name or IP, "[::1]:7656", or a
+// multiaddr like /ip4/127.0.0.1/tcp/7656 or /dns4/i2p-router/tcp/7656. The host
+// comes back without brackets or multiaddr prefixes and lower cased, port is
+// empty if s didn't have one.
+func ParseSAMAddress(s string) (host, port string, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", "", fmt.Errorf("empty SAM address")
+	}
+	if strings.HasPrefix(s, "/") {
+		return parseSAMMultiaddr(s)
+	}
+	// a bare IPv6 literal would confuse SplitHostPort
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")); ip != nil {
+		return ip.String(), "", nil
+	}
+	host, port, err = net.SplitHostPort(s)
+	if err != nil {
+		host, port = s, ""
+	}
+	if host, err = parseSAMHost(host); err != nil {
+		return "", "", err
+	}
+	if port != "" {
+		if port, err = ParseSAMPort(port); err != nil {
+			return "", "", err
+		}
+	}
+	return host, port, nil
+}
+
+func parseSAMMultiaddr(s string) (host, port string, err error) {
+	m, err := ma.NewMultiaddr(s)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid SAM multiaddr %s: %s", s, err)
+	}
+	protos := m.Protocols()
+	if len(protos) > 2 || (len(protos) == 2 && protos[1].Code != ma.P_TCP) {
+		return "", "", fmt.Errorf("SAM multiaddr %s should be a host optionally followed by /tcp/port", s)
+	}
+	switch protos[0].Code {
+	case ma.P_IP4, ma.P_IP6, ma.P_DNS, ma.P_DNS4, ma.P_DNS6:
+	default:
+		return "", "", fmt.Errorf("SAM multiaddr %s should start with /ip4, /ip6, /dns4 or /dns6", s)
+	}
+	if host, err = m.ValueForProtocol(protos[0].Code); err != nil {
+		return "", "", err
+	}
+	if host, err = parseSAMHost(host); err != nil {
+		return "", "", err
+	}
+	if len(protos) == 2 {
+		if port, err = m.ValueForProtocol(ma.P_TCP); err != nil {
+			return "", "", err
+		}
+		if port, err = ParseSAMPort(port); err != nil {
+			return "", "", err
+		}
+	}
+	return host, port, nil
+}
+
+// parseSAMHost checks a host is an IP address or a plausible DNS name
+func parseSAMHost(host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if name == "" || len(name) > 253 {
+		return "", fmt.Errorf("invalid SAM host %q", host)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", fmt.Errorf("invalid SAM host %q", host)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", fmt.Errorf("invalid SAM host %q", host)
+			}
+		}
+	}
+	return name, nil
+}
+
+// ParseSAMPort checks a SAM port, which may also be given as "/tcp/7656/"
+func ParseSAMPort(s string) (string, error) {
+	p := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(s), "/tcp/"), "/")
+	val, err := strconv.Atoi(p)
+	if err != nil || val <= 0 || val >= 65536 {
+		return "", fmt.Errorf("invalid SAM port %q", s)
+	}
+	return strconv.Itoa(val), nil
+}
+
+// JoinSAMAddress makes the "host:port" the SAM bridge is dialed with, filling
+// in the defaults for whatever is missing.
+func JoinSAMAddress(host, port string) string {
+	if host == "" {
+		host = DefaultSAMHost
+	}
+	if port == "" {
+		port = DefaultSAMPort
+	}
+	return net.JoinHostPort(host, port)
+}
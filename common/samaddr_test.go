@@ -0,0 +1,76 @@
+package i2phelpers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSAMAddress(t *testing.T) {
+	good := []struct{ in, host, port string }{
+		{"127.0.0.1", "127.0.0.1", ""},
+		{"127.0.0.1:7656", "127.0.0.1", "7656"},
+		{"i2p-router", "i2p-router", ""},
+		{"I2P-Router.local:7657", "i2p-router.local", "7657"},
+		{"::1", "::1", ""},
+		{"[::1]", "::1", ""},
+		{"[::1]:7656", "::1", "7656"},
+		{"/ip4/127.0.0.1/", "127.0.0.1", ""},
+		{"/ip4/127.0.0.1/tcp/7656", "127.0.0.1", "7656"},
+		{"/ip6/::1/tcp/7656", "::1", "7656"},
+		{"/dns4/i2p-router/tcp/7656", "i2p-router", "7656"},
+		{"/dns6/i2p-router", "i2p-router", ""},
+	}
+	for _, c := range good {
+		host, port, err := ParseSAMAddress(c.in)
+		if err != nil {
+			t.Errorf("%s: %s", c.in, err)
+			continue
+		}
+		if host != c.host || port != c.port {
+			t.Errorf("%s: got %q %q, want %q %q", c.in, host, port, c.host, c.port)
+		}
+	}
+	bad := []string{
+		"",
+		"i2p router",
+		"-router",
+		"127.0.0.1:0",
+		"127.0.0.1:70000",
+		"host:port",
+		"/ip4/127.0.0.1/udp/7656",
+		"/tcp/7656",
+		"/ip4/127.0.0.1/tcp/7656/tcp/1",
+	}
+	for _, s := range bad {
+		if host, port, err := ParseSAMAddress(s); err == nil {
+			t.Errorf("%q should be rejected, got %q %q", s, host, port)
+		}
+	}
+}
+
+func TestJoinSAMAddress(t *testing.T) {
+	if a := JoinSAMAddress("", ""); a != "127.0.0.1:7656" {
+		t.Errorf("got %s", a)
+	}
+	if a := JoinSAMAddress("::1", "7000"); a != "[::1]:7000" {
+		t.Errorf("got %s", a)
+	}
+}
+
+func TestSetSAMAddresses(t *testing.T) {
+	cfg := DefaultConfig()
+	if err := cfg.SetSAMAddresses([]string{"/dns4/i2pd/tcp/7656", "java-router:7657", "10.0.0.3"}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, b := range cfg.Bridges() {
+		got = append(got, b.Address)
+	}
+	want := "i2pd:7656 java-router:7657 10.0.0.3:7656"
+	if strings.Join(got, " ") != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+	if err := cfg.SetSAMAddresses([]string{"i2pd", "i2pd:7656"}); err == nil {
+		t.Error("accepted the same bridge twice")
+	}
+}
@@ -0,0 +1,29 @@
+package i2phelpers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/RTradeLtd/go-garlic-tcp-transport/bridge"
+)
+
+// SAMTLSConfig makes the TLS config for a SAM bridge served over TLS. caFile
+// is a PEM file of the CA certificates to trust, fingerprints are SHA-256
+// fingerprints of the bridge's own certificate, see i2pbridge.TLSConfig.
+// Either can be left out, but not both.
+func SAMTLSConfig(caFile string, fingerprints ...string) (*tls.Config, error) {
+	var roots *x509.CertPool
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s has no PEM certificates in it", caFile)
+		}
+	}
+	return i2pbridge.TLSConfig(roots, fingerprints...)
+}
@@ -0,0 +1,450 @@
+package i2phelpers
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/big"
+
+	"filippo.io/edwards25519"
+	"github.com/eyedeekay/sam3/i2pkeys"
+)
+
+// I2PEncoding is the modified base64 alphabet I2P uses for destinations and
+// private keys.
+var I2PEncoding = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-~")
+
+// SignatureType is the numeric signing key type carried in a destination's
+// key certificate.
+type SignatureType uint16
+
+// Signature types defined by the I2P common structures spec. Types 9 and 10
+// are reserved for GOST and are not supported.
+const (
+	DSA_SHA1               SignatureType = 0
+	ECDSA_SHA256_P256      SignatureType = 1
+	ECDSA_SHA384_P384      SignatureType = 2
+	ECDSA_SHA512_P521      SignatureType = 3
+	RSA_SHA256_2048        SignatureType = 4
+	RSA_SHA384_3072        SignatureType = 5
+	RSA_SHA512_4096        SignatureType = 6
+	EdDSA_SHA512_Ed25519   SignatureType = 7
+	EdDSA_SHA512_Ed25519ph SignatureType = 8
+	RedDSA_SHA512_Ed25519  SignatureType = 11
+)
+
+// signatureSizes holds the public key, private key and signature lengths of
+// each signature type, in bytes.
+var signatureSizes = map[SignatureType][3]int{
+	DSA_SHA1:               {128, 20, 40},
+	ECDSA_SHA256_P256:      {64, 32, 64},
+	ECDSA_SHA384_P384:      {96, 48, 96},
+	ECDSA_SHA512_P521:      {132, 66, 132},
+	RSA_SHA256_2048:        {256, 512, 256},
+	RSA_SHA384_3072:        {384, 768, 384},
+	RSA_SHA512_4096:        {512, 1024, 512},
+	EdDSA_SHA512_Ed25519:   {32, 32, 64},
+	EdDSA_SHA512_Ed25519ph: {32, 32, 64},
+	RedDSA_SHA512_Ed25519:  {32, 32, 64},
+}
+
+var signatureNames = map[SignatureType]string{
+	DSA_SHA1:               "DSA_SHA1",
+	ECDSA_SHA256_P256:      "ECDSA_SHA256_P256",
+	ECDSA_SHA384_P384:      "ECDSA_SHA384_P384",
+	ECDSA_SHA512_P521:      "ECDSA_SHA512_P521",
+	RSA_SHA256_2048:        "RSA_SHA256_2048",
+	RSA_SHA384_3072:        "RSA_SHA384_3072",
+	RSA_SHA512_4096:        "RSA_SHA512_4096",
+	EdDSA_SHA512_Ed25519:   "EdDSA_SHA512_Ed25519",
+	EdDSA_SHA512_Ed25519ph: "EdDSA_SHA512_Ed25519ph",
+	RedDSA_SHA512_Ed25519:  "RedDSA_SHA512_Ed25519",
+}
+
+// String returns the name SAM uses for the signature type
+func (s SignatureType) String() string {
+	if n, ok := signatureNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("SIGTYPE_%d", uint16(s))
+}
+
+// PublicKeyLen is the length of the signing public key in bytes
+func (s SignatureType) PublicKeyLen() int {
+	return signatureSizes[s][0]
+}
+
+// PrivateKeyLen is the length of the signing private key in bytes
+func (s SignatureType) PrivateKeyLen() int {
+	return signatureSizes[s][1]
+}
+
+// SignatureLen is the length of a signature in bytes
+func (s SignatureType) SignatureLen() int {
+	return signatureSizes[s][2]
+}
+
+// Supported reports whether data can be signed and verified with this type
+func (s SignatureType) Supported() bool {
+	_, ok := signatureSizes[s]
+	return ok
+}
+
+// The DSA group every DSA_SHA1 destination uses, from the I2P cryptography
+// spec.
+var i2pDSAParameters = dsa.Parameters{
+	P: fromHex("9c05b2aa960d9b97b8931963c9cc9e8c3026e9b8ed92fad0a69cc886d5bf8015" +
+		"fcadae31a0ad18fab3f01b00a358de237655c4964afaa2b337e96ad316b9fb1c" +
+		"c564b5aec5b69a9ff6c3e4548707fef8503d91dd8602e867e6d35d2235c1869c" +
+		"e2479c3b9d5401de04e0727fb33d6511285d4cf29538d9e3b6051f5b22cc1c93"),
+	Q: fromHex("a5dfc28fef4ca1e286744cd8eed9d29d684046b7"),
+	G: fromHex("0c1f4d27d40093b429e962d7223824e0bbc47e7c832a39236fc683af84889581" +
+		"075ff9082ed32353d4374d7301cda1d23c431f4698599dda02451824ff369752" +
+		"593647cc3ddc197de985e43d136cdcfc6bd5409cd2f450821142a5e6f8eb1c3a" +
+		"b5d0484b8129fcf17bce4f7f33321c3cb3dbb14a905e7b2b3e93be4708cbcc82"),
+}
+
+func fromHex(s string) *big.Int {
+	i, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("invalid hex constant " + s)
+	}
+	return i
+}
+
+const (
+	destKeysLen    = 384
+	certKey        = 5
+	cryptoElGamal  = 0
+	cryptoX25519   = 4
+	elGamalPrivLen = 256
+	x25519PrivLen  = 32
+)
+
+// Destination is a parsed I2P destination, just enough of it to check
+// signatures made by its owner.
+type Destination struct {
+	SignatureType SignatureType
+	CryptoType    uint16
+	SigningKey    []byte
+	// Len is the length of the destination in bytes, including certificate
+	Len int
+}
+
+// ParseDestination reads the certificate and signing public key out of the
+// binary form of a destination. b may have trailing data, such as the private
+// keys which follow it in a SAM private key blob.
+func ParseDestination(b []byte) (*Destination, error) {
+	if len(b) < destKeysLen+3 {
+		return nil, fmt.Errorf("destination too short: %d bytes", len(b))
+	}
+	certType := b[destKeysLen]
+	certLen := int(binary.BigEndian.Uint16(b[destKeysLen+1:]))
+	end := destKeysLen + 3 + certLen
+	if len(b) < end {
+		return nil, fmt.Errorf("destination certificate truncated")
+	}
+	d := &Destination{SignatureType: DSA_SHA1, CryptoType: cryptoElGamal, Len: end}
+	var excess []byte
+	if certType == certKey {
+		if certLen < 4 {
+			return nil, fmt.Errorf("key certificate too short: %d bytes", certLen)
+		}
+		payload := b[destKeysLen+3 : end]
+		d.SignatureType = SignatureType(binary.BigEndian.Uint16(payload))
+		d.CryptoType = binary.BigEndian.Uint16(payload[2:])
+		excess = payload[4:]
+	}
+	if !d.SignatureType.Supported() {
+		return nil, fmt.Errorf("unsupported signature type %s", d.SignatureType)
+	}
+	// the signing key is right-aligned in the 128 bytes after the encryption
+	// key, anything that doesn't fit there is carried in the certificate.
+	n := d.SignatureType.PublicKeyLen()
+	if n <= 128 {
+		d.SigningKey = append([]byte{}, b[destKeysLen-n:destKeysLen]...)
+	} else {
+		if len(excess) < n-128 {
+			return nil, fmt.Errorf("key certificate is missing %d bytes of signing key", n-128-len(excess))
+		}
+		d.SigningKey = append(append([]byte{}, b[256:destKeysLen]...), excess[:n-128]...)
+	}
+	return d, nil
+}
+
+// DestinationFromAddr decodes and parses an I2PAddr
+func DestinationFromAddr(addr i2pkeys.I2PAddr) (*Destination, error) {
+	b, err := I2PEncoding.DecodeString(addr.Base64())
+	if err != nil {
+		return nil, fmt.Errorf("destination is not valid base64: %s", err)
+	}
+	return ParseDestination(b)
+}
+
+// parsePrivateKeys splits a binary private key blob into its destination and
+// signing private key.
+func parsePrivateKeys(b []byte) (*Destination, []byte, error) {
+	d, err := ParseDestination(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	off := d.Len
+	switch d.CryptoType {
+	case cryptoElGamal:
+		off += elGamalPrivLen
+	case cryptoX25519:
+		off += x25519PrivLen
+	default:
+		return nil, nil, fmt.Errorf("unsupported encryption type %d", d.CryptoType)
+	}
+	n := d.SignatureType.PrivateKeyLen()
+	if len(b) < off+n {
+		return nil, nil, fmt.Errorf("private keys truncated, no %s signing key", d.SignatureType)
+	}
+	return d, b[off : off+n], nil
+}
+
+// SignData signs data with the signing private key of keys, producing a
+// signature in the wire format of the destination's signature type.
+func SignData(keys i2pkeys.I2PKeys, data []byte) ([]byte, error) {
+	b, err := I2PEncoding.DecodeString(keys.String())
+	if err != nil {
+		return nil, fmt.Errorf("private keys are not valid base64: %s", err)
+	}
+	defer wipe(b)
+	return signBlob(b, data)
+}
+
+// Sign signs data with the signing private key, see SignData
+func (k PrivateKeys) Sign(data []byte) ([]byte, error) {
+	var sig []byte
+	var err error
+	if !k.bytes(func(b []byte) { sig, err = signBlob(b, data) }) {
+		return nil, fmt.Errorf("private keys for %s have been wiped", k.addr.Base32())
+	}
+	return sig, err
+}
+
+// signBlob signs data with the signing key in the binary private key blob b
+func signBlob(b, data []byte) ([]byte, error) {
+	d, priv, err := parsePrivateKeys(b)
+	if err != nil {
+		return nil, err
+	}
+	switch d.SignatureType {
+	case DSA_SHA1:
+		k := &dsa.PrivateKey{X: new(big.Int).SetBytes(priv)}
+		k.Parameters = i2pDSAParameters
+		k.Y = new(big.Int).SetBytes(d.SigningKey)
+		h := sha1.Sum(data)
+		r, s, err := dsa.Sign(rand.Reader, k, h[:])
+		if err != nil {
+			return nil, err
+		}
+		return append(padBytes(r, 20), padBytes(s, 20)...), nil
+	case ECDSA_SHA256_P256, ECDSA_SHA384_P384, ECDSA_SHA512_P521:
+		curve, h := ecdsaParams(d.SignatureType)
+		k := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(priv)}
+		k.Curve = curve
+		half := len(d.SigningKey) / 2
+		k.X = new(big.Int).SetBytes(d.SigningKey[:half])
+		k.Y = new(big.Int).SetBytes(d.SigningKey[half:])
+		h.Write(data)
+		r, s, err := ecdsa.Sign(rand.Reader, k, h.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		return append(padBytes(r, half), padBytes(s, half)...), nil
+	case RSA_SHA256_2048, RSA_SHA384_3072, RSA_SHA512_4096:
+		// I2P stores RSA private keys as modulus || private exponent, without
+		// the primes, so we do the raw exponentiation ourselves.
+		size := d.SignatureType.SignatureLen()
+		n := new(big.Int).SetBytes(priv[:size])
+		x := new(big.Int).SetBytes(priv[size:])
+		em, err := pkcs1v15Encode(d.SignatureType, data, size)
+		if err != nil {
+			return nil, err
+		}
+		return padBytes(new(big.Int).Exp(new(big.Int).SetBytes(em), x, n), size), nil
+	case EdDSA_SHA512_Ed25519:
+		k := ed25519.NewKeyFromSeed(priv)
+		defer wipe(k)
+		return ed25519.Sign(k, data), nil
+	case EdDSA_SHA512_Ed25519ph:
+		// I2P signs the SHA-512 of the data with plain Ed25519, this isn't
+		// RFC 8032's Ed25519ph, which adds a dom2 prefix.
+		k := ed25519.NewKeyFromSeed(priv)
+		defer wipe(k)
+		h := sha512.Sum512(data)
+		return ed25519.Sign(k, h[:]), nil
+	case RedDSA_SHA512_Ed25519:
+		return signRedDSA(priv, d.SigningKey, data)
+	}
+	return nil, fmt.Errorf("unsupported signature type %s", d.SignatureType)
+}
+
+// VerifyData checks that sig is a signature over data by dest. It returns an
+// error only when dest or sig are malformed, a well-formed signature that
+// doesn't match returns false.
+func VerifyData(dest i2pkeys.I2PAddr, data, sig []byte) (bool, error) {
+	d, err := DestinationFromAddr(dest)
+	if err != nil {
+		return false, err
+	}
+	if len(sig) != d.SignatureType.SignatureLen() {
+		return false, fmt.Errorf("%s signature must be %d bytes, got %d", d.SignatureType, d.SignatureType.SignatureLen(), len(sig))
+	}
+	switch d.SignatureType {
+	case DSA_SHA1:
+		k := &dsa.PublicKey{Parameters: i2pDSAParameters, Y: new(big.Int).SetBytes(d.SigningKey)}
+		h := sha1.Sum(data)
+		return dsa.Verify(k, h[:], new(big.Int).SetBytes(sig[:20]), new(big.Int).SetBytes(sig[20:])), nil
+	case ECDSA_SHA256_P256, ECDSA_SHA384_P384, ECDSA_SHA512_P521:
+		curve, h := ecdsaParams(d.SignatureType)
+		half := len(d.SigningKey) / 2
+		k := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(d.SigningKey[:half]),
+			Y:     new(big.Int).SetBytes(d.SigningKey[half:]),
+		}
+		if !curve.IsOnCurve(k.X, k.Y) {
+			return false, fmt.Errorf("%s signing key is not on the curve", d.SignatureType)
+		}
+		h.Write(data)
+		return ecdsa.Verify(k, h.Sum(nil), new(big.Int).SetBytes(sig[:half]), new(big.Int).SetBytes(sig[half:])), nil
+	case RSA_SHA256_2048, RSA_SHA384_3072, RSA_SHA512_4096:
+		size := d.SignatureType.SignatureLen()
+		n := new(big.Int).SetBytes(d.SigningKey)
+		s := new(big.Int).SetBytes(sig)
+		if s.Cmp(n) >= 0 {
+			return false, nil
+		}
+		em, err := pkcs1v15Encode(d.SignatureType, data, size)
+		if err != nil {
+			return false, err
+		}
+		m := new(big.Int).Exp(s, big.NewInt(65537), n)
+		return m.Cmp(new(big.Int).SetBytes(em)) == 0, nil
+	case EdDSA_SHA512_Ed25519, RedDSA_SHA512_Ed25519:
+		// RedDSA only differs from EdDSA in how signatures are made, they are
+		// checked the same way.
+		return ed25519.Verify(ed25519.PublicKey(d.SigningKey), data, sig), nil
+	case EdDSA_SHA512_Ed25519ph:
+		h := sha512.Sum512(data)
+		return ed25519.Verify(ed25519.PublicKey(d.SigningKey), h[:], sig), nil
+	}
+	return false, fmt.Errorf("unsupported signature type %s", d.SignatureType)
+}
+
+func ecdsaParams(s SignatureType) (elliptic.Curve, hash.Hash) {
+	switch s {
+	case ECDSA_SHA384_P384:
+		return elliptic.P384(), sha512.New384()
+	case ECDSA_SHA512_P521:
+		return elliptic.P521(), sha512.New()
+	}
+	return elliptic.P256(), sha256.New()
+}
+
+// DER prefixes of the DigestInfo structure for each RSA hash, from RFC 8017
+var pkcs1v15Prefixes = map[SignatureType][]byte{
+	RSA_SHA256_2048: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	RSA_SHA384_3072: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	RSA_SHA512_4096: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pkcs1v15Encode builds the EMSA-PKCS1-v1_5 encoded message for data
+func pkcs1v15Encode(s SignatureType, data []byte, size int) ([]byte, error) {
+	var digest []byte
+	switch s {
+	case RSA_SHA256_2048:
+		h := sha256.Sum256(data)
+		digest = h[:]
+	case RSA_SHA384_3072:
+		h := sha512.Sum384(data)
+		digest = h[:]
+	default:
+		h := sha512.Sum512(data)
+		digest = h[:]
+	}
+	t := append(append([]byte{}, pkcs1v15Prefixes[s]...), digest...)
+	if size < len(t)+11 {
+		return nil, fmt.Errorf("RSA modulus too short")
+	}
+	em := make([]byte, size)
+	em[1] = 1
+	for i := 2; i < size-len(t)-1; i++ {
+		em[i] = 0xff
+	}
+	copy(em[size-len(t):], t)
+	return em, nil
+}
+
+// signRedDSA signs like Ed25519, except that the private key is the scalar
+// itself rather than a seed, and the nonce is randomized.
+func signRedDSA(priv, pub, data []byte) ([]byte, error) {
+	a, err := edwards25519.NewScalar().SetCanonicalBytes(priv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RedDSA private key: %s", err)
+	}
+	t := make([]byte, 80)
+	if _, err := rand.Read(t); err != nil {
+		return nil, err
+	}
+	h := sha512.New()
+	h.Write(t)
+	h.Write(pub)
+	h.Write(data)
+	r := uniformScalar(h.Sum(nil))
+	R := new(edwards25519.Point).ScalarBaseMult(r).Bytes()
+	h.Reset()
+	h.Write(R)
+	h.Write(pub)
+	h.Write(data)
+	k := uniformScalar(h.Sum(nil))
+	S := edwards25519.NewScalar().MultiplyAdd(k, a, r)
+	return append(R, S.Bytes()...), nil
+}
+
+// ed25519Order is l, the order of the Ed25519 base point
+var ed25519Order = fromHex("1000000000000000000000000000000014def9dea2f79cd65812631a5cf5d3ed")
+
+// uniformScalar reduces a 64 byte little-endian hash mod l. Scalar has
+// SetUniformBytes for this, but it changed signature in edwards25519 v1.0.0,
+// doing it here builds with v1.0.0-beta.2 and later alike.
+func uniformScalar(b []byte) *edwards25519.Scalar {
+	n := new(big.Int).SetBytes(reverse(b))
+	s, err := edwards25519.NewScalar().SetCanonicalBytes(reverse(padBytes(n.Mod(n, ed25519Order), 32)))
+	if err != nil {
+		// anything mod l is canonical
+		panic(err)
+	}
+	return s
+}
+
+// reverse returns b back to front, to go between little and big endian
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i, c := range b {
+		r[len(b)-1-i] = c
+	}
+	return r
+}
+
+// padBytes left-pads the big-endian form of i to size bytes
+func padBytes(i *big.Int, size int) []byte {
+	b := i.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
@@ -0,0 +1,272 @@
+package i2phelpers
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"filippo.io/edwards25519"
+	"github.com/eyedeekay/sam3/i2pkeys"
+)
+
+// testKeys builds a SAM-style private key blob around a signing keypair, the
+// same way DEST GENERATE lays it out.
+func testKeys(t *testing.T, st SignatureType, pub, priv []byte) i2pkeys.I2PKeys {
+	if len(pub) != st.PublicKeyLen() || len(priv) != st.PrivateKeyLen() {
+		t.Fatalf("%s: bad key lengths %d/%d", st, len(pub), len(priv))
+	}
+	dest := make([]byte, destKeysLen)
+	rand.Read(dest[:256])
+	var excess []byte
+	if len(pub) <= 128 {
+		copy(dest[destKeysLen-len(pub):], pub)
+	} else {
+		copy(dest[256:], pub[:128])
+		excess = pub[128:]
+	}
+	if st == DSA_SHA1 {
+		dest = append(dest, 0, 0, 0)
+	} else {
+		cert := make([]byte, 7)
+		cert[0] = certKey
+		binary.BigEndian.PutUint16(cert[1:], uint16(4+len(excess)))
+		binary.BigEndian.PutUint16(cert[3:], uint16(st))
+		dest = append(append(dest, cert...), excess...)
+	}
+	both := append(append(append([]byte{}, dest...), make([]byte, elGamalPrivLen)...), priv...)
+	return i2pkeys.NewKeys(i2pkeys.I2PAddr(I2PEncoding.EncodeToString(dest)), I2PEncoding.EncodeToString(both))
+}
+
+func generateKeys(t *testing.T, st SignatureType) i2pkeys.I2PKeys {
+	switch st {
+	case DSA_SHA1:
+		k := &dsa.PrivateKey{}
+		k.Parameters = i2pDSAParameters
+		if err := dsa.GenerateKey(k, rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+		return testKeys(t, st, padBytes(k.Y, 128), padBytes(k.X, 20))
+	case ECDSA_SHA256_P256, ECDSA_SHA384_P384, ECDSA_SHA512_P521:
+		curve, _ := ecdsaParams(st)
+		k, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		half := st.PublicKeyLen() / 2
+		return testKeys(t, st, append(padBytes(k.X, half), padBytes(k.Y, half)...), padBytes(k.D, st.PrivateKeyLen()))
+	case RSA_SHA256_2048, RSA_SHA384_3072, RSA_SHA512_4096:
+		size := st.SignatureLen()
+		k, err := rsa.GenerateKey(rand.Reader, size*8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return testKeys(t, st, padBytes(k.N, size), append(padBytes(k.N, size), padBytes(k.D, size)...))
+	case EdDSA_SHA512_Ed25519, EdDSA_SHA512_Ed25519ph:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return testKeys(t, st, pub, priv.Seed())
+	case RedDSA_SHA512_Ed25519:
+		seed := make([]byte, 64)
+		rand.Read(seed)
+		a := uniformScalar(seed)
+		pub := new(edwards25519.Point).ScalarBaseMult(a).Bytes()
+		return testKeys(t, st, pub, a.Bytes())
+	}
+	t.Fatalf("no generator for %s", st)
+	return i2pkeys.I2PKeys{}
+}
+
+// Key and signature sizes from the SigningPublicKey table of the I2P common
+// structures spec.
+func TestSignatureTypeSizes(t *testing.T) {
+	vectors := []struct {
+		st               SignatureType
+		name             string
+		pub, priv, sigln int
+	}{
+		{0, "DSA_SHA1", 128, 20, 40},
+		{1, "ECDSA_SHA256_P256", 64, 32, 64},
+		{2, "ECDSA_SHA384_P384", 96, 48, 96},
+		{3, "ECDSA_SHA512_P521", 132, 66, 132},
+		{4, "RSA_SHA256_2048", 256, 512, 256},
+		{5, "RSA_SHA384_3072", 384, 768, 384},
+		{6, "RSA_SHA512_4096", 512, 1024, 512},
+		{7, "EdDSA_SHA512_Ed25519", 32, 32, 64},
+		{8, "EdDSA_SHA512_Ed25519ph", 32, 32, 64},
+		{11, "RedDSA_SHA512_Ed25519", 32, 32, 64},
+	}
+	for _, v := range vectors {
+		if v.st.String() != v.name {
+			t.Errorf("type %d is named %s, want %s", uint16(v.st), v.st, v.name)
+		}
+		if v.st.PublicKeyLen() != v.pub || v.st.PrivateKeyLen() != v.priv || v.st.SignatureLen() != v.sigln {
+			t.Errorf("%s sizes %d/%d/%d, want %d/%d/%d", v.st, v.st.PublicKeyLen(), v.st.PrivateKeyLen(), v.st.SignatureLen(), v.pub, v.priv, v.sigln)
+		}
+	}
+	if SignatureType(9).Supported() || SignatureType(10).Supported() {
+		t.Error("GOST signature types should not be supported")
+	}
+}
+
+// The DSA group is fixed by the spec, make sure nothing got mangled.
+func TestDSAParameters(t *testing.T) {
+	p, q, g := i2pDSAParameters.P, i2pDSAParameters.Q, i2pDSAParameters.G
+	if p.BitLen() != 1024 || q.BitLen() != 160 {
+		t.Fatalf("DSA group is %d/%d bits", p.BitLen(), q.BitLen())
+	}
+	if !p.ProbablyPrime(20) || !q.ProbablyPrime(20) {
+		t.Fatal("DSA p and q must be prime")
+	}
+	pm1 := new(big.Int).Sub(p, big.NewInt(1))
+	if new(big.Int).Mod(pm1, q).Sign() != 0 {
+		t.Fatal("q does not divide p-1")
+	}
+	if new(big.Int).Exp(g, q, p).Cmp(big.NewInt(1)) != 0 {
+		t.Fatal("g does not generate the order q subgroup")
+	}
+}
+
+// Known answers for the Ed25519 family. I2P's EdDSA_SHA512_Ed25519 is plain
+// Ed25519, so RFC 8032's vectors apply as they are. EdDSA_SHA512_Ed25519ph
+// signs the SHA-512 of the data with plain Ed25519, without RFC 8032
+// Ed25519ph's dom2 prefix, which is RFC 8032's "SHA(abc)" vector signed over
+// "abc". RedDSA_SHA512_Ed25519 signatures are randomized, so its vector is one
+// to verify: they're checked just like Ed25519's.
+var ed25519Vectors = []struct {
+	name      string
+	st        SignatureType
+	seed, pub string
+	data      []byte
+	sig       string
+}{
+	{
+		"RFC 8032 test 1", EdDSA_SHA512_Ed25519,
+		"9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60",
+		"d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a",
+		[]byte{},
+		"e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b",
+	},
+	{
+		"RFC 8032 test 2", EdDSA_SHA512_Ed25519,
+		"4ccd089b28ff96da9db6c346ec114e0f5b8a319f35aba624da8cf6ed4fb8a6fb",
+		"3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c",
+		[]byte{0x72},
+		"92a009a9f0d4cab8720e820b5f642540a2b27b5416503f8fb3762223ebdb69da085ac1e43e15996e458f3613d0f11d8c387b2eaeb4302aeeb00d291612bb0c00",
+	},
+	{
+		"RFC 8032 SHA(abc)", EdDSA_SHA512_Ed25519ph,
+		"833fe62409237b9d62ec77587520911e9a759cec1d19755b7da901b96dca3d42",
+		"ec172b93ad5e563bf4932c70e1245034c35467ef2efd4d64ebf819683467e2bf",
+		[]byte("abc"),
+		"dc2a4459e7369633a52b1bf277839a00201009a3efbf3ecb69bea2186c26b58909351fc9ac90b3ecfdfbc7c66431e0303dca179c138ac17ad9bef1177331a704",
+	},
+	{
+		"RFC 8032 test 2", RedDSA_SHA512_Ed25519,
+		"", "3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c",
+		[]byte{0x72},
+		"92a009a9f0d4cab8720e820b5f642540a2b27b5416503f8fb3762223ebdb69da085ac1e43e15996e458f3613d0f11d8c387b2eaeb4302aeeb00d291612bb0c00",
+	},
+}
+
+func TestSignatureVectors(t *testing.T) {
+	for _, v := range ed25519Vectors {
+		pub, _ := hex.DecodeString(v.pub)
+		want, _ := hex.DecodeString(v.sig)
+		priv := make([]byte, v.st.PrivateKeyLen())
+		if v.seed != "" {
+			priv, _ = hex.DecodeString(v.seed)
+		}
+		keys := testKeys(t, v.st, pub, priv)
+		if ok, err := VerifyData(keys.Addr(), v.data, want); err != nil || !ok {
+			t.Errorf("%s, %s: known signature didn't verify: %v", v.name, v.st, err)
+		}
+		if ok, _ := VerifyData(keys.Addr(), append(v.data, '!'), want); ok {
+			t.Errorf("%s, %s: verified over the wrong data", v.name, v.st)
+		}
+		if v.seed == "" {
+			continue
+		}
+		sig, err := SignData(keys, v.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sig, want) {
+			t.Errorf("%s, %s: signature mismatch\n got %x\nwant %x", v.name, v.st, sig, want)
+		}
+	}
+}
+
+// A RedDSA key is the scalar Ed25519 derives from its seed, so its signatures
+// have to verify as Ed25519 ones with the same public key
+func TestSignRedDSAMatchesEd25519(t *testing.T) {
+	seed, _ := hex.DecodeString(ed25519Vectors[0].seed)
+	pub, _ := hex.DecodeString(ed25519Vectors[0].pub)
+	h := sha512.Sum512(seed)
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	a := uniformScalar(append(h[:32:32], make([]byte, 32)...))
+	if got := new(edwards25519.Point).ScalarBaseMult(a).Bytes(); !bytes.Equal(got, pub) {
+		t.Fatalf("public key %x, want %x", got, pub)
+	}
+	keys := testKeys(t, RedDSA_SHA512_Ed25519, pub, a.Bytes())
+	data := []byte("/garlic64/bootstrap-list")
+	sig, err := SignData(keys, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), data, sig) {
+		t.Fatal("RedDSA signature isn't a valid Ed25519 one")
+	}
+}
+
+func TestSignVerifyAllTypes(t *testing.T) {
+	data := []byte("/garlic64/bootstrap-list")
+	for st := range signatureSizes {
+		keys := generateKeys(t, st)
+		d, err := DestinationFromAddr(keys.Addr())
+		if err != nil {
+			t.Fatalf("%s: %s", st, err)
+		}
+		if d.SignatureType != st {
+			t.Fatalf("%s: destination parsed as %s", st, d.SignatureType)
+		}
+		sig, err := SignData(keys, data)
+		if err != nil {
+			t.Fatalf("%s: %s", st, err)
+		}
+		if len(sig) != st.SignatureLen() {
+			t.Fatalf("%s: signature is %d bytes", st, len(sig))
+		}
+		if ok, err := VerifyData(keys.Addr(), data, sig); err != nil || !ok {
+			t.Fatalf("%s: signature did not verify: %v", st, err)
+		}
+		if ok, _ := VerifyData(keys.Addr(), append(data, '!'), sig); ok {
+			t.Fatalf("%s: signature verified over the wrong data", st)
+		}
+		other := generateKeys(t, st)
+		if ok, _ := VerifyData(other.Addr(), data, sig); ok {
+			t.Fatalf("%s: signature verified for the wrong destination", st)
+		}
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	keys := generateKeys(t, EdDSA_SHA512_Ed25519)
+	if _, err := VerifyData(keys.Addr(), []byte("x"), make([]byte, 40)); err == nil {
+		t.Error("expected an error for a short signature")
+	}
+	if _, err := VerifyData(i2pkeys.I2PAddr("not-a-destination"), []byte("x"), make([]byte, 64)); err == nil {
+		t.Error("expected an error for a malformed destination")
+	}
+}
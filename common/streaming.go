@@ -0,0 +1,174 @@
+package i2phelpers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamingProfile tells the streaming library what a session's streams are
+// mostly for
+type StreamingProfile int
+
+const (
+	// ProfileBulk is tuned for throughput, and is I2P's default
+	ProfileBulk StreamingProfile = 1
+	// ProfileInteractive is tuned for latency
+	ProfileInteractive StreamingProfile = 2
+)
+
+func (p StreamingProfile) String() string {
+	switch p {
+	case 0:
+		return "default"
+	case ProfileBulk:
+		return "bulk"
+	case ProfileInteractive:
+		return "interactive"
+	}
+	return "StreamingProfile(" + strconv.Itoa(int(p)) + ")"
+}
+
+// maxWindowSize is the streaming library's own limit on the window
+const maxWindowSize = 128
+
+// StreamingOptions are the i2p.streaming.* options for a session's streams.
+// Zero fields aren't sent, so the router's defaults apply.
+type StreamingOptions struct {
+	Profile StreamingProfile
+	// MaxWindowSize is the most messages in flight, 1 to 128
+	MaxWindowSize *int
+	// InitialRTT is the round trip time guessed before it's been measured
+	InitialRTT time.Duration
+	// ConnectDelay, if positive, holds the SYN back that long so the first
+	// data can go along with it. Negative sends it straight away, which is
+	// I2P's default.
+	ConnectDelay time.Duration
+	// InactivityTimeout is how long a stream can go without traffic before
+	// the streaming library acts on it
+	InactivityTimeout time.Duration
+	// MaxConnsPerMinute limits incoming streams from any one peer, 0 is
+	// no limit
+	MaxConnsPerMinute *int
+}
+
+// Validate checks the options are within the streaming library's limits
+func (o StreamingOptions) Validate() error {
+	var problems []string
+	if o.Profile != 0 && o.Profile != ProfileBulk && o.Profile != ProfileInteractive {
+		problems = append(problems, fmt.Sprintf("%s isn't a streaming profile", o.Profile))
+	}
+	if w := o.MaxWindowSize; w != nil && (*w < 1 || *w > maxWindowSize) {
+		problems = append(problems, fmt.Sprintf("MaxWindowSize is %d, it has to be 1 to %d", *w, maxWindowSize))
+	}
+	if o.InitialRTT < 0 {
+		problems = append(problems, "InitialRTT can't be negative")
+	}
+	if o.InactivityTimeout < 0 {
+		problems = append(problems, "InactivityTimeout can't be negative")
+	}
+	if n := o.MaxConnsPerMinute; n != nil && *n < 0 {
+		problems = append(problems, "MaxConnsPerMinute can't be negative")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid streaming options: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Override returns o with every field that's set in with replaced
+func (o StreamingOptions) Override(with StreamingOptions) StreamingOptions {
+	if with.Profile != 0 {
+		o.Profile = with.Profile
+	}
+	if with.MaxWindowSize != nil {
+		o.MaxWindowSize = with.MaxWindowSize
+	}
+	if with.InitialRTT != 0 {
+		o.InitialRTT = with.InitialRTT
+	}
+	if with.ConnectDelay != 0 {
+		o.ConnectDelay = with.ConnectDelay
+	}
+	if with.InactivityTimeout != 0 {
+		o.InactivityTimeout = with.InactivityTimeout
+	}
+	if with.MaxConnsPerMinute != nil {
+		o.MaxConnsPerMinute = with.MaxConnsPerMinute
+	}
+	return o
+}
+
+// SAMOptions validates the options and turns them into "key=value" form
+func (o StreamingOptions) SAMOptions() ([]string, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	var opts []string
+	add := func(key string, value int64) {
+		opts = append(opts, "i2p.streaming."+key+"="+strconv.FormatInt(value, 10))
+	}
+	if o.Profile != 0 {
+		add("profile", int64(o.Profile))
+	}
+	if o.MaxWindowSize != nil {
+		add("maxWindowSize", int64(*o.MaxWindowSize))
+	}
+	if o.InitialRTT != 0 {
+		add("initialRTT", o.InitialRTT.Milliseconds())
+	}
+	if o.ConnectDelay < 0 {
+		add("connectDelay", -1)
+	} else if o.ConnectDelay > 0 {
+		add("connectDelay", o.ConnectDelay.Milliseconds())
+	}
+	if o.InactivityTimeout != 0 {
+		add("inactivityTimeout", o.InactivityTimeout.Milliseconds())
+	}
+	if o.MaxConnsPerMinute != nil {
+		add("maxConnsPerMinute", int64(*o.MaxConnsPerMinute))
+	}
+	return opts, nil
+}
+
+type streamingKey struct{}
+
+// WithStreaming returns a context that dials with o on top of the transport's
+// own streaming options, so that, say, DHT queries can ask for the
+// interactive profile while block transfers stay bulk. It takes a PRIMARY
+// session, see Config.Primary.
+func WithStreaming(ctx context.Context, o StreamingOptions) context.Context {
+	if prev, ok := StreamingFrom(ctx); ok {
+		o = prev.Override(o)
+	}
+	return context.WithValue(ctx, streamingKey{}, o)
+}
+
+// StreamingFrom returns the per-dial streaming options WithStreaming put in
+// ctx
+func StreamingFrom(ctx context.Context) (StreamingOptions, bool) {
+	o, ok := ctx.Value(streamingKey{}).(StreamingOptions)
+	return o, ok
+}
+
+// DialOptions are the streaming options a dial with ctx needs that differ
+// from the session's, or nothing if it can dial on the session as it is.
+func (c Config) DialOptions(ctx context.Context) ([]string, error) {
+	o, ok := StreamingFrom(ctx)
+	if !ok {
+		return nil, nil
+	}
+	session := c.Preset.Streaming().Override(c.Streaming)
+	want, err := session.Override(o).SAMOptions()
+	if err != nil {
+		return nil, err
+	}
+	have, _ := session.SAMOptions()
+	if reflect.DeepEqual(want, have) {
+		return nil, nil
+	}
+	return want, nil
+}
@@ -0,0 +1,69 @@
+package i2phelpers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStreamingSAMOptions(t *testing.T) {
+	o := StreamingOptions{
+		Profile:           ProfileInteractive,
+		MaxWindowSize:     Int(64),
+		InitialRTT:        2 * time.Second,
+		ConnectDelay:      -1,
+		InactivityTimeout: 90 * time.Second,
+		MaxConnsPerMinute: Int(0),
+	}
+	opts, err := o.SAMOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"i2p.streaming.profile=2",
+		"i2p.streaming.maxWindowSize=64",
+		"i2p.streaming.initialRTT=2000",
+		"i2p.streaming.connectDelay=-1",
+		"i2p.streaming.inactivityTimeout=90000",
+		"i2p.streaming.maxConnsPerMinute=0",
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("got %v, want %v", opts, want)
+	}
+	if err := (StreamingOptions{Profile: 3, MaxWindowSize: Int(500)}).Validate(); err == nil {
+		t.Error("accepted a bad profile and window")
+	}
+}
+
+func TestDialOptions(t *testing.T) {
+	c := DefaultConfig()
+	c.Preset = BulkTransfer
+	c.Streaming.MaxWindowSize = Int(128)
+	if opts, err := c.DialOptions(context.Background()); err != nil || opts != nil {
+		t.Errorf("plain dial got %v, %v", opts, err)
+	}
+	// asking for what the session has already needs no subsession
+	same := WithStreaming(context.Background(), StreamingOptions{Profile: ProfileBulk})
+	if opts, err := c.DialOptions(same); err != nil || opts != nil {
+		t.Errorf("dial with the session's options got %v, %v", opts, err)
+	}
+	ctx := WithStreaming(context.Background(), StreamingOptions{Profile: ProfileInteractive})
+	ctx = WithStreaming(ctx, StreamingOptions{InitialRTT: time.Second})
+	opts, err := c.DialOptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"i2p.streaming.profile=2",
+		"i2p.streaming.maxWindowSize=128",
+		"i2p.streaming.initialRTT=1000",
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("got %v, want %v", opts, want)
+	}
+	bad := WithStreaming(context.Background(), StreamingOptions{MaxWindowSize: Int(0)})
+	if _, err := c.DialOptions(bad); err == nil {
+		t.Error("accepted a zero window")
+	}
+}
@@ -0,0 +1,268 @@
+package i2phelpers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TunnelOptions are the I2CP options a session's tunnels are built with.
+// Fields left nil or zero aren't sent, so the router's defaults apply. Use Int
+// and Bool to fill the pointer fields in.
+type TunnelOptions struct {
+	// InboundLength and OutboundLength are hops per tunnel, 0 to 7
+	InboundLength  *int
+	OutboundLength *int
+	// InboundQuantity and OutboundQuantity are how many tunnels are kept up,
+	// 1 to 16
+	InboundQuantity  *int
+	OutboundQuantity *int
+	// InboundLengthVariance and OutboundLengthVariance randomize the
+	// length, -7 to 7. Positive values add 0 to n hops, negative ones add
+	// -n to n.
+	InboundLengthVariance  *int
+	OutboundLengthVariance *int
+	// InboundBackupQuantity and OutboundBackupQuantity are spare tunnels
+	// kept ready in case one fails, 0 to 16
+	InboundBackupQuantity  *int
+	OutboundBackupQuantity *int
+
+	// ReduceOnIdle drops to ReduceQuantity tunnels (1 to 16) after
+	// ReduceIdleTime (at least 5 minutes) without traffic
+	ReduceOnIdle   *bool
+	ReduceIdleTime time.Duration
+	ReduceQuantity *int
+	// CloseOnIdle closes the session's tunnels after CloseIdleTime (at least
+	// 5 minutes) without traffic
+	CloseOnIdle   *bool
+	CloseIdleTime time.Duration
+
+	// LeaseSetType is 1 for the original lease set, 3 for LS2, 5 for an
+	// encrypted LS2 or 7 for a meta lease set
+	LeaseSetType *int
+	// LeaseSetEncTypes are the encryption types offered in the lease set,
+	// 0 for ElGamal, 4 for ECIES-X25519 and 5 to 7 for the ML-KEM hybrids
+	LeaseSetEncTypes []int
+	// DontPublishLeaseSet keeps the lease set to ourselves, for sessions
+	// that only ever dial out
+	DontPublishLeaseSet *bool
+
+	// Extra are raw "key=value" options passed on as they are, for anything
+	// not covered above
+	Extra []string
+}
+
+// Int is for filling in TunnelOptions
+func Int(n int) *int {
+	return &n
+}
+
+// Bool is for filling in TunnelOptions
+func Bool(b bool) *bool {
+	return &b
+}
+
+// minIdleTime is the shortest idle time I2P accepts before reducing or
+// closing tunnels
+const minIdleTime = 5 * time.Minute
+
+// tunnelKeys are every inbound.* and outbound.* option I2P knows about, so
+// that a misspelled one in Extra or GarlicOptions isn't silently ignored
+var tunnelKeys = map[string]bool{
+	"length":         true,
+	"lengthVariance": true,
+	"quantity":       true,
+	"backupQuantity": true,
+	"nickname":       true,
+	"priority":       true,
+	"allowZeroHop":   true,
+	"IPRestriction":  true,
+	"randomKey":      true,
+}
+
+// Validate checks every field against the range I2P allows, and reports all
+// of the problems at once.
+func (o TunnelOptions) Validate() error {
+	var problems []string
+	check := func(name string, v *int, min, max int) {
+		if v != nil && (*v < min || *v > max) {
+			problems = append(problems, fmt.Sprintf("%s is %d, it has to be %d to %d", name, *v, min, max))
+		}
+	}
+	check("InboundLength", o.InboundLength, 0, 7)
+	check("OutboundLength", o.OutboundLength, 0, 7)
+	check("InboundQuantity", o.InboundQuantity, 1, 16)
+	check("OutboundQuantity", o.OutboundQuantity, 1, 16)
+	check("InboundLengthVariance", o.InboundLengthVariance, -7, 7)
+	check("OutboundLengthVariance", o.OutboundLengthVariance, -7, 7)
+	check("InboundBackupQuantity", o.InboundBackupQuantity, 0, 16)
+	check("OutboundBackupQuantity", o.OutboundBackupQuantity, 0, 16)
+	check("ReduceQuantity", o.ReduceQuantity, 1, 16)
+	idle := func(name string, d time.Duration, on *bool, flag string) {
+		if d == 0 {
+			return
+		}
+		if on == nil || !*on {
+			problems = append(problems, fmt.Sprintf("%s does nothing without %s", name, flag))
+		}
+		if d < minIdleTime {
+			problems = append(problems, fmt.Sprintf("%s is %s, it has to be at least %s", name, d, minIdleTime))
+		}
+	}
+	idle("ReduceIdleTime", o.ReduceIdleTime, o.ReduceOnIdle, "ReduceOnIdle")
+	idle("CloseIdleTime", o.CloseIdleTime, o.CloseOnIdle, "CloseOnIdle")
+	if o.ReduceQuantity != nil && (o.ReduceOnIdle == nil || !*o.ReduceOnIdle) {
+		problems = append(problems, "ReduceQuantity does nothing without ReduceOnIdle")
+	}
+	if t := o.LeaseSetType; t != nil && *t != 1 && *t != 3 && *t != 5 && *t != 7 {
+		problems = append(problems, fmt.Sprintf("LeaseSetType is %d, it has to be 1, 3, 5 or 7", *t))
+	}
+	for _, e := range o.LeaseSetEncTypes {
+		if e != 0 && (e < 4 || e > 7) {
+			problems = append(problems, fmt.Sprintf("lease set encryption type %d doesn't exist, use 0 or 4 to 7", e))
+		}
+	}
+	if _, err := ParseSAMOptions(o.Extra); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid tunnel options: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Override returns o with every field that's set in with replaced, and with's
+// Extra added to o's
+func (o TunnelOptions) Override(with TunnelOptions) TunnelOptions {
+	ints := []struct{ dst, src **int }{
+		{&o.InboundLength, &with.InboundLength},
+		{&o.OutboundLength, &with.OutboundLength},
+		{&o.InboundQuantity, &with.InboundQuantity},
+		{&o.OutboundQuantity, &with.OutboundQuantity},
+		{&o.InboundLengthVariance, &with.InboundLengthVariance},
+		{&o.OutboundLengthVariance, &with.OutboundLengthVariance},
+		{&o.InboundBackupQuantity, &with.InboundBackupQuantity},
+		{&o.OutboundBackupQuantity, &with.OutboundBackupQuantity},
+		{&o.ReduceQuantity, &with.ReduceQuantity},
+		{&o.LeaseSetType, &with.LeaseSetType},
+	}
+	for _, f := range ints {
+		if *f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+	bools := []struct{ dst, src **bool }{
+		{&o.ReduceOnIdle, &with.ReduceOnIdle},
+		{&o.CloseOnIdle, &with.CloseOnIdle},
+		{&o.DontPublishLeaseSet, &with.DontPublishLeaseSet},
+	}
+	for _, f := range bools {
+		if *f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+	if with.ReduceIdleTime != 0 {
+		o.ReduceIdleTime = with.ReduceIdleTime
+	}
+	if with.CloseIdleTime != 0 {
+		o.CloseIdleTime = with.CloseIdleTime
+	}
+	if with.LeaseSetEncTypes != nil {
+		o.LeaseSetEncTypes = append([]int(nil), with.LeaseSetEncTypes...)
+	}
+	o.Extra = append(append([]string(nil), o.Extra...), with.Extra...)
+	return o
+}
+
+// SAMOptions validates the options and turns them into the "key=value" form
+// SESSION CREATE takes, Extra last.
+func (o TunnelOptions) SAMOptions() ([]string, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	var opts []string
+	num := func(key string, v *int) {
+		if v != nil {
+			opts = append(opts, key+"="+strconv.Itoa(*v))
+		}
+	}
+	flag := func(key string, v *bool) {
+		if v != nil {
+			opts = append(opts, key+"="+strconv.FormatBool(*v))
+		}
+	}
+	millis := func(key string, d time.Duration) {
+		if d != 0 {
+			opts = append(opts, key+"="+strconv.FormatInt(d.Milliseconds(), 10))
+		}
+	}
+	num("inbound.length", o.InboundLength)
+	num("outbound.length", o.OutboundLength)
+	num("inbound.quantity", o.InboundQuantity)
+	num("outbound.quantity", o.OutboundQuantity)
+	num("inbound.lengthVariance", o.InboundLengthVariance)
+	num("outbound.lengthVariance", o.OutboundLengthVariance)
+	num("inbound.backupQuantity", o.InboundBackupQuantity)
+	num("outbound.backupQuantity", o.OutboundBackupQuantity)
+	flag("i2cp.reduceOnIdle", o.ReduceOnIdle)
+	millis("i2cp.reduceIdleTime", o.ReduceIdleTime)
+	num("i2cp.reduceQuantity", o.ReduceQuantity)
+	flag("i2cp.closeOnIdle", o.CloseOnIdle)
+	millis("i2cp.closeIdleTime", o.CloseIdleTime)
+	num("i2cp.leaseSetType", o.LeaseSetType)
+	if len(o.LeaseSetEncTypes) > 0 {
+		var types []string
+		for _, e := range o.LeaseSetEncTypes {
+			types = append(types, strconv.Itoa(e))
+		}
+		opts = append(opts, "i2cp.leaseSetEncType="+strings.Join(types, ","))
+	}
+	flag("i2cp.dontPublishLeaseSet", o.DontPublishLeaseSet)
+	return MergeSAMOptions(opts, o.Extra)
+}
+
+// ParseSAMOptions splits raw "key=value" options into a map, complaining
+// about anything that isn't key=value, inbound.* and outbound.* options I2P
+// doesn't have, and the same key given twice with different values.
+func ParseSAMOptions(opts []string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("option %q should be key=value", opt)
+		}
+		key, value := kv[0], kv[1]
+		for _, prefix := range []string{"inbound.", "outbound."} {
+			if strings.HasPrefix(key, prefix) && !tunnelKeys[strings.TrimPrefix(key, prefix)] {
+				return nil, fmt.Errorf("unknown tunnel option %q", key)
+			}
+		}
+		if old, ok := m[key]; ok && old != value {
+			return nil, fmt.Errorf("option %s is set to both %q and %q", key, old, value)
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+// MergeSAMOptions puts lists of raw options together, dropping repeats and
+// failing if two of them set the same key to different values.
+func MergeSAMOptions(lists ...[]string) ([]string, error) {
+	var all []string
+	for _, l := range lists {
+		all = append(all, l...)
+	}
+	if _, err := ParseSAMOptions(all); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	merged := []string{}
+	for _, opt := range all {
+		if !seen[opt] {
+			seen[opt] = true
+			merged = append(merged, opt)
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,149 @@
+package i2phelpers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTunnelOptionsSAMOptions(t *testing.T) {
+	o := TunnelOptions{
+		InboundLength:    Int(0),
+		OutboundLength:   Int(2),
+		InboundQuantity:  Int(4),
+		ReduceOnIdle:     Bool(true),
+		ReduceIdleTime:   10 * time.Minute,
+		ReduceQuantity:   Int(1),
+		LeaseSetType:     Int(3),
+		LeaseSetEncTypes: []int{4, 0},
+		Extra:            []string{"inbound.nickname=garlic"},
+	}
+	opts, err := o.SAMOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"inbound.length=0",
+		"outbound.length=2",
+		"inbound.quantity=4",
+		"i2cp.reduceOnIdle=true",
+		"i2cp.reduceIdleTime=600000",
+		"i2cp.reduceQuantity=1",
+		"i2cp.leaseSetType=3",
+		"i2cp.leaseSetEncType=4,0",
+		"inbound.nickname=garlic",
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("got %v, want %v", opts, want)
+	}
+	if opts, _ := (TunnelOptions{}).SAMOptions(); len(opts) != 0 {
+		t.Errorf("empty options gave %v", opts)
+	}
+}
+
+func TestTunnelOptionsValidate(t *testing.T) {
+	o := TunnelOptions{
+		InboundLength:    Int(8),
+		OutboundQuantity: Int(0),
+		CloseIdleTime:    time.Minute,
+		LeaseSetType:     Int(2),
+	}
+	err := o.Validate()
+	if err == nil {
+		t.Fatal("accepted out of range options")
+	}
+	for _, want := range []string{"InboundLength", "OutboundQuantity", "CloseOnIdle", "at least", "LeaseSetType"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q doesn't mention %s", err, want)
+		}
+	}
+}
+
+func TestParseSAMOptions(t *testing.T) {
+	for _, bad := range [][]string{
+		{"inbound.lenght=3"},
+		{"inbound.length"},
+		{"inbound.length=3", "inbound.length=2"},
+	} {
+		if _, err := ParseSAMOptions(bad); err == nil {
+			t.Errorf("accepted %v", bad)
+		}
+	}
+	if _, err := ParseSAMOptions([]string{"inbound.length=3", "inbound.length=3", "i2cp.gzip=false"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSessionOptionsConflict(t *testing.T) {
+	c := DefaultConfig()
+	c.Tunnel.InboundLength = Int(3)
+	c.Options = []string{"inbound.length=1"}
+	if err := c.Check(); err == nil || !strings.Contains(err.Error(), "inbound.length") {
+		t.Errorf("got %v, want a conflict on inbound.length", err)
+	}
+	c.Options = []string{"inbound.length=3", "i2cp.gzip=false"}
+	opts, err := c.SessionOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"inbound.length=3", "i2cp.gzip=false"}; !reflect.DeepEqual(opts, want) {
+		t.Errorf("got %v, want %v", opts, want)
+	}
+}
+
+func TestSessionOptionsClientOnly(t *testing.T) {
+	c := DefaultConfig()
+	c.ClientOnly = true
+	opts, err := c.SessionOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"i2cp.dontPublishLeaseSet=true"}; !reflect.DeepEqual(opts, want) {
+		t.Errorf("got %v, want %v", opts, want)
+	}
+	c.Tunnel.DontPublishLeaseSet = Bool(false)
+	if err := c.Check(); err == nil {
+		t.Error("client-only mode publishing its lease set accepted")
+	}
+}
+
+func TestIsolatedOptions(t *testing.T) {
+	c := DefaultConfig()
+	c.Tunnel.DontPublishLeaseSet = Bool(false)
+	c.Options = []string{"i2cp.dontPublishLeaseSet=false", "inbound.length=2"}
+	opts, err := c.IsolatedOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"i2cp.dontPublishLeaseSet=true", "inbound.length=2"}; !reflect.DeepEqual(opts, want) {
+		t.Errorf("got %v, want %v", opts, want)
+	}
+}
+
+func TestPoolSessionOptions(t *testing.T) {
+	c := DefaultConfig()
+	c.Tunnel.OutboundLength = Int(2)
+	c.Options = []string{"inbound.quantity=4"}
+	c.Pool.Tunnel = TunnelOptions{InboundLength: Int(1), InboundQuantity: Int(1)}
+	if err := c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := c.PoolSessionOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(opts, " ")
+	for _, want := range []string{"inbound.length=1", "inbound.quantity=1", "outbound.length=2", "i2cp.dontPublishLeaseSet=true"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s missing from %s", want, got)
+		}
+	}
+	if strings.Contains(got, "inbound.quantity=4") {
+		t.Errorf("raw option beat the pool's own: %s", got)
+	}
+	c.Pool.Size = -1
+	if err := c.Check(); err == nil {
+		t.Error("negative pool size accepted")
+	}
+}
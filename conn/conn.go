@@ -3,8 +3,10 @@ package i2ptcpconn
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
-	"reflect"
+	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/mux"
 	network "github.com/libp2p/go-libp2p-core/network"
@@ -12,90 +14,136 @@ import (
 	tpt "github.com/libp2p/go-libp2p-core/transport"
 	ma "github.com/multiformats/go-multiaddr"
 
+	"github.com/RTradeLtd/go-garlic-tcp-transport/bridge"
 	"github.com/RTradeLtd/go-garlic-tcp-transport/codec"
 	"github.com/RTradeLtd/go-garlic-tcp-transport/common"
-	"github.com/eyedeekay/sam3"
 	"github.com/eyedeekay/sam3/i2pkeys"
 )
 
 // GarlicTCPConn implements a Conn interface
 type GarlicTCPConn struct {
-	*sam3.SAMConn
-	*sam3.SAM
-	*sam3.StreamSession
-	*sam3.StreamListener
-	i2pkeys.I2PKeys
+	*i2pbridge.SAMConn
 	network.ConnSecurity
 
+	// supervisor keeps the session up, every connection made from the
+	// same transport shares it. listener is only set on listeners, and
+	// SAMConn only on dialed or accepted streams.
+	supervisor *i2pbridge.Supervisor
+	listener   *i2pbridge.Listener
+	dir        network.Direction
+	// dialer and peers are where dials go instead of the supervisor's
+	// session, depending on config.Isolation, see NewDialers
+	dialer *i2pbridge.Supervisor
+	peers  *i2pbridge.PeerSessions
+
+	// keys are the private keys given with Keys, or just the address once
+	// they've been loaded and wiped, shared with the connections made from
+	// this one and guarded by keysMu. source is the copy the supervisor makes
+	// sessions with. WipeKeys wipes both, but the copies sam3's key types and
+	// SESSION CREATE need are strings, which can't be wiped.
+	keysMu *sync.Mutex
+	keys   *i2phelpers.PrivateKeys
+	source i2phelpers.PrivateKeys
+	// lockKeys, if set, is called before keys are loaded from the keys path
+	// or made, see KeysLock
+	lockKeys func() error
+
 	parentTransport tpt.Transport
 
-	onlyGarlic    bool
-	garlicOptions []string
+	// config is only changed after the connection is made by the transport,
+	// through Config, under configMu. See settings.
+	configMu *sync.RWMutex
+	config   i2phelpers.Config
 }
 
 var gc tpt.CapableConn = &GarlicTCPConn{}
 
-func (t *GarlicTCPConn) keysPath() string {
-	if t.parentTransport != nil {
-		x := reflect.TypeOf(t.parentTransport)
-		if x.String() == "i2ptcp.GarlicTCPTransport" {
-			if _, b := x.FieldByName("keysPath"); b {
-				return reflect.ValueOf(t.parentTransport).FieldByName("keysPath").String()
-			}
-		}
+// startTimeout is how long ListenI2P waits for the session to come up
+const startTimeout = 2 * time.Minute
+
+// settings is the connection's config as it is now
+func (t *GarlicTCPConn) settings() i2phelpers.Config {
+	if t.configMu == nil {
+		return t.config
 	}
-	return "127.0.0.1"
+	t.configMu.RLock()
+	defer t.configMu.RUnlock()
+	return t.config
 }
 
-// SAMHost returns the IP address of the configured SAM bridge
+func (t *GarlicTCPConn) keysPath() string {
+	return t.settings().KeysPath
+}
+
+// SAMHost returns the host of the configured SAM bridge
 func (t *GarlicTCPConn) SAMHost() string {
-	if t.parentTransport != nil {
-		x := reflect.TypeOf(t.parentTransport)
-		if x.String() == "i2ptcp.GarlicTCPTransport" {
-			if _, b := x.FieldByName("HostSAM"); b {
-				return reflect.ValueOf(t.parentTransport).FieldByName("HostSAM").String()
-			}
-		}
-	}
-	return "127.0.0.1"
+	return t.settings().SAMHost
 }
 
 // SAMPort returns the Port of the configured SAM bridge
 func (t *GarlicTCPConn) SAMPort() string {
-	if t.parentTransport != nil {
-		x := reflect.TypeOf(t.parentTransport)
-		if x.String() == "i2ptcp.GarlicTCPTransport" {
-			if _, b := x.FieldByName("PortSAM"); b {
-				return reflect.ValueOf(t.parentTransport).FieldByName("PortSAM").String()
-			}
-		}
-	}
-	return "7656"
+	return t.settings().SAMPort
 }
 
 // SAMAddress combines them and returns a full address.
 func (t *GarlicTCPConn) SAMAddress() string {
-	rt := t.SAMHost() + ":" + t.SAMPort()
-	fmt.Println(rt)
-	return rt
+	return t.settings().SAMAddress()
 }
 
-func (t *GarlicTCPConn) i2pkey() i2pkeys.I2PKeys {
-	if t.I2PKeys.String() == "" {
-		t.I2PKeys, _ = t.GetI2PKeys()
+// addr returns our destination, loading the keys if we don't know it yet. In
+// client-only mode it's the current session's.
+func (t *GarlicTCPConn) addr() i2pkeys.I2PAddr {
+	if t.settings().ClientOnly {
+		return t.supervisor.Addr()
+	}
+	if k := t.currentKeys(); !k.IsZero() {
+		return k.Addr()
+	}
+	keys, err := t.GetI2PKeys()
+	if err != nil {
+		return ""
+	}
+	k, err := i2phelpers.NewPrivateKeys(keys)
+	if err != nil {
+		return ""
+	}
+	k.Wipe()
+	t.keysMu.Lock()
+	defer t.keysMu.Unlock()
+	if t.keys.IsZero() {
+		*t.keys = k
 	}
-	return t.I2PKeys
+	return t.keys.Addr()
+}
+
+// initKeys makes sure there's somewhere to keep the keys, for connections
+// that weren't given any
+func (t *GarlicTCPConn) initKeys() {
+	if t.keysMu == nil {
+		t.keysMu = new(sync.Mutex)
+	}
+	if t.keys == nil {
+		t.keys = new(i2phelpers.PrivateKeys)
+	}
+}
+
+// currentKeys is what we know of our keys so far
+func (t *GarlicTCPConn) currentKeys() i2phelpers.PrivateKeys {
+	t.keysMu.Lock()
+	defer t.keysMu.Unlock()
+	return *t.keys
 }
 
 // PrintOptions returns the options passed to the SAM bridge as a slice of
 // strings.
 func (t *GarlicTCPConn) PrintOptions() []string {
-	return t.garlicOptions
+	opts, _ := t.settings().SessionOptions()
+	return opts
 }
 
 // MaBase64 gives us a multiaddr by converting an I2PAddr
 func (t *GarlicTCPConn) MA() ma.Multiaddr {
-	r, err := i2ptcpcodec.FromI2PNetAddrToMultiaddr(t.i2pkey().Addr())
+	r, err := i2ptcpcodec.FromI2PNetAddrToMultiaddr(t.addr())
 	if err != nil {
 		panic("Critical address error! There is no way this should have occurred" + err.Error())
 	}
@@ -114,12 +162,31 @@ func (t *GarlicTCPConn) RemoteMA() ma.Multiaddr {
 // Base32 returns the remotely-accessible base32 address of the gateway over i2p
 // this is the one you want to use to visit it in the browser.
 func (t *GarlicTCPConn) Base32() string {
-	return t.i2pkey().Addr().Base32()
+	return t.addr().Base32()
 }
 
 // Base64 returns the remotely-accessible base64 address of the gateway over I2P
 func (t *GarlicTCPConn) Base64() string {
-	return t.i2pkey().Addr().Base64()
+	return t.addr().Base64()
+}
+
+// Sign signs data with the private key of our destination, so that anyone who
+// knows our garlic address can check that we wrote it.
+func (t *GarlicTCPConn) Sign(data []byte) ([]byte, error) {
+	if k := t.currentKeys(); k.HasPrivate() {
+		return k.Sign(data)
+	}
+	keys, err := t.GetI2PKeys()
+	if err != nil {
+		return nil, err
+	}
+	return i2phelpers.SignData(keys, data)
+}
+
+// Verify checks that sig is a signature over data by the destination dest. It
+// only returns an error if dest or sig are malformed.
+func Verify(dest i2pkeys.I2PAddr, data, sig []byte) (bool, error) {
+	return i2phelpers.VerifyData(dest, data, sig)
 }
 
 // Transport returns the GarlicTCPTransport to which the GarlicTCPConn belongs
@@ -127,13 +194,56 @@ func (t *GarlicTCPConn) Transport() tpt.Transport {
 	return t.parentTransport
 }
 
-// IsClosed says a connection is closed if t.StreamSession is nil because
-// Close() nils it if it works. Might need to re-visit that.
+// ID returns the name of the current SAM session, or nothing if it's down
+func (t *GarlicTCPConn) ID() string {
+	if t.supervisor == nil {
+		return ""
+	}
+	if ss := t.supervisor.Current(); ss != nil {
+		return ss.ID()
+	}
+	return ""
+}
+
+// Start connects to the SAM bridge and waits for the session. It's optional,
+// the first dial or listen does it otherwise. Sessions for isolated dials
+// start being built too, but aren't waited for.
+func (t *GarlicTCPConn) Start(ctx context.Context) error {
+	if err := t.supervisor.Start(ctx); err != nil {
+		return err
+	}
+	if t.dialer != nil {
+		go t.dialer.Start(context.Background())
+	}
+	if t.peers != nil {
+		t.peers.Start()
+	}
+	return nil
+}
+
+// Supervisor returns what keeps the connection's SAM session up
+func (t *GarlicTCPConn) Supervisor() *i2pbridge.Supervisor {
+	return t.supervisor
+}
+
+// IsClosed says whether the session behind the connection has been closed
 func (t *GarlicTCPConn) IsClosed() bool {
-	if t.StreamSession == nil {
-		return true
+	return t.supervisor == nil || t.supervisor.Status() == i2pbridge.StatusClosed
+}
+
+// child is a connection sharing our session, for a stream or a listener
+func (t *GarlicTCPConn) child(dir network.Direction) *GarlicTCPConn {
+	return &GarlicTCPConn{
+		supervisor:      t.supervisor,
+		dialer:          t.dialer,
+		peers:           t.peers,
+		dir:             dir,
+		keysMu:          t.keysMu,
+		keys:            t.keys,
+		lockKeys:        t.lockKeys,
+		parentTransport: t.parentTransport,
+		config:          t.settings(),
 	}
-	return false
 }
 
 // AcceptStream lets us streammux
@@ -149,21 +259,47 @@ func (t *GarlicTCPConn) Dial(c context.Context, m ma.Multiaddr, p peer.ID) (tpt.
 
 // DialI2P helps with Dial and returns a GarlicTCPConn
 func (t *GarlicTCPConn) DialI2P(c context.Context, m ma.Multiaddr, p peer.ID) (*GarlicTCPConn, error) {
-	var err error
-	t.SAMConn, err = t.StreamSession.DialContextI2P(c, "", m.String())
+	dest, err := m.ValueForProtocol(ma.P_GARLIC64)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a garlic64 address: %s", m, err)
+	}
+	// streaming options set on c with i2phelpers.WithStreaming
+	opts, err := t.settings().DialOptions(c)
 	if err != nil {
 		return nil, err
 	}
-	return t, nil
+	conn := t.child(network.DirOutbound)
+	switch {
+	case t.peers != nil:
+		key := dest
+		if p != "" {
+			key = p.Pretty()
+		}
+		conn.SAMConn, err = t.peers.DialWith(c, key, opts, dest)
+	case t.dialer != nil:
+		conn.SAMConn, err = t.dialer.DialWith(c, opts, dest)
+	default:
+		conn.SAMConn, err = t.supervisor.DialWith(c, opts, dest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
 }
 
 // OpenStream lets us streammux
 func (t *GarlicTCPConn) OpenStream() (mux.MuxedStream, error) {
-	return t.DialI2P(nil, t.RemoteMultiaddr(), t.RemotePeer())
+	return t.DialI2P(context.Background(), t.RemoteMultiaddr(), t.RemotePeer())
 }
 
-// LocalMultiaddr returns the local multiaddr for this connection
+// LocalMultiaddr returns the local multiaddr for this connection. Streams
+// dialed from an isolated session have a destination of their own.
 func (t *GarlicTCPConn) LocalMultiaddr() ma.Multiaddr {
+	if t.SAMConn != nil && t.dir == network.DirOutbound {
+		if r, err := i2ptcpcodec.FromI2PNetAddrToMultiaddr(t.SAMConn.LocalAddr().(i2pkeys.I2PAddr)); err == nil {
+			return r
+		}
+	}
 	return t.MA()
 }
 
@@ -172,9 +308,24 @@ func (t *GarlicTCPConn) RemoteMultiaddr() ma.Multiaddr {
 	return t.RemoteMA()
 }
 
-// Close ends a SAM session associated with a transport
+// Close closes a stream or stops a listener. A connection that is neither
+// owns the session, and closing it ends the session and any isolated ones.
 func (t *GarlicTCPConn) Close() error {
-	//return t.SAMConn.Close()
+	switch {
+	case t.SAMConn != nil:
+		return t.SAMConn.Close()
+	case t.listener != nil:
+		return t.listener.Close()
+	}
+	if t.dialer != nil {
+		t.dialer.Close()
+	}
+	if t.peers != nil {
+		t.peers.Close()
+	}
+	if t.supervisor != nil {
+		return t.supervisor.Close()
+	}
 	return nil
 }
 
@@ -183,12 +334,51 @@ func (t *GarlicTCPConn) Reset() error {
 	return t.Close()
 }
 
-// GetI2PKeys loads the i2p address keys and returns them.
+// GetI2PKeys loads the i2p address keys and returns them. There are none to
+// give out in client-only mode.
 func (t *GarlicTCPConn) GetI2PKeys() (i2pkeys.I2PKeys, error) {
-	if t.I2PKeys.String() == "" {
-		return i2phelpers.LoadKeys(t.keysPath())
+	cfg := t.settings()
+	if cfg.ClientOnly {
+		return i2pkeys.I2PKeys{}, fmt.Errorf("client-only mode has no stored keys, the bridge keeps the transient ones")
+	}
+	if k := t.currentKeys(); k.HasPrivate() {
+		return k.Keys(), nil
 	}
-	return t.I2PKeys, nil
+	// the keys on disk may be made here, they have to be ours first
+	if t.lockKeys != nil {
+		if err := t.lockKeys(); err != nil {
+			return i2pkeys.I2PKeys{}, err
+		}
+	}
+	return i2phelpers.LoadOrCreateKeys(cfg.KeysPath, cfg.Bridge())
+}
+
+// WipeKeys zeroes any private keys the connection is holding on to. The
+// address is kept. Keys from the keys path are loaded again if they're needed,
+// but once keys given with Keys are wiped no new session can be made.
+func (t *GarlicTCPConn) WipeKeys() {
+	t.keysMu.Lock()
+	t.keys.Wipe()
+	t.keysMu.Unlock()
+	t.source.Wipe()
+}
+
+// String describes the connection by its b32 address, never its keys
+func (t GarlicTCPConn) String() string {
+	if t.keysMu == nil {
+		return "GarlicTCPConn()"
+	}
+	k := t.currentKeys()
+	if k.IsZero() {
+		return "GarlicTCPConn()"
+	}
+	return "GarlicTCPConn(" + k.Addr().Base32() + ")"
+}
+
+// Format makes sure every fmt verb goes through String, so that not even %#v
+// can print the fields holding key material.
+func (t GarlicTCPConn) Format(f fmt.State, verb rune) {
+	io.WriteString(f, t.String())
 }
 
 // Accept implements a listener
@@ -198,12 +388,16 @@ func (t *GarlicTCPConn) Accept() (tpt.CapableConn, error) {
 
 // AcceptI2P helps with Accept
 func (t *GarlicTCPConn) AcceptI2P() (*GarlicTCPConn, error) {
+	if t.listener == nil {
+		return nil, fmt.Errorf("not listening, call ListenI2P first")
+	}
+	conn := t.child(network.DirInbound)
 	var err error
-	t.SAMConn, err = t.StreamListener.AcceptI2P()
+	conn.SAMConn, err = t.listener.AcceptI2P()
 	if err != nil {
 		return nil, err
 	}
-	return t, nil
+	return conn, nil
 }
 
 // Listen implements a listener
@@ -211,19 +405,29 @@ func (t *GarlicTCPConn) Listen() (tpt.CapableConn, error) {
 	return t.ListenI2P()
 }
 
-// ListenI2P helps with Listen
+// ListenI2P starts accepting streams on the session. The listener carries on
+// across new sessions if the SAM bridge has to be reconnected.
 func (t *GarlicTCPConn) ListenI2P() (*GarlicTCPConn, error) {
-	var err error
-	t.StreamListener, err = t.StreamSession.Listen()
+	if t.settings().ClientOnly {
+		return nil, i2phelpers.ErrClientOnly
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	if err := t.Start(ctx); err != nil {
+		return nil, err
+	}
+	l, err := t.supervisor.Listen()
 	if err != nil {
 		return nil, err
 	}
-	return t, nil
+	conn := t.child(network.DirUnknown)
+	conn.listener = l
+	return conn, nil
 }
 
 // Addr returns the net.Addr version of the local Multiaddr
 func (t *GarlicTCPConn) Addr() net.Addr {
-	return t.i2pkey().Addr()
+	return t.addr()
 }
 
 // Multiaddr returns the local Multiaddr
@@ -233,16 +437,8 @@ func (t *GarlicTCPConn) Multiaddr() ma.Multiaddr {
 
 // Stat returns the local Multiaddr
 func (t *GarlicTCPConn) Stat() network.Stat {
-	var dir network.Direction
-	if t.StreamListener == nil {
-		dir = network.DirOutbound
-	} else if t.SAMConn != nil {
-		dir = network.DirInbound
-	} else {
-		dir = network.DirUnknown
-	}
 	return network.Stat{
-		Direction: dir,
+		Direction: t.dir,
 	}
 }
 
@@ -255,32 +451,90 @@ func NewGarlicTCPConn(transport tpt.Transport, onlyGarlic bool, options []string
 	)
 }
 
-// NewGarlicTCPConnFromOptions creates a GarlicTCPConn using function arguments
+// NewGarlicTCPConnFromOptions creates a GarlicTCPConn using function
+// arguments. It only sets things up, the SAM bridge isn't contacted until the
+// first dial or listen, or Start.
 func NewGarlicTCPConnFromOptions(opts ...func(*GarlicTCPConn) error) (*GarlicTCPConn, error) {
 	var t GarlicTCPConn
-	t.onlyGarlic = false
-	t.garlicOptions = []string{}
+	t.config = i2phelpers.DefaultConfig()
 	t.parentTransport = nil
 	for _, o := range opts {
 		if err := o(&t); err != nil {
 			return nil, err
 		}
 	}
-	var err error
-	if t.parentTransport == nil {
-		return nil, fmt.Errorf("Parent transport must be set")
-	}
-	t.SAM, err = sam3.NewSAM(t.SAMAddress())
-	if err != nil {
+	t.initKeys()
+	if err := t.config.Check(); err != nil {
 		return nil, err
 	}
-	t.I2PKeys, err = t.GetI2PKeys()
-	if err != nil {
-		return nil, err
+	if t.config.ClientOnly && t.keys.HasPrivate() {
+		return nil, fmt.Errorf("client-only connections use transient keys, they can't be given Keys")
 	}
-	t.StreamSession, err = t.SAM.NewStreamSession(i2phelpers.RandTunName(), t.I2PKeys, t.PrintOptions())
-	if err != nil {
+	if t.supervisor != nil {
+		return &t, nil
+	}
+	// a copy of its own, so that nothing done to t.keys changes the keys
+	// sessions are made with
+	t.source = t.keys.Clone()
+	t.supervisor = i2pbridge.NewSupervisor(t.config.Bridges(), KeySource(t.config, t.source), t.PrintOptions())
+	t.config.Idle.Supervise(t.supervisor)
+	t.supervisor.Primary = t.config.Primary
+	var err error
+	if t.dialer, t.peers, err = NewDialers(t.config); err != nil {
 		return nil, err
 	}
 	return &t, nil
 }
+
+// NewDialers sets up the sessions dials go out through under cfg.Isolation: a
+// supervised session with a transient destination for IsolationSeparate, or
+// per-peer sessions from a pre-warmed pool for IsolationPerPeer. With
+// IsolationShared dials use the main session, and both are nil.
+func NewDialers(cfg i2phelpers.Config) (*i2pbridge.Supervisor, *i2pbridge.PeerSessions, error) {
+	if cfg.Isolation == i2phelpers.IsolationShared {
+		return nil, nil, nil
+	}
+	if cfg.Isolation == i2phelpers.IsolationSeparate {
+		options, err := cfg.IsolatedOptions()
+		if err != nil {
+			return nil, nil, err
+		}
+		dialer := i2pbridge.NewSupervisor(cfg.Bridges(), i2pbridge.Transient, options)
+		cfg.Idle.Supervise(dialer)
+		dialer.Primary = cfg.Primary
+		return dialer, nil, nil
+	}
+	options, err := cfg.PoolSessionOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := i2pbridge.NewSessionPool(cfg.Bridges(), cfg.Pool.PoolSize(), options)
+	pool.Primary = cfg.Primary
+	return nil, i2pbridge.NewPeerSessions(pool, cfg.Pool.Peers()), nil
+}
+
+// KeySource gives a supervisor the keys for a session: keys, if they were
+// handed over already, otherwise whatever is stored under cfg.KeysPath, made
+// on the SAM bridge in use if there's nothing there yet. Stored keys are read
+// afresh for each session so they don't have to stay in memory, and whichever
+// bridge the session ends up on, it has the same destination. In client-only
+// mode it's always a transient destination.
+func KeySource(cfg i2phelpers.Config, keys i2phelpers.PrivateKeys) i2pbridge.KeySource {
+	if cfg.ClientOnly {
+		return i2pbridge.Transient
+	}
+	if keys.HasPrivate() {
+		// keys is shared with the caller, once they wipe it there are no
+		// keys to make sessions with, rather than the all zero ones
+		return func(*i2pbridge.Bridge) (i2pkeys.I2PKeys, error) {
+			k := keys.Keys()
+			if k.String() == "" {
+				return i2pkeys.I2PKeys{}, fmt.Errorf("%w: the private keys for %s have been wiped", i2pbridge.ErrInvalidKey, keys.Addr().Base32())
+			}
+			return k, nil
+		}
+	}
+	return func(b *i2pbridge.Bridge) (i2pkeys.I2PKeys, error) {
+		return i2phelpers.LoadOrCreateKeys(cfg.KeysPath, b)
+	}
+}
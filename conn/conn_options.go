@@ -1,10 +1,14 @@
 package i2ptcpconn
 
 import (
-	"fmt"
+	"sync"
 
 	//peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/eyedeekay/sam3/i2pkeys"
 	tpt "github.com/libp2p/go-libp2p-transport"
+
+	"github.com/RTradeLtd/go-garlic-tcp-transport/bridge"
+	"github.com/RTradeLtd/go-garlic-tcp-transport/common"
 )
 
 // Option is a functional argument to the connection constructor
@@ -18,13 +22,125 @@ func Transport(t tpt.Transport) func(*GarlicTCPConn) error {
 	}
 }
 
-//SAMPass sets the password to use when authenticating to the SAM bridge. It's
-//ignored for now, and will return an error if it recieves a non-empty string.
+//Config sets everything the connection needs to reach the SAM bridge and find
+//its keys in one go. The transport uses it to hand its own settings down, and
+//again when they change.
+func Config(cfg i2phelpers.Config) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		if c.configMu == nil {
+			c.configMu = new(sync.RWMutex)
+		}
+		c.configMu.Lock()
+		defer c.configMu.Unlock()
+		c.config = cfg.Copy()
+		return nil
+	}
+}
+
+//Supervisor makes the connection share a session that's already supervised,
+//instead of starting its own. The transport uses it so that all of its
+//connections go through one session.
+func Supervisor(s *i2pbridge.Supervisor) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		c.supervisor = s
+		return nil
+	}
+}
+
+//Dialers makes the connection dial through sessions that are already set up
+//for its isolation policy, see NewDialers. Either can be nil.
+func Dialers(dialer *i2pbridge.Supervisor, peers *i2pbridge.PeerSessions) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		c.dialer = dialer
+		c.peers = peers
+		return nil
+	}
+}
+
+//Isolation sets which destination dials come from, see i2phelpers.Isolation
+func Isolation(i i2phelpers.Isolation) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		c.config.Isolation = i
+		return nil
+	}
+}
+
+//SessionPool sets up the pool IsolationPerPeer takes sessions from
+func SessionPool(o i2phelpers.PoolOptions) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		if err := o.Validate(); err != nil {
+			return err
+		}
+		c.config.Pool = o
+		return nil
+	}
+}
+
+//IdlePolicy sets what happens to an unused session, see i2phelpers.IdlePolicy
+func IdlePolicy(p i2phelpers.IdlePolicy) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		c.config.Idle = p
+		return nil
+	}
+}
+
+//SAMAddress sets the SAM bridge to use, in any form i2phelpers.ParseSAMAddress
+//accepts.
+func SAMAddress(s string) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		return c.config.SetSAMAddress(s)
+	}
+}
+
+//SAMHost sets the host of the SAM bridge, the same as SAMAddress
+func SAMHost(s string) func(*GarlicTCPConn) error {
+	return SAMAddress(s)
+}
+
+//SAMPort sets the port of the SAM bridge
+func SAMPort(s string) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		return c.config.SetSAMPort(s)
+	}
+}
+
+//KeysPath sets the path to the keys, if no keys are present, they will be generated.
+func KeysPath(s string) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		c.config.KeysPath = s
+		return nil
+	}
+}
+
+//SAMUser sets the user to authenticate to the SAM bridge as
+func SAMUser(s string) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		c.config.SAMUser = s
+		return nil
+	}
+}
+
+//SAMPass sets the password to use when authenticating to the SAM bridge. It
+//goes with SAMUser, SAM 3.2 authentication needs both.
 func SAMPass(s string) func(*GarlicTCPConn) error {
 	return func(c *GarlicTCPConn) error {
-		if s != "" {
-			return fmt.Errorf("SAMPass is unused for now, pass no argument(or empty string). Failing closed")
+		c.config.SAMPass = s
+		return nil
+	}
+}
+
+//SAMTLS talks to the SAM bridge over TLS, trusting a CA from the PEM file
+//caFile or pinning certificate fingerprints, see i2phelpers.SAMTLSConfig.
+func SAMTLS(caFile string, fingerprints ...string) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		cfg, err := i2phelpers.SAMTLSConfig(caFile, fingerprints...)
+		if err != nil {
+			return err
 		}
+		c.config.SAMTLS = cfg
 		return nil
 	}
 }
@@ -33,7 +149,71 @@ func SAMPass(s string) func(*GarlicTCPConn) error {
 //connections. It does nothing but indicate that for now.
 func OnlyGarlic(b bool) func(*GarlicTCPConn) error {
 	return func(c *GarlicTCPConn) error {
-		c.onlyGarlic = b
+		c.config.OnlyGarlic = b
+		return nil
+	}
+}
+
+//ClientOnly only dials out, from a transient destination, see
+//i2phelpers.Config.ClientOnly
+func ClientOnly() func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		c.config.ClientOnly = true
+		return nil
+	}
+}
+
+// Keys sets the keys the connection will use instead of loading them from the
+// keys path.
+func Keys(k i2pkeys.I2PKeys) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		keys, err := i2phelpers.NewPrivateKeys(k)
+		if err != nil {
+			return err
+		}
+		c.keys = &keys
+		return nil
+	}
+}
+
+//KeysLock has the connection call lock before it loads keys from the keys
+//path, or makes them there. The transport uses it so that its connections
+//take its lock on the keys first.
+func KeysLock(lock func() error) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		c.initKeys()
+		c.lockKeys = lock
+		return nil
+	}
+}
+
+//TunnelOptions sets typed I2CP options for the session's tunnels
+func TunnelOptions(o i2phelpers.TunnelOptions) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		if err := o.Validate(); err != nil {
+			return err
+		}
+		c.config.Tunnel = c.config.Tunnel.Override(o)
+		return nil
+	}
+}
+
+//PrimarySession makes the session a PRIMARY one if the SAM bridge speaks SAM
+//3.3, see i2phelpers.Config.Primary
+func PrimarySession() func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		c.config.Primary = true
+		return nil
+	}
+}
+
+//StreamingOptions sets typed streaming library options for the session
+func StreamingOptions(o i2phelpers.StreamingOptions) func(*GarlicTCPConn) error {
+	return func(c *GarlicTCPConn) error {
+		if err := o.Validate(); err != nil {
+			return err
+		}
+		c.config.Streaming = c.config.Streaming.Override(o)
 		return nil
 	}
 }
@@ -42,7 +222,7 @@ func OnlyGarlic(b bool) func(*GarlicTCPConn) error {
 func GarlicOptions(s []string) func(*GarlicTCPConn) error {
 	return func(c *GarlicTCPConn) error {
 		for _, v := range s {
-			c.garlicOptions = append(c.garlicOptions, v)
+			c.config.Options = append(c.config.Options, v)
 		}
 		return nil
 	}
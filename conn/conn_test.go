@@ -3,6 +3,8 @@ package i2ptcpconn
 import (
 	"log"
 	"testing"
+
+	"github.com/RTradeLtd/go-garlic-tcp-transport/common"
 )
 
 func TestGarlicTransport(t *testing.T) {
@@ -42,3 +44,26 @@ func TestGarlicTransportMaStrings(t *testing.T) {
 	log.Println(listener.ID())
 	log.Println(listener.Base64())
 }
+
+func TestConfigOption(t *testing.T) {
+	cfg := i2phelpers.DefaultConfig()
+	if err := cfg.SetSAMAddress("/dns4/i2p-router/tcp/7000"); err != nil {
+		t.Fatal(err)
+	}
+	cfg.KeysPath = "node.i2pkeys"
+	cfg.Options = []string{"inbound.length=2"}
+	var conn GarlicTCPConn
+	if err := Config(cfg)(&conn); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Options[0] = "inbound.length=0"
+	if a := conn.SAMAddress(); a != "i2p-router:7000" {
+		t.Errorf("got SAM address %s", a)
+	}
+	if p := conn.keysPath(); p != "node.i2pkeys" {
+		t.Errorf("got keys path %s", p)
+	}
+	if o := conn.PrintOptions(); len(o) != 1 || o[0] != "inbound.length=2" {
+		t.Errorf("options are shared with the caller: %v", o)
+	}
+}
@@ -2,13 +2,18 @@ package i2ptcp
 
 import (
 	"context"
-	"strings"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
 
 	peer "github.com/libp2p/go-libp2p-peer"
 
 	tpt "github.com/libp2p/go-libp2p-transport"
 	ma "github.com/multiformats/go-multiaddr"
 
+	"github.com/RTradeLtd/go-garlic-tcp-transport/bridge"
 	"github.com/RTradeLtd/go-garlic-tcp-transport/common"
 	"github.com/RTradeLtd/go-garlic-tcp-transport/conn"
 )
@@ -17,37 +22,110 @@ import (
 // via the SAM bridge
 type GarlicTCPTransport struct {
 	i2ptcpconn.GarlicTCPConn
-	id       peer.ID
-	HostSAM  string
-	PortSAM  string
-	PassSAM  string
-	keysPath string
-
-	onlyGarlic    bool
-	garlicOptions []string
+	id peer.ID
+	// Deprecated: HostSAM, PortSAM, UserSAM and PassSAM are copies of the
+	// SAM bridge settings, kept for code that reads them. Changing them does
+	// nothing, set them with the SAMHost, SAMPort, SAMUser and SAMPass
+	// options and read them with SAMHost, SAMPort and Config.
+	HostSAM    string
+	PortSAM    string
+	UserSAM    string
+	PassSAM    string
+	config     i2phelpers.Config
+	supervisor *i2pbridge.Supervisor
+	// dialer and peers isolate dials, see Isolation
+	dialer     *i2pbridge.Supervisor
+	peers      *i2pbridge.PeerSessions
+	// adaptive changes the tunnel quantity with the load, if asked to
+	adaptive   *i2pbridge.Adaptive
+	keysLock   *i2phelpers.KeysLock
+	keysMu     sync.Mutex
+	// touched is set once the keys' metadata says they're in use by id
+	touched bool
+	// startMu keeps discovery, which sets dialer and peers up again, to one
+	// Start at a time. configMu guards config and discovery, which discovery
+	// and Reconfigure change, and reconfMu keeps Reconfigure to one at a
+	// time.
+	startMu   sync.Mutex
+	configMu  sync.RWMutex
+	reconfMu  sync.Mutex
+	discover  bool
+	discovery *i2phelpers.Discovery
 }
 
+const (
+	// startTimeout bounds the wait for the SAM session on Listen
+	startTimeout = 2 * time.Minute
+	// discoverTimeout bounds looking for the SAM bridge, see DiscoverSAM
+	discoverTimeout = time.Minute
+)
+
 var test tpt.Transport = &GarlicTCPTransport{}
 
+// ErrClientOnly is what Listen fails with on a ClientOnly transport
+var ErrClientOnly = i2phelpers.ErrClientOnly
+
+// SAMHost returns the host of the SAM bridge, an IP address or DNS name
 func (t *GarlicTCPTransport) SAMHost() string {
-	st := strings.TrimPrefix(t.HostSAM, "/ip4/")
-	stt := strings.TrimPrefix(st, "/ip6/")
-	rt := strings.TrimSuffix(stt, "/")
-	return rt
+	return t.Config().SAMHost
 }
 
+// SAMPort returns the port of the SAM bridge
 func (t *GarlicTCPTransport) SAMPort() string {
-	st := strings.TrimPrefix(t.PortSAM, "/tcp/")
-	rt := strings.TrimSuffix(st, "/")
-	return rt
+	return t.Config().SAMPort
 }
 
+// SAMAddress returns the "host:port" the SAM bridge is dialed on
 func (t *GarlicTCPTransport) SAMAddress() string {
-	return t.SAMHost() + ":" + t.SAMPort()
+	return t.Config().SAMAddress()
+}
+
+// Capabilities asks the SAM bridge which SAM version it speaks and so what it
+// can do.
+func (t *GarlicTCPTransport) Capabilities() (i2pbridge.Capabilities, error) {
+	return t.Config().Bridge().Capabilities()
+}
+
+// Discovery says which SAM bridge DiscoverSAM found and why it was picked, or
+// nil if the transport wasn't told to look or hasn't started yet.
+func (t *GarlicTCPTransport) Discovery() *i2phelpers.Discovery {
+	t.configMu.RLock()
+	defer t.configMu.RUnlock()
+	return t.discovery
+}
+
+// Config returns a copy of the transport's configuration
+func (t *GarlicTCPTransport) Config() i2phelpers.Config {
+	t.configMu.RLock()
+	defer t.configMu.RUnlock()
+	return t.config.Copy()
+}
+
+// setConfig changes the transport's configuration, and its embedded
+// connection's
+func (t *GarlicTCPTransport) setConfig(cfg i2phelpers.Config) {
+	t.configMu.Lock()
+	t.config = cfg
+	t.configMu.Unlock()
+	i2ptcpconn.Config(cfg)(&t.GarlicTCPConn)
 }
 
+// PrintOptions returns the options passed to SESSION CREATE, typed tunnel
+// options first.
 func (t *GarlicTCPTransport) PrintOptions() []string {
-	return t.garlicOptions
+	opts, _ := t.Config().SessionOptions()
+	return opts
+}
+
+// String describes the transport without any of its key material
+func (t *GarlicTCPTransport) String() string {
+	cfg := t.Config()
+	return "GarlicTCPTransport(" + cfg.KeysPath + " via " + cfg.SAMAddress() + ")"
+}
+
+// Format sends every fmt verb through String, see GarlicTCPConn.Format
+func (t *GarlicTCPTransport) Format(f fmt.State, verb rune) {
+	io.WriteString(f, t.String())
 }
 
 // CanDial implements transport.CanDial
@@ -71,9 +149,399 @@ func (t *GarlicTCPTransport) MatchesI2P(a ma.Multiaddr) bool {
 	return i2phelpers.IsValidGarlicMultiAddr(a)
 }
 
+// lockKeys makes sure no other transport is using our keys. The lock is held
+// until the transport is closed.
+func (t *GarlicTCPTransport) lockKeys() error {
+	t.keysMu.Lock()
+	defer t.keysMu.Unlock()
+	if t.keysLock != nil {
+		return nil
+	}
+	l, err := i2phelpers.LockKeys(t.Config().KeysPath)
+	if err != nil {
+		return err
+	}
+	t.keysLock = l
+	return nil
+}
+
+// touchKeys records which peer the keys belong to, once they've been loaded.
+// It's done once rather than on every dial, and like the rest of the
+// metadata it's best effort: failing to write it is never worth failing to
+// start over.
+func (t *GarlicTCPTransport) touchKeys() {
+	t.keysMu.Lock()
+	defer t.keysMu.Unlock()
+	cfg := t.Config()
+	if t.touched || t.keysLock == nil || t.id == "" || cfg.ClientOnly {
+		return
+	}
+	t.touched = true
+	i2phelpers.TouchKeys(cfg.KeysPath, t.id.Pretty())
+}
+
+// Close ends the SAM session, releases the transport's lock on its keys and
+// wipes any key material it still holds.
+func (t *GarlicTCPTransport) Close() error {
+	t.keysMu.Lock()
+	defer t.keysMu.Unlock()
+	if t.adaptive != nil {
+		t.adaptive.Close()
+	}
+	if t.supervisor != nil {
+		t.GarlicTCPConn.Close()
+	}
+	t.GarlicTCPConn.WipeKeys()
+	err := t.keysLock.Unlock()
+	t.keysLock = nil
+	t.touched = false
+	return err
+}
+
+// Events reports what the SAM session is doing: connecting, ready, lost when
+// the router goes away and ready again once it's been recreated.
+func (t *GarlicTCPTransport) Events() <-chan i2pbridge.Event {
+	return t.supervisor.Events()
+}
+
+// ActiveBridge is the SAM bridge the session is on, or nil while it's down
+func (t *GarlicTCPTransport) ActiveBridge() *i2pbridge.Bridge {
+	return t.supervisor.Active()
+}
+
+// BridgeHealth reports the last health check of each SAM bridge, in the order
+// they were given to SAMAddresses.
+func (t *GarlicTCPTransport) BridgeHealth() []i2pbridge.BridgeHealth {
+	return t.supervisor.Health()
+}
+
+// Status says whether the SAM session is up right now
+func (t *GarlicTCPTransport) Status() i2pbridge.Status {
+	return t.supervisor.Status()
+}
+
+// Start connects to the SAM bridge, finding it first if DiscoverSAM was
+// given, and waits until the session is up or ctx is done. Calling it is
+// optional, the first Dial or Listen starts the transport too. If the bridge
+// isn't there yet, it can be called again later.
+func (t *GarlicTCPTransport) Start(ctx context.Context) error {
+	// client-only sessions don't use the keys on disk, so there's nothing
+	// to lock
+	if !t.Config().ClientOnly {
+		if err := t.lockKeys(); err != nil {
+			return err
+		}
+	}
+	if err := t.discoverSAM(ctx); err != nil {
+		return err
+	}
+	if err := t.GarlicTCPConn.Start(ctx); err != nil {
+		return err
+	}
+	t.touchKeys()
+	if t.adaptive != nil {
+		t.adaptive.Start()
+	}
+	return nil
+}
+
+// discoverSAM looks for the SAM bridge the first time the transport starts,
+// if it was asked to.
+func (t *GarlicTCPTransport) discoverSAM(ctx context.Context) error {
+	t.startMu.Lock()
+	defer t.startMu.Unlock()
+	if !t.discover || t.discovery != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, discoverTimeout)
+	defer cancel()
+	cfg := t.Config()
+	d, err := i2phelpers.DiscoverSAM(ctx, cfg.SAMUser, cfg.SAMPass)
+	if err != nil {
+		return err
+	}
+	if err := cfg.SetSAMAddress(d.Address); err != nil {
+		return err
+	}
+	if err := t.supervisor.SetBridges(cfg.Bridges()); err != nil {
+		return err
+	}
+	// nothing has started yet, so the isolated sessions can just be set up
+	// again for the bridge that was found
+	if err := t.setDialers(cfg); err != nil {
+		return err
+	}
+	t.setConfig(cfg)
+	t.configMu.Lock()
+	t.discovery = d
+	t.configMu.Unlock()
+	t.setSAMFields(cfg)
+	return nil
+}
+
+// setSAMFields fills in the deprecated copies of the SAM bridge settings
+func (t *GarlicTCPTransport) setSAMFields(cfg i2phelpers.Config) {
+	t.HostSAM, t.PortSAM = cfg.SAMHost, cfg.SAMPort
+	t.UserSAM, t.PassSAM = cfg.SAMUser, cfg.SAMPass
+}
+
+// PoolStats reports how the pool of sessions for IsolationPerPeer is doing:
+// how many are ready, how long refilling takes and how often a dial found one
+// waiting. It's false without IsolationPerPeer.
+func (t *GarlicTCPTransport) PoolStats() (i2pbridge.PoolStats, bool) {
+	// discovery sets the pool up again
+	t.startMu.Lock()
+	peers := t.peers
+	t.startMu.Unlock()
+	if peers == nil {
+		return i2pbridge.PoolStats{}, false
+	}
+	return peers.Pool().Stats(), true
+}
+
+// AdaptiveStats reports what AdaptiveTunnels has measured and the tunnel
+// quantity changes it made. It's false without AdaptiveTunnels.
+func (t *GarlicTCPTransport) AdaptiveStats() (i2pbridge.AdaptiveStats, bool) {
+	if t.adaptive == nil {
+		return i2pbridge.AdaptiveStats{}, false
+	}
+	return t.adaptive.Stats(), true
+}
+
+// Ready is closed once the SAM session is up and our lease set is published,
+// so that peers dialing our address can reach us. It's a new channel for each
+// session, so ask again after the session has been lost.
+func (t *GarlicTCPTransport) Ready() <-chan struct{} {
+	return t.supervisor.Ready()
+}
+
+// WaitReady starts the transport if need be and waits until it's Ready, or
+// says why not: the bridge turning us down, or ctx running out, along with
+// what the last lookup of our own address said.
+func (t *GarlicTCPTransport) WaitReady(ctx context.Context) error {
+	if err := t.Start(ctx); err != nil {
+		return err
+	}
+	return t.supervisor.WaitReady(ctx)
+}
+
+// Reconfigure changes the session's options without a restart, taking the
+// same options as NewGarlicTCPTransportFromOptions: TunnelOptions,
+// StreamingOptions, Preset, GarlicOptions and the pool's tunnel options in
+// SessionPool. Anything else, like the SAM bridge or the keys, can't change
+// this way. A session with the new
+// options and the same keys takes over new dials and accepts, and the old one
+// is closed once its streams have finished, see i2pbridge.Supervisor.Reconfigure.
+// Isolated dial sessions are remade with the new options too.
+//
+// Most routers won't have our destination in two sessions at once. Then the
+// old session has to be closed before the new one is made: it takes no new
+// streams, its streams get DrainTimeout to finish, two minutes unless the
+// supervisor is told otherwise, and dials wait for the new session until
+// then, or until their context is done.
+//
+// If any session turns the new options down, the ones already moved over
+// are moved back and the configuration stays as it was.
+func (t *GarlicTCPTransport) Reconfigure(ctx context.Context, opts ...func(*GarlicTCPTransport) error) error {
+	t.reconfMu.Lock()
+	defer t.reconfMu.Unlock()
+	// turn bad options down without bothering the bridge
+	if _, err := reconfigured(t.Config(), opts); err != nil {
+		return err
+	}
+	// discovery changes the config, so the new one is worked out from what
+	// it's like once started
+	if err := t.Start(ctx); err != nil {
+		return err
+	}
+	old := t.Config()
+	cfg, err := reconfigured(old, opts)
+	if err != nil {
+		return err
+	}
+	return t.reconfigure(ctx, old, cfg, true)
+}
+
+// sessions are the sessions up right now, the main one and any isolated dial
+// sessions, for AdaptiveTunnels to measure
+func (t *GarlicTCPTransport) sessions() []*i2pbridge.StreamSession {
+	t.startMu.Lock()
+	dialer, peers := t.dialer, t.peers
+	t.startMu.Unlock()
+	var sessions []*i2pbridge.StreamSession
+	for _, s := range []*i2pbridge.Supervisor{t.supervisor, dialer} {
+		if s == nil {
+			continue
+		}
+		if ss := s.Current(); ss != nil {
+			sessions = append(sessions, ss)
+		}
+	}
+	if peers != nil {
+		sessions = append(sessions, peers.Sessions()...)
+	}
+	return sessions
+}
+
+// scaleTunnels is how AdaptiveTunnels changes the tunnel quantity: through the
+// config, like Reconfigure, so that Config and PrintOptions follow it and a
+// later Reconfigure keeps it. Bridges that won't have a destination in two
+// sessions at once turn it down with ErrDuplicatedDest rather than have the
+// session drained for it.
+func (t *GarlicTCPTransport) scaleTunnels(ctx context.Context, quantity int) error {
+	t.reconfMu.Lock()
+	defer t.reconfMu.Unlock()
+	old := t.Config()
+	cfg := old.Copy()
+	cfg.Tunnel = cfg.Tunnel.Override(i2phelpers.TunnelOptions{
+		InboundQuantity:  i2phelpers.Int(quantity),
+		OutboundQuantity: i2phelpers.Int(quantity),
+	})
+	if err := cfg.Check(); err != nil {
+		return err
+	}
+	return t.reconfigure(ctx, old, cfg, false)
+}
+
+// reconfigured is old with opts applied, if they only change what Reconfigure
+// can
+func reconfigured(old i2phelpers.Config, opts []func(*GarlicTCPTransport) error) (i2phelpers.Config, error) {
+	scratch := GarlicTCPTransport{config: old.Copy()}
+	for _, o := range opts {
+		if err := o(&scratch); err != nil {
+			return i2phelpers.Config{}, err
+		}
+	}
+	cfg := scratch.config
+	if err := cfg.Check(); err != nil {
+		return i2phelpers.Config{}, err
+	}
+	// only the session options may change
+	fixed := func(c i2phelpers.Config) i2phelpers.Config {
+		c.Preset = i2phelpers.NoPreset
+		c.Tunnel = i2phelpers.TunnelOptions{}
+		c.Streaming = i2phelpers.StreamingOptions{}
+		c.Options = nil
+		c.Pool.Tunnel = i2phelpers.TunnelOptions{}
+		return c
+	}
+	if !reflect.DeepEqual(fixed(old), fixed(cfg)) {
+		return i2phelpers.Config{}, fmt.Errorf("Reconfigure only changes tunnel and streaming options, not the SAM bridge, keys or policies")
+	}
+	return cfg, nil
+}
+
+// reconfigure moves every session from old's options to cfg's and makes cfg
+// the configuration. The options are all worked out first, and if a session
+// turns its new ones down, those already moved are moved back, so that it's
+// all or nothing. The dial session goes first since it's the cheapest to move
+// back. Without drain, a bridge that won't have the destination in two
+// sessions at once fails it with ErrDuplicatedDest, see
+// i2pbridge.Supervisor.TryReconfigure.
+func (t *GarlicTCPTransport) reconfigure(ctx context.Context, old, cfg i2phelpers.Config, drain bool) error {
+	move := (*i2pbridge.Supervisor).Reconfigure
+	if !drain {
+		move = (*i2pbridge.Supervisor).TryReconfigure
+	}
+	var steps []reconfigureStep
+	add := func(s *i2pbridge.Supervisor, options func(i2phelpers.Config) ([]string, error)) error {
+		from, err := options(old)
+		if err != nil {
+			return err
+		}
+		to, err := options(cfg)
+		if err != nil {
+			return err
+		}
+		steps = append(steps, reconfigureStep{s, from, to})
+		return nil
+	}
+	if t.dialer != nil {
+		if err := add(t.dialer, i2phelpers.Config.IsolatedOptions); err != nil {
+			return err
+		}
+	}
+	if err := add(t.supervisor, i2phelpers.Config.SessionOptions); err != nil {
+		return err
+	}
+	var pool []string
+	if t.peers != nil {
+		var err error
+		if pool, err = cfg.PoolSessionOptions(); err != nil {
+			return err
+		}
+	}
+	for i, step := range steps {
+		if err := move(step.s, ctx, step.to); err != nil {
+			return t.rollback(steps[:i+1], err)
+		}
+	}
+	if t.peers != nil {
+		t.peers.Pool().SetOptions(pool)
+	}
+	t.setConfig(cfg)
+	return nil
+}
+
+// reconfigureStep is a supervisor moving from one set of options to another
+type reconfigureStep struct {
+	s        *i2pbridge.Supervisor
+	from, to []string
+}
+
+// rollback moves the supervisors in done back to their old options after err
+// stopped a Reconfigure. The one that failed has usually gone back by itself,
+// but not if ctx ran out on it.
+func (t *GarlicTCPTransport) rollback(done []reconfigureStep, err error) error {
+	// ctx may be what ran out, the old options get a fresh one
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	for _, step := range done {
+		if sameOptions(step.s.Options(), step.from) {
+			continue
+		}
+		if rerr := step.s.Reconfigure(ctx, step.from); rerr != nil {
+			return fmt.Errorf("%w, and moving back to the old options failed too: %s", err, rerr)
+		}
+	}
+	return err
+}
+
+// sameOptions says whether a and b are the same options, in the same order
+func sameOptions(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// newConn makes sure the session is up and hands out a connection sharing it.
+func (t *GarlicTCPTransport) newConn(ctx context.Context) (*i2ptcpconn.GarlicTCPConn, error) {
+	if err := t.Start(ctx); err != nil {
+		return nil, err
+	}
+	cfg := t.Config()
+	conn, err := i2ptcpconn.NewGarlicTCPConnFromOptions(
+		i2ptcpconn.Transport(t),
+		i2ptcpconn.Config(cfg),
+		i2ptcpconn.Supervisor(t.supervisor),
+		i2ptcpconn.Dialers(t.dialer, t.peers),
+		i2ptcpconn.KeysLock(t.lockKeys),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
 // Dial returns a new GarlicConn
 func (t *GarlicTCPTransport) Dial(c context.Context, m ma.Multiaddr, p peer.ID) (tpt.Conn, error) {
-	conn, err := i2ptcpconn.NewGarlicTCPConn(t, t.onlyGarlic, t.PrintOptions())
+	conn, err := t.newConn(c)
 	if err != nil {
 		return nil, err
 	}
@@ -87,15 +555,31 @@ func (t *GarlicTCPTransport) Listen(addr ma.Multiaddr) (tpt.Listener, error) {
 }
 
 // ListenI2P is like Listen, but it returns the GarlicTCPConn and doesn't
-//require a multiaddr
+//require a multiaddr. It fails with ErrClientOnly in client-only mode, before
+//any session is made.
 func (t *GarlicTCPTransport) ListenI2P() (*i2ptcpconn.GarlicTCPConn, error) {
-	conn, err := i2ptcpconn.NewGarlicTCPConn(t, t.onlyGarlic, t.PrintOptions())
+	if t.Config().ClientOnly {
+		return nil, ErrClientOnly
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	conn, err := t.newConn(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return conn.ListenI2P()
 }
 
+// IsRetryable says whether a Dial or Listen error might go away if tried again
+// later, like an unreachable peer, a timeout or a router that's restarting, or
+// whether it's permanent, like
+// bad keys, a clashing destination or failed SAM authentication. The SAM result
+// codes themselves can be matched with errors.Is against the i2pbridge.Err*
+// sentinels.
+func IsRetryable(err error) bool {
+	return i2pbridge.IsRetryable(err)
+}
+
 // Protocols need only return this I think
 func (t *GarlicTCPTransport) Protocols() []int {
 	return []int{ma.P_GARLIC32, ma.P_GARLIC64}
@@ -131,21 +615,52 @@ func NewGarlicTCPTransportPeer(id peer.ID, host, port, pass string, keysPath str
 	)
 }
 
+// NewGarlicTCPTransportFromOptions makes a transport from functional options.
+// It only sets things up: keys are loaded and the SAM bridge is looked for and
+// contacted on Start or the first Dial or Listen.
 func NewGarlicTCPTransportFromOptions(opts ...func(*GarlicTCPTransport) error) (*GarlicTCPTransport, error) {
 	var g GarlicTCPTransport
-	g.HostSAM = "127.0.0.1"
-	g.PortSAM = "7656"
-	g.PassSAM = ""
-	g.keysPath = ""
-	g.onlyGarlic = false
-	g.garlicOptions = []string{}
+	g.config = i2phelpers.DefaultConfig()
 	for _, o := range opts {
 		if err := o(&g); err != nil {
 			return nil, err
 		}
 	}
-	if g.keysPath == "" {
-		g.keysPath = "dht-" + i2phelpers.RandTunName()
+	if err := g.config.Check(); err != nil {
+		return nil, err
 	}
+	options, err := g.config.SessionOptions()
+	if err != nil {
+		return nil, err
+	}
+	g.supervisor = i2pbridge.NewSupervisor(g.config.Bridges(), i2ptcpconn.KeySource(g.config, i2phelpers.PrivateKeys{}), options)
+	g.config.Idle.Supervise(g.supervisor)
+	g.supervisor.Primary = g.config.Primary
+	if err := g.setDialers(g.config); err != nil {
+		return nil, err
+	}
+	if g.config.Adaptive != nil {
+		if g.adaptive, err = i2pbridge.NewAdaptive(g.supervisor, *g.config.Adaptive); err != nil {
+			return nil, err
+		}
+		g.adaptive.Sessions = g.sessions
+		g.adaptive.Apply = g.scaleTunnels
+	}
+	g.setSAMFields(g.config)
+	// the embedded connection answers for our address and session
+	i2ptcpconn.Config(g.config)(&g.GarlicTCPConn)
+	i2ptcpconn.Supervisor(g.supervisor)(&g.GarlicTCPConn)
+	i2ptcpconn.KeysLock(g.lockKeys)(&g.GarlicTCPConn)
 	return &g, nil
 }
+
+// setDialers sets up the sessions dials are isolated on, for the embedded
+// connection and every one handed out after
+func (t *GarlicTCPTransport) setDialers(cfg i2phelpers.Config) error {
+	dialer, peers, err := i2ptcpconn.NewDialers(cfg)
+	if err != nil {
+		return err
+	}
+	t.dialer, t.peers = dialer, peers
+	return i2ptcpconn.Dialers(dialer, peers)(&t.GarlicTCPConn)
+}
@@ -3,56 +3,122 @@ package i2ptcp
 import (
 	"fmt"
 	peer "github.com/libp2p/go-libp2p-peer"
-	"net"
-	"strconv"
-	"strings"
+
+	"github.com/RTradeLtd/go-garlic-tcp-transport/bridge"
+	"github.com/RTradeLtd/go-garlic-tcp-transport/common"
 )
 
 // Option is a functional argument
 type Option func(*GarlicTCPTransport) error
 
-//SAMHost sets the host of the SAM Bridge to use
-func SAMHost(s string) func(*GarlicTCPTransport) error {
+//SAMAddress sets the SAM bridge to use. It takes "host:port", a host name or
+//IP address on its own (IPv6 with or without brackets), or a multiaddr such as
+//"/dns4/i2p-router/tcp/7656". If there's no port, the port set by SAMPort or
+//7656 is used.
+func SAMAddress(s string) func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		if err := c.config.SetSAMAddress(s); err != nil {
+			return fmt.Errorf("Transport Construction error: %s", err)
+		}
+		return nil
+	}
+}
+
+//SAMAddresses sets several SAM bridges, in the forms SAMAddress takes, most
+//preferred first. The transport uses the first one that works and fails over
+//to the others, with the same keys, if it goes away.
+func SAMAddresses(addrs ...string) func(*GarlicTCPTransport) error {
 	return func(c *GarlicTCPTransport) error {
-		st := ""
-		if !strings.Contains("/ip4/", s) || !strings.Contains("/ip6/", s) {
-			ip := net.ParseIP(s)
-			if ip.To4() != nil {
-				st = "/ip4/" + s + "/"
-			}
-			if ip.To16() != nil {
-				st = "/ip6/" + s + "/"
-			}
+		if err := c.config.SetSAMAddresses(addrs); err != nil {
+			return fmt.Errorf("Transport Construction error: %s", err)
 		}
-		c.HostSAM = st
 		return nil
 	}
 }
 
+//SAMHost sets the host of the SAM Bridge to use. It's the same as SAMAddress,
+//and is kept for existing callers.
+func SAMHost(s string) func(*GarlicTCPTransport) error {
+	return SAMAddress(s)
+}
+
 //SAMPort sets the port of the SAM bridge to use
 func SAMPort(s string) func(*GarlicTCPTransport) error {
 	return func(c *GarlicTCPTransport) error {
-		st := strings.TrimPrefix(s, "/tcp/")
-		rt := strings.TrimSuffix(st, "/")
-		val, err := strconv.Atoi(rt)
+		if err := c.config.SetSAMPort(s); err != nil {
+			return fmt.Errorf("Transport Construction error: %s", err)
+		}
+		return nil
+	}
+}
+
+//SAMUser sets the user to authenticate to the SAM bridge as
+func SAMUser(s string) func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		c.config.SAMUser = s
+		return nil
+	}
+}
+
+//SAMPass sets the password to use when authenticating to the SAM bridge. It
+//goes with SAMUser, SAM 3.2 authentication needs both. Prefer
+//SAMCredentialsFile or SAMCredentialsFromEnv to keep the password off the
+//command line.
+func SAMPass(s string) func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		c.config.SAMPass = s
+		return nil
+	}
+}
+
+//SAMCredentialsFile reads the SAM user and password from a file containing
+//"user:password", which must only be readable by its owner.
+func SAMCredentialsFile(path string) func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		user, pass, err := i2phelpers.SAMCredentialsFromFile(path)
 		if err != nil {
 			return fmt.Errorf("Transport Construction error: %s", err)
 		}
-		if val > 0 && val < 65536 {
-			c.PortSAM = "/tcp/" + rt + "/"
-			return nil
+		c.config.SAMUser, c.config.SAMPass = user, pass
+		return nil
+	}
+}
+
+//SAMCredentialsFromEnv reads the SAM user and password from $I2P_SAM_USER and
+//$I2P_SAM_PASSWORD.
+func SAMCredentialsFromEnv() func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		user, pass, err := i2phelpers.SAMCredentialsFromEnv()
+		if err != nil {
+			return fmt.Errorf("Transport Construction error: %s", err)
 		}
-		return fmt.Errorf("port is %s invalid", s)
+		c.config.SAMUser, c.config.SAMPass = user, pass
+		return nil
 	}
 }
 
-//SAMPass sets the password to use when authenticating to the SAM bridge. It's
-//ignored for now, and will return an error if it recieves a non-empty string.
-func SAMPass(s string) func(*GarlicTCPTransport) error {
+//SAMTLS talks to the SAM bridge over TLS, on every control and data
+//connection. The bridge's certificate has to be signed by a CA in the PEM file
+//caFile, or have one of the given SHA-256 fingerprints, or both if both are
+//given. The system's CAs aren't trusted.
+func SAMTLS(caFile string, fingerprints ...string) func(*GarlicTCPTransport) error {
 	return func(c *GarlicTCPTransport) error {
-		if s != "" {
-			return fmt.Errorf("SAMPass is unused for now, pass no argument(or empty string). Failing closed.")
+		cfg, err := i2phelpers.SAMTLSConfig(caFile, fingerprints...)
+		if err != nil {
+			return fmt.Errorf("Transport Construction error: %s", err)
 		}
+		c.config.SAMTLS = cfg
+		return nil
+	}
+}
+
+//DiscoverSAM looks for the SAM bridge instead of using SAMAddress: wherever
+//$I2P_SAM or $SAM_ADDRESS point, then the default port on localhost, then
+//wherever i2pd's config file says. It looks when the transport starts, see
+//i2phelpers.DiscoverSAM, and Discovery for what it found.
+func DiscoverSAM() func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		c.discover = true
 		return nil
 	}
 }
@@ -60,22 +126,144 @@ func SAMPass(s string) func(*GarlicTCPTransport) error {
 //KeysPath sets the path to the keys, if no keys are present, they will be generated.
 func KeysPath(s string) func(*GarlicTCPTransport) error {
 	return func(c *GarlicTCPTransport) error {
-		c.keysPath = s
+		c.config.KeysPath = s
 		return nil
 	}
 }
 
 func OnlyGarlic(b bool) func(*GarlicTCPTransport) error {
 	return func(c *GarlicTCPTransport) error {
-		c.onlyGarlic = b
+		c.config.OnlyGarlic = b
+		return nil
+	}
+}
+
+//ClientOnly makes a transport that only dials out, from a transient
+//destination the SAM bridge makes up for each session. Nothing is written to
+//the keys path, no lease set is published and Listen fails with ErrClientOnly.
+func ClientOnly() func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		c.config.ClientOnly = true
+		return nil
+	}
+}
+
+//Isolation sets which destination dials come from: the one we listen on
+//(i2phelpers.IsolationShared, the default), a second transient one for all
+//dials (IsolationSeparate), or a transient one per remote peer
+//(IsolationPerPeer), taken from a pool built ahead of time so that dials don't
+//wait for tunnels.
+func Isolation(i i2phelpers.Isolation) func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		if _, err := i2phelpers.ParseIsolation(i.String()); err != nil {
+			return fmt.Errorf("Transport Construction error: %s", err)
+		}
+		c.config.Isolation = i
+		return nil
+	}
+}
+
+//SessionPool sets up the pool of ready transient sessions IsolationPerPeer
+//dials new peers from: how many to keep built, how many peers can have one at
+//once, and tunnel options of their own. See PoolStats for how it's doing.
+func SessionPool(o i2phelpers.PoolOptions) func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		if err := o.Validate(); err != nil {
+			return fmt.Errorf("Transport Construction error: %s", err)
+		}
+		c.config.Pool = o
+		return nil
+	}
+}
+
+//PrimarySession makes the session a PRIMARY one if the SAM bridge speaks SAM
+//3.3, so that dials can ask for streaming options of their own with
+//i2phelpers.WithStreaming. Without it such dials fail.
+func PrimarySession() func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		c.config.Primary = true
+		return nil
+	}
+}
+
+//IdlePolicy closes the session, or has the router drop tunnels, once it's
+//gone p.After without a stream. A closed session is made again by the next
+//dial. Listeners don't keep it up, and wait for that dial, unless
+//p.KeepListening is set, which nodes that have to stay reachable want.
+func IdlePolicy(p i2phelpers.IdlePolicy) func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("Transport Construction error: %s", err)
+		}
+		c.config.Idle = p
+		return nil
+	}
+}
+
+//AdaptiveTunnels adds tunnels when the transport's sessions are busy and drops
+//them when they're idle, between o.MinQuantity and o.MaxQuantity. The load is
+//measured over the main session and any isolated dial sessions, and each
+//change moves them all over like Reconfigure does. Routers that won't have a
+//destination in two sessions at once keep the main session as it is, the
+//change is skipped rather than drain it. See AdaptiveStats.
+func AdaptiveTunnels(o i2pbridge.AdaptiveOptions) func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		if err := o.Validate(); err != nil {
+			return fmt.Errorf("Transport Construction error: %s", err)
+		}
+		c.config.Adaptive = &o
+		return nil
+	}
+}
+
+//TunnelOptions sets typed I2CP options for the session's tunnels. They're
+//checked against the ranges I2P allows when the transport is made. Only the
+//fields that are set change, so they can be used to adjust a Preset.
+func TunnelOptions(o i2phelpers.TunnelOptions) func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		if err := o.Validate(); err != nil {
+			return fmt.Errorf("Transport Construction error: %s", err)
+		}
+		c.config.Tunnel = c.config.Tunnel.Override(o)
+		return nil
+	}
+}
+
+//StreamingOptions sets typed streaming library options for the session. Only
+//the fields that are set change, so they can be used to adjust a Preset. They
+//are the defaults for every dial, a single dial can ask for others with
+//i2phelpers.WithStreaming on its context.
+func StreamingOptions(o i2phelpers.StreamingOptions) func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		if err := o.Validate(); err != nil {
+			return fmt.Errorf("Transport Construction error: %s", err)
+		}
+		c.config.Streaming = c.config.Streaming.Override(o)
+		return nil
+	}
+}
+
+//Preset picks a named trade off between anonymity and performance:
+//i2phelpers.HighAnonymity, Balanced, LowLatency or BulkTransfer. Fields set
+//with TunnelOptions or StreamingOptions take precedence, whichever order the
+//options come in.
+func Preset(p i2phelpers.Preset) func(*GarlicTCPTransport) error {
+	return func(c *GarlicTCPTransport) error {
+		if _, err := i2phelpers.ParsePreset(p.String()); err != nil {
+			return fmt.Errorf("Transport Construction error: %s", err)
+		}
+		c.config.Preset = p
 		return nil
 	}
 }
 
+//GarlicOptions passes raw "key=value" options to SESSION CREATE. Prefer
+//TunnelOptions, this is for whatever it doesn't cover. Misspelled tunnel
+//options and keys set twice to different values are reported.
 func GarlicOptions(s []string) func(*GarlicTCPTransport) error {
 	return func(c *GarlicTCPTransport) error {
 		for _, v := range s {
-			c.garlicOptions = append(c.garlicOptions, v)
+			c.config.Options = append(c.config.Options, v)
 		}
 		return nil
 	}
@@ -1,8 +1,28 @@
 package i2ptcp
 
 import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/eyedeekay/sam3/i2pkeys"
+	peer "github.com/libp2p/go-libp2p-peer"
+
+	"github.com/RTradeLtd/go-garlic-tcp-transport/bridge"
+	"github.com/RTradeLtd/go-garlic-tcp-transport/common"
+	"github.com/RTradeLtd/go-garlic-tcp-transport/conn"
 )
 
 func TestGarlicTransport(t *testing.T) {
@@ -20,6 +40,11 @@ func TestGarlicTransport(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	if err := transport.WaitReady(ctx); err != nil {
+		t.Error(err)
+	}
 	log.Println(listener.ID())
 	log.Println(listener.Base64())
 }
@@ -42,3 +67,524 @@ func TestGarlicTransportMaStrings(t *testing.T) {
 	log.Println(listener.ID())
 	log.Println(listener.Base64())
 }
+
+// ed25519TestKeys lays out a destination and private keys the way SAM does,
+// with a throwaway Ed25519 signing key.
+func ed25519TestKeys(t *testing.T) i2pkeys.I2PKeys {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := make([]byte, 384, 391)
+	rand.Read(dest[:256])
+	copy(dest[384-32:], pub)
+	dest = append(dest, 5, 0, 4, 0, 7, 0, 0)
+	both := append(append(append([]byte{}, dest...), make([]byte, 256)...), priv.Seed()...)
+	return i2pkeys.NewKeys(
+		i2pkeys.I2PAddr(i2phelpers.I2PEncoding.EncodeToString(dest)),
+		i2phelpers.I2PEncoding.EncodeToString(both),
+	)
+}
+
+func TestFormatHidesKeys(t *testing.T) {
+	keys := ed25519TestKeys(t)
+	transport, err := NewGarlicTCPTransportFromOptions(KeysPath("redacted.i2pkeys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i2ptcpconn.Keys(keys)(&transport.GarlicTCPConn); err != nil {
+		t.Fatal(err)
+	}
+	both, _ := i2phelpers.I2PEncoding.DecodeString(keys.String())
+	seed := both[len(both)-32:]
+	secrets := []string{
+		keys.String()[len(keys.String())-43:],
+		fmt.Sprintf("%x", seed),
+		strings.Trim(fmt.Sprint(seed), "[]"),
+	}
+	j, err := json.Marshal(transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := []string{string(j)}
+	for _, verb := range []string{"%v", "%+v", "%#v", "%s", "%x", "%q"} {
+		outputs = append(outputs,
+			fmt.Sprintf(verb, transport),
+			fmt.Sprintf(verb, &transport.GarlicTCPConn),
+			fmt.Sprintf(verb, transport.GarlicTCPConn),
+		)
+	}
+	for _, out := range outputs {
+		for _, secret := range secrets {
+			if strings.Contains(out, secret) {
+				t.Fatalf("key material leaked: %s", out)
+			}
+		}
+	}
+	if !strings.Contains(fmt.Sprint(&transport.GarlicTCPConn), keys.Addr().Base32()) {
+		t.Error("connection should be described by its address")
+	}
+}
+
+func TestStoredKeysLoadedUnderLock(t *testing.T) {
+	t.Setenv(i2phelpers.EnvDir, t.TempDir())
+	keys := ed25519TestKeys(t)
+	path, err := i2phelpers.KeysFile("node.i2pkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i2phelpers.WriteKeysFile(path, keys, i2phelpers.KeysFormatIncompat); err != nil {
+		t.Fatal(err)
+	}
+	transport, err := NewGarlicTCPTransportFromOptions(KeysPath("node.i2pkeys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	addrs := make(chan string, 10)
+	for i := 0; i < cap(addrs); i++ {
+		go func() {
+			_ = fmt.Sprint(&transport.GarlicTCPConn)
+			addrs <- transport.Base32()
+		}()
+	}
+	for i := 0; i < cap(addrs); i++ {
+		if a := <-addrs; a != keys.Addr().Base32() {
+			t.Errorf("got address %s", a)
+		}
+	}
+	if l, err := i2phelpers.LockKeys("node.i2pkeys"); err == nil {
+		l.Unlock()
+		t.Error("the keys were loaded without taking the lock on them")
+	}
+}
+
+func TestKeySourceWiped(t *testing.T) {
+	keys := ed25519TestKeys(t)
+	pk, err := i2phelpers.NewPrivateKeys(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := pk.Clone()
+	source := i2ptcpconn.KeySource(i2phelpers.DefaultConfig(), held)
+	pk.Wipe()
+	got, err := source(nil)
+	if err != nil || got.String() != keys.String() {
+		t.Fatalf("got %v, wiping the original reached the key source's copy", err)
+	}
+	held.Wipe()
+	if got, err := source(nil); !errors.Is(err, i2pbridge.ErrInvalidKey) || got.String() != "" {
+		t.Fatalf("got %v, want wiped keys turned down", err)
+	}
+}
+
+func TestSAMAddressOption(t *testing.T) {
+	cases := []struct {
+		opts []func(*GarlicTCPTransport) error
+		want string
+	}{
+		{nil, "127.0.0.1:7656"},
+		{[]func(*GarlicTCPTransport) error{SAMHost("i2p-router")}, "i2p-router:7656"},
+		{[]func(*GarlicTCPTransport) error{SAMHost("/ip4/10.0.0.2/"), SAMPort("/tcp/7000/")}, "10.0.0.2:7000"},
+		{[]func(*GarlicTCPTransport) error{SAMAddress("/dns4/i2p-router/tcp/7000")}, "i2p-router:7000"},
+		{[]func(*GarlicTCPTransport) error{SAMAddress("[::1]:7000")}, "[::1]:7000"},
+	}
+	for _, c := range cases {
+		transport, err := NewGarlicTCPTransportFromOptions(c.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a := transport.SAMAddress(); a != c.want {
+			t.Errorf("got %s, want %s", a, c.want)
+		}
+		// the deprecated fields still say where the bridge is
+		if a := net.JoinHostPort(transport.HostSAM, transport.PortSAM); a != c.want {
+			t.Errorf("HostSAM and PortSAM say %s, want %s", a, c.want)
+		}
+	}
+	if _, err := NewGarlicTCPTransportFromOptions(SAMHost("not a host")); err == nil {
+		t.Error("accepted an invalid SAM host")
+	}
+}
+
+func TestLazyStart(t *testing.T) {
+	// nothing listens here, which only matters once the transport starts
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	transport, err := NewGarlicTCPTransportFromOptions(SAMAddress(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	if s := transport.Status(); s != i2pbridge.StatusConnecting {
+		t.Errorf("status %s before Start", s)
+	}
+	for i := 0; i < 2; i++ {
+		if err := transport.Start(context.Background()); err == nil || !strings.Contains(err.Error(), "refused") {
+			t.Fatalf("got %v, want connection refused", err)
+		}
+	}
+	if s := transport.Status(); s == i2pbridge.StatusClosed {
+		t.Error("a missing bridge shouldn't close the transport")
+	}
+}
+
+func TestClientOnlyListen(t *testing.T) {
+	keys := t.TempDir()
+	t.Setenv(i2phelpers.EnvDir, keys)
+	transport, err := NewGarlicTCPTransportFromOptions(ClientOnly(), KeysPath("client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	if _, err := transport.ListenI2P(); !errors.Is(err, ErrClientOnly) {
+		t.Errorf("got %v, want ErrClientOnly", err)
+	}
+	if s := transport.Status(); s != i2pbridge.StatusConnecting {
+		t.Errorf("listening started the session, status %s", s)
+	}
+	if entries, _ := os.ReadDir(keys); len(entries) != 0 {
+		t.Errorf("client-only transport wrote %d files", len(entries))
+	}
+}
+
+func TestReconfigureOnlySessionOptions(t *testing.T) {
+	transport, err := NewGarlicTCPTransportFromOptions(SAMAddress("127.0.0.1:7656"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	if err := transport.Reconfigure(context.Background(), SAMAddress("127.0.0.1:7657")); err == nil {
+		t.Error("Reconfigure moved the transport to another bridge")
+	}
+	err = transport.Reconfigure(context.Background(), TunnelOptions(i2phelpers.TunnelOptions{InboundLength: i2phelpers.Int(9)}))
+	if err == nil || !strings.Contains(err.Error(), "InboundLength") {
+		t.Errorf("got %v, want invalid tunnel options", err)
+	}
+	if s := transport.Status(); s != i2pbridge.StatusConnecting {
+		t.Errorf("a refused Reconfigure started the transport, status %s", s)
+	}
+}
+
+// fakeBridge is just enough of a SAM bridge for a transport to make sessions
+// and dial on them. reject turns down the SESSION CREATEs it matches, and
+// uniqueDests the ones for a destination already in a session.
+type fakeBridge struct {
+	l         net.Listener
+	transient i2pkeys.I2PKeys
+
+	mu          sync.Mutex
+	reject      func(map[string]string) bool
+	creates     []map[string]string
+	uniqueDests bool
+	dests       map[string]bool
+}
+
+func newFakeBridge(t *testing.T) *fakeBridge {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBridge{l: l, transient: ed25519TestKeys(t), dests: map[string]bool{}}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBridge) serve(c net.Conn) {
+	defer c.Close()
+	var dest string
+	defer func() {
+		b.mu.Lock()
+		delete(b.dests, dest)
+		b.mu.Unlock()
+	}()
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if strings.HasPrefix(line, "PING") {
+			c.Write([]byte("PONG" + strings.TrimPrefix(line, "PING")))
+			continue
+		}
+		req, err := i2pbridge.ParseReply(strings.TrimSpace(line))
+		if err != nil {
+			return
+		}
+		switch req.Topic + " " + req.Type {
+		case "HELLO VERSION":
+			c.Write([]byte("HELLO REPLY RESULT=OK VERSION=3.1\n"))
+		case "SESSION CREATE":
+			b.mu.Lock()
+			if b.uniqueDests && b.dests[req.Pairs["DESTINATION"]] {
+				b.mu.Unlock()
+				c.Write([]byte("SESSION STATUS RESULT=DUPLICATED_DEST\n"))
+				continue
+			}
+			rejected := b.reject != nil && b.reject(req.Pairs)
+			if !rejected {
+				b.creates = append(b.creates, req.Pairs)
+				if req.Pairs["DESTINATION"] != "TRANSIENT" {
+					dest = req.Pairs["DESTINATION"]
+					b.dests[dest] = true
+				}
+			}
+			b.mu.Unlock()
+			if rejected {
+				c.Write([]byte("SESSION STATUS RESULT=I2P_ERROR MESSAGE=\"options turned down\"\n"))
+				continue
+			}
+			reply := req.Pairs["DESTINATION"]
+			if reply == "TRANSIENT" {
+				reply = b.transient.String()
+			}
+			c.Write([]byte("SESSION STATUS RESULT=OK DESTINATION=" + reply + "\n"))
+		case "NAMING LOOKUP":
+			c.Write([]byte("NAMING REPLY RESULT=OK NAME=" + req.Pairs["NAME"] + " VALUE=" + string(b.transient.Addr()) + "\n"))
+		case "STREAM CONNECT":
+			c.Write([]byte("STREAM STATUS RESULT=OK\n"))
+		}
+	}
+}
+
+// lastCreate is the last SESSION CREATE for a transient destination, or for
+// a stored one
+func (b *fakeBridge) lastCreate(transient bool) map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := len(b.creates) - 1; i >= 0; i-- {
+		if (b.creates[i]["DESTINATION"] == "TRANSIENT") == transient {
+			return b.creates[i]
+		}
+	}
+	return nil
+}
+
+// storedKeysTransport is a transport on b with keys already in the keys path
+func storedKeysTransport(t *testing.T, b *fakeBridge, opts ...func(*GarlicTCPTransport) error) *GarlicTCPTransport {
+	t.Setenv(i2phelpers.EnvDir, t.TempDir())
+	path, err := i2phelpers.KeysFile("node.i2pkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i2phelpers.WriteKeysFile(path, ed25519TestKeys(t), i2phelpers.KeysFormatIncompat); err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]func(*GarlicTCPTransport) error{SAMAddress(b.l.Addr().String()), KeysPath("node.i2pkeys")}, opts...)
+	transport, err := NewGarlicTCPTransportFromOptions(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { transport.Close() })
+	return transport
+}
+
+func TestKeysTouchedOnce(t *testing.T) {
+	b := newFakeBridge(t)
+	id := peer.ID("node")
+	transport := storedKeysTransport(t, b, LocalPeerID(id))
+	ctx := context.Background()
+	if err := transport.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	info, err := i2phelpers.KeysInfo("node.i2pkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.PeerID != id.Pretty() {
+		t.Errorf("keys recorded for %q", info.PeerID)
+	}
+	// dials and listens leave the metadata alone
+	path, _ := i2phelpers.KeysFile("node.i2pkeys")
+	if err := os.Remove(path + ".json"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := transport.newConn(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path + ".json"); !os.IsNotExist(err) {
+		t.Error("metadata written again on the dial path")
+	}
+}
+
+func TestReconfigureRace(t *testing.T) {
+	b := newFakeBridge(t)
+	transport := storedKeysTransport(t, b)
+	ctx := context.Background()
+	if err := transport.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_ = transport.String()
+				transport.SAMAddress()
+				transport.PrintOptions()
+				transport.Discovery()
+				transport.GarlicTCPConn.PrintOptions()
+			}
+		}()
+	}
+	for _, n := range []int{2, 3} {
+		if err := transport.Reconfigure(ctx, TunnelOptions(i2phelpers.TunnelOptions{InboundLength: i2phelpers.Int(n)})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	if got := b.lastCreate(false)["inbound.length"]; got != "3" {
+		t.Errorf("session made with inbound.length=%q", got)
+	}
+	if got := *transport.Config().Tunnel.InboundLength; got != 3 {
+		t.Errorf("config says inbound.length=%d", got)
+	}
+}
+
+func TestReconfigureRollsBack(t *testing.T) {
+	b := newFakeBridge(t)
+	transport := storedKeysTransport(t, b, Isolation(i2phelpers.IsolationSeparate))
+	ctx := context.Background()
+	if err := transport.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.dialer.Session(ctx); err != nil {
+		t.Fatal(err)
+	}
+	before := transport.dialer.Options()
+	// the dial session takes the new options, the main one doesn't
+	b.mu.Lock()
+	b.reject = func(req map[string]string) bool {
+		return req["DESTINATION"] != "TRANSIENT" && req["inbound.length"] == "3"
+	}
+	b.mu.Unlock()
+	err := transport.Reconfigure(ctx, TunnelOptions(i2phelpers.TunnelOptions{InboundLength: i2phelpers.Int(3)}))
+	if err == nil {
+		t.Fatal("Reconfigure should have failed")
+	}
+	if got := transport.dialer.Options(); !reflect.DeepEqual(got, before) {
+		t.Errorf("dial session left with %v, want %v", got, before)
+	}
+	if got := b.lastCreate(true)["inbound.length"]; got == "3" {
+		t.Error("dial session wasn't moved back")
+	}
+	if transport.Config().Tunnel.InboundLength != nil {
+		t.Error("config changed by a failed Reconfigure")
+	}
+}
+
+func TestReconfigureRollsBackDrained(t *testing.T) {
+	b := newFakeBridge(t)
+	b.uniqueDests = true
+	transport := storedKeysTransport(t, b, Isolation(i2phelpers.IsolationSeparate))
+	ctx := context.Background()
+	if err := transport.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.dialer.Session(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dialer, main := transport.dialer.Options(), transport.supervisor.Options()
+	// the dial session moves, then the main one makes way for a session the
+	// bridge turns down
+	b.mu.Lock()
+	b.reject = func(req map[string]string) bool {
+		return req["DESTINATION"] != "TRANSIENT" && req["inbound.length"] == "3"
+	}
+	b.mu.Unlock()
+	err := transport.Reconfigure(ctx, TunnelOptions(i2phelpers.TunnelOptions{InboundLength: i2phelpers.Int(3)}))
+	if err == nil {
+		t.Fatal("Reconfigure should have failed")
+	}
+	if got := transport.dialer.Options(); !reflect.DeepEqual(got, dialer) {
+		t.Errorf("dial session left with %v, want %v", got, dialer)
+	}
+	if got := transport.supervisor.Options(); !reflect.DeepEqual(got, main) {
+		t.Errorf("main session left with %v, want %v", got, main)
+	}
+	if transport.supervisor.Current() == nil {
+		t.Error("main session not brought back")
+	}
+	if got := b.lastCreate(false)["inbound.length"]; got == "3" {
+		t.Error("main session left on the new options")
+	}
+	if transport.Config().Tunnel.InboundLength != nil {
+		t.Error("config changed by a failed Reconfigure")
+	}
+}
+
+func TestAdaptiveTunnelsThroughConfig(t *testing.T) {
+	b := newFakeBridge(t)
+	transport := storedKeysTransport(t, b,
+		Isolation(i2phelpers.IsolationSeparate),
+		AdaptiveTunnels(i2pbridge.AdaptiveOptions{
+			MinQuantity: 2,
+			MaxQuantity: 3,
+			Interval:    20 * time.Millisecond,
+			HighStreams: 3,
+			LowStreams:  1,
+			Sustain:     1,
+			Cooldown:    time.Hour,
+		}),
+	)
+	ctx := context.Background()
+	if err := transport.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the load is all on the dial session
+	peer, _ := i2pkeys.NewI2PAddrFromBytes(make([]byte, 387))
+	for i := 0; i < 7; i++ {
+		c, err := transport.dialer.DialContextI2P(ctx, "", peer.Base64())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for st, _ := transport.AdaptiveStats(); st.Ups == 0; st, _ = transport.AdaptiveStats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("didn't scale up, stats %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cfg := transport.Config()
+	if q := cfg.Tunnel.InboundQuantity; q == nil || *q != 3 {
+		t.Errorf("config wasn't changed, inbound quantity %v", q)
+	}
+	for _, create := range []map[string]string{b.lastCreate(false), b.lastCreate(true)} {
+		if create["inbound.quantity"] != "3" || create["outbound.quantity"] != "3" {
+			t.Errorf("session made with %v", create)
+		}
+	}
+	// a later Reconfigure starts from the new quantity
+	if err := transport.Reconfigure(ctx, TunnelOptions(i2phelpers.TunnelOptions{InboundLength: i2phelpers.Int(2)})); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.lastCreate(false)["inbound.quantity"]; got != "3" {
+		t.Errorf("Reconfigure went back to inbound.quantity=%q", got)
+	}
+}